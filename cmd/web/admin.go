@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"chilliweb.com/snippetbox/pkg/forms"
+	"chilliweb.com/snippetbox/pkg/models"
+)
+
+// The most users or snippets listed on an admin page. Searching narrows the
+// list down.
+const adminPageSize = 50
+
+// The systemStats type holds the details about the running server shown on
+// the admin dashboard.
+type systemStats struct {
+	Uptime        time.Duration
+	GoVersion     string
+	Goroutines    int
+	HeapMB        float64
+	WorkersFailed int64
+}
+
+// The adminDashboard handler shows the counts of users, snippets and
+// sessions, and how the server itself is doing.
+func (app *application) adminDashboard(w http.ResponseWriter, r *http.Request) {
+	stats, err := app.stats.Get(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	app.render(w, r, "admin/dashboard.page.tmpl", &templateData{
+		Stats: stats,
+		System: &systemStats{
+			Uptime:        time.Since(app.started).Round(time.Second),
+			GoVersion:     runtime.Version(),
+			Goroutines:    runtime.NumGoroutine(),
+			HeapMB:        float64(mem.HeapAlloc) / (1 << 20),
+			WorkersFailed: app.workersFailed.Load(),
+		},
+	})
+}
+
+// The adminUsers handler lists the users whose name or email address
+// contains the q query string parameter, or the newest users if it's empty.
+func (app *application) adminUsers(w http.ResponseWriter, r *http.Request) {
+	form := forms.New(r.URL.Query())
+
+	users, err := app.users.Search(r.Context(), strings.TrimSpace(form.Get("q")), adminPageSize)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.render(w, r, "admin/users.page.tmpl", &templateData{
+		Form:  form,
+		Users: users,
+		Roles: models.Roles,
+	})
+}
+
+// The adminSnippets handler lists the snippets whose title or content
+// contains the q query string parameter, or the newest snippets if it's
+// empty, including those which have expired.
+func (app *application) adminSnippets(w http.ResponseWriter, r *http.Request) {
+	form := forms.New(r.URL.Query())
+
+	snippets, err := app.snippets.Search(r.Context(), strings.TrimSpace(form.Get("q")), adminPageSize)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.render(w, r, "admin/snippets.page.tmpl", &templateData{
+		Form:     form,
+		Snippets: snippets,
+	})
+}
+
+// The postedID() helper parses the form and returns the positive integer in
+// its id field, or false if there isn't one.
+func postedID(r *http.Request) (int, bool) {
+	if err := r.ParseForm(); err != nil {
+		return 0, false
+	}
+
+	id, err := strconv.Atoi(r.PostForm.Get("id"))
+	if err != nil || id < 1 {
+		return 0, false
+	}
+	return id, true
+}
+
+// The adminDeleteSnippet handler deletes any snippet, whoever created it and
+// whether or not it has expired.
+func (app *application) adminDeleteSnippet(w http.ResponseWriter, r *http.Request) {
+	id, ok := postedID(r)
+	if !ok {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err := app.snippets.Delete(r.Context(), id)
+	if err == models.ErrNoRecord {
+		app.notFound(w)
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.InfoContext(r.Context(), "snippet deleted",
+		slog.Int("snippet_id", id), slog.Int("by_user_id", app.authenticatedUser(r).ID))
+
+	app.session.Put(r, "flash", fmt.Sprintf("Snippet %d has been deleted", id))
+	http.Redirect(w, r, "/admin/snippets", http.StatusSeeOther)
+}
+
+// The adminDeactivateUser and adminActivateUser handlers turn a user's
+// account off and back on again.
+func (app *application) adminDeactivateUser(w http.ResponseWriter, r *http.Request) {
+	app.setUserActive(w, r, false)
+}
+
+func (app *application) adminActivateUser(w http.ResponseWriter, r *http.Request) {
+	app.setUserActive(w, r, true)
+}
+
+// The setUserActive() helper deactivates or reactivates the account in the
+// id form field. Deactivating an account also logs out all of its sessions
+// and forgets its "remember me" tokens. Admins can't deactivate their own
+// account, so that there's always someone left who can turn it back on.
+func (app *application) setUserActive(w http.ResponseWriter, r *http.Request, active bool) {
+	id, ok := postedID(r)
+	if !ok || id == app.authenticatedUser(r).ID {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err := app.users.SetActive(r.Context(), id, active)
+	if err == models.ErrNoRecord {
+		app.notFound(w)
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !active {
+		if err := app.sessionRegistry.RevokeOthers(r.Context(), id, ""); err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		if err := app.rememberTokens.DeleteForUser(r.Context(), id, ""); err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	app.logger.InfoContext(r.Context(), "user active changed",
+		slog.Int("user_id", id), slog.Bool("active", active), slog.Int("by_user_id", app.authenticatedUser(r).ID))
+
+	if active {
+		app.session.Put(r, "flash", fmt.Sprintf("User %d has been reactivated", id))
+	} else {
+		app.session.Put(r, "flash", fmt.Sprintf("User %d has been deactivated", id))
+	}
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// The adminSetRole handler gives the user in the id form field the role in
+// the role field. Admins can't change their own role, for the same reason
+// they can't deactivate themselves.
+func (app *application) adminSetRole(w http.ResponseWriter, r *http.Request) {
+	id, ok := postedID(r)
+	role := r.PostForm.Get("role")
+	if !ok || id == app.authenticatedUser(r).ID || !models.ValidRole(role) {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err := app.users.SetRole(r.Context(), id, role)
+	if err == models.ErrNoRecord {
+		app.notFound(w)
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.InfoContext(r.Context(), "user role changed",
+		slog.Int("user_id", id), slog.String("role", role), slog.Int("by_user_id", app.authenticatedUser(r).ID))
+
+	app.session.Put(r, "flash", fmt.Sprintf("User %d is now a %s", id, role))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// The adminUnlockUser handler unlocks the account in the id form field after
+// too many failed logins, like the -unlock-user command-line flag does.
+func (app *application) adminUnlockUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := postedID(r)
+	if !ok {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err := app.users.UnlockID(r.Context(), id)
+	if err == models.ErrNoRecord {
+		app.notFound(w)
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.logger.InfoContext(r.Context(), "user unlocked",
+		slog.Int("user_id", id), slog.Int("by_user_id", app.authenticatedUser(r).ID))
+
+	app.session.Put(r, "flash", fmt.Sprintf("User %d has been unlocked", id))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestAdminAccess(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		urlPath  string
+		wantCode int
+	}{
+		{"Anonymous dashboard", "", "/admin", http.StatusFound},
+		{"User dashboard", "alice@example.com", "/admin", http.StatusForbidden},
+		{"Moderator dashboard", "moderator@example.com", "/admin", http.StatusOK},
+		{"Moderator snippets", "moderator@example.com", "/admin/snippets", http.StatusOK},
+		{"Moderator users", "moderator@example.com", "/admin/users", http.StatusForbidden},
+		{"Admin dashboard", "admin@example.com", "/admin", http.StatusOK},
+		{"Admin snippets", "admin@example.com", "/admin/snippets", http.StatusOK},
+		{"Admin users", "admin@example.com", "/admin/users", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			if tt.email != "" {
+				ts.login(t, tt.email)
+			}
+
+			code, _, _ := ts.get(t, tt.urlPath)
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+		})
+	}
+}
+
+func TestAdminSearch(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ts.login(t, "admin@example.com")
+
+	tests := []struct {
+		name     string
+		urlPath  string
+		want     []byte
+		dontWant []byte
+	}{
+		{"All users", "/admin/users", []byte("alice@example.com"), nil},
+		{"Matching users", "/admin/users?q=Frank", []byte("deactivated@example.com"), []byte("alice@example.com")},
+		{"Locked user", "/admin/users?q=Grace", []byte("/admin/users/unlock"), nil},
+		{"Unlocked user", "/admin/users?q=Frank", []byte("deactivated@example.com"), []byte("/admin/users/unlock")},
+		{"No users", "/admin/users?q=nobody", []byte("No users found"), nil},
+		{"Matching snippets", "/admin/snippets?q=pond", []byte("An old and silent pond"), nil},
+		{"No snippets", "/admin/snippets?q=frog", []byte("No snippets found"), nil},
+		{"Dashboard", "/admin", []byte("5 active"), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := ts.get(t, tt.urlPath)
+			if code != http.StatusOK {
+				t.Fatalf("want %d; got %d", http.StatusOK, code)
+			}
+			if !bytes.Contains(body, tt.want) {
+				t.Errorf("want body to contain %q", tt.want)
+			}
+			if tt.dontWant != nil && bytes.Contains(body, tt.dontWant) {
+				t.Errorf("want body not to contain %q", tt.dontWant)
+			}
+		})
+	}
+}
+
+func TestAdminActions(t *testing.T) {
+	// The admin is user 4 in the mock UserModel.
+	tests := []struct {
+		name     string
+		email    string
+		urlPath  string
+		form     url.Values
+		wantCode int
+	}{
+		{"Delete snippet", "moderator@example.com", "/admin/snippets/delete", url.Values{"id": {"1"}}, http.StatusSeeOther},
+		{"Delete unknown snippet", "moderator@example.com", "/admin/snippets/delete", url.Values{"id": {"2"}}, http.StatusNotFound},
+		{"Delete invalid ID", "moderator@example.com", "/admin/snippets/delete", url.Values{"id": {"foo"}}, http.StatusBadRequest},
+		{"Delete as user", "alice@example.com", "/admin/snippets/delete", url.Values{"id": {"1"}}, http.StatusForbidden},
+		{"Deactivate user", "admin@example.com", "/admin/users/deactivate", url.Values{"id": {"1"}}, http.StatusSeeOther},
+		{"Deactivate self", "admin@example.com", "/admin/users/deactivate", url.Values{"id": {"4"}}, http.StatusBadRequest},
+		{"Deactivate unknown user", "admin@example.com", "/admin/users/deactivate", url.Values{"id": {"99"}}, http.StatusNotFound},
+		{"Deactivate as moderator", "moderator@example.com", "/admin/users/deactivate", url.Values{"id": {"1"}}, http.StatusForbidden},
+		{"Activate user", "admin@example.com", "/admin/users/activate", url.Values{"id": {"6"}}, http.StatusSeeOther},
+		{"Set role", "admin@example.com", "/admin/users/role", url.Values{"id": {"1"}, "role": {"moderator"}}, http.StatusSeeOther},
+		{"Set invalid role", "admin@example.com", "/admin/users/role", url.Values{"id": {"1"}, "role": {"root"}}, http.StatusBadRequest},
+		{"Set own role", "admin@example.com", "/admin/users/role", url.Values{"id": {"4"}, "role": {"user"}}, http.StatusBadRequest},
+		{"Unlock user", "admin@example.com", "/admin/users/unlock", url.Values{"id": {"7"}}, http.StatusSeeOther},
+		{"Unlock unknown user", "admin@example.com", "/admin/users/unlock", url.Values{"id": {"99"}}, http.StatusNotFound},
+		{"Unlock as moderator", "moderator@example.com", "/admin/users/unlock", url.Values{"id": {"7"}}, http.StatusForbidden},
+		{"Set unknown user's role", "admin@example.com", "/admin/users/role", url.Values{"id": {"99"}, "role": {"user"}}, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			ts.login(t, tt.email)
+
+			_, _, body := ts.get(t, "/account")
+			tt.form.Set("csrf_token", extractCSRFToken(t, body))
+
+			code, _, _ := ts.postForm(t, tt.urlPath, tt.form)
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+		})
+	}
+}
+
+func TestDeactivateUserLogsOut(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+	alice := newTestServer(t, app.routes())
+	defer alice.Close()
+
+	ts.login(t, "admin@example.com")
+	alice.login(t, "alice@example.com")
+
+	_, _, body := ts.get(t, "/admin/users")
+	form := url.Values{}
+	form.Add("id", "1")
+	form.Add("csrf_token", extractCSRFToken(t, body))
+	if code, _, _ := ts.postForm(t, "/admin/users/deactivate", form); code != http.StatusSeeOther {
+		t.Fatalf("want %d; got %d", http.StatusSeeOther, code)
+	}
+
+	if code, _, _ := alice.get(t, "/account"); code != http.StatusFound {
+		t.Errorf("want %d; got %d", http.StatusFound, code)
+	}
+}
+
+func TestLoginDeactivatedUser(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	_, _, body := ts.get(t, "/user/login")
+	form := url.Values{}
+	form.Add("email", "deactivated@example.com")
+	form.Add("password", "validPa$$word")
+	form.Add("csrf_token", extractCSRFToken(t, body))
+
+	code, header, _ := ts.postForm(t, "/user/login", form)
+	if code != http.StatusSeeOther || header.Get("Location") != "/user/login" {
+		t.Errorf("want %d to %q; got %d to %q", http.StatusSeeOther, "/user/login", code, header.Get("Location"))
+	}
+
+	if code, _, _ := ts.get(t, "/account"); code != http.StatusFound {
+		t.Errorf("want %d; got %d", http.StatusFound, code)
+	}
+	if _, _, body := ts.get(t, "/user/login"); !bytes.Contains(body, []byte("This account has been deactivated")) {
+		t.Error("want the deactivated flash message")
+	}
+}
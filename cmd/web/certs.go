@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The certManager type holds the TLS certificate and private key for the
+// server, and reloads them from disk when the files change. It is used via
+// tls.Config.GetCertificate, so a new certificate takes effect for the next
+// TLS handshake without restarting the server.
+type certManager struct {
+	certFile string
+	keyFile  string
+	logger   *slog.Logger
+
+	// How long before the certificate expires to start logging warnings.
+	expiryWarning time.Duration
+
+	// The current certificate is stored in an atomic pointer, so it can be
+	// swapped out without blocking any handshakes in progress.
+	cert atomic.Pointer[tls.Certificate]
+
+	// The mu mutex protects the fields below, which are used to decide
+	// whether the files have changed and when we last warned about expiry.
+	mu         sync.Mutex
+	certMod    time.Time
+	keyMod     time.Time
+	lastWarned time.Time
+}
+
+// The newCertManager() function creates a certManager and loads the initial
+// certificate. Unlike later reloads, failing to load the initial certificate
+// is an error, because we have nothing else to serve.
+func newCertManager(certFile, keyFile string, expiryWarning time.Duration, logger *slog.Logger) (*certManager, error) {
+	m := &certManager{
+		certFile:      certFile,
+		keyFile:       keyFile,
+		expiryWarning: expiryWarning,
+		logger:        logger,
+	}
+
+	if err := m.reload(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// The GetCertificate() method returns the current certificate. It has the
+// signature required by tls.Config.GetCertificate.
+func (m *certManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return m.cert.Load(), nil
+}
+
+// The reload() method loads the certificate and key from disk. If they can't
+// be loaded or parsed, the error is returned and we carry on serving the
+// existing certificate.
+func (m *certManager) reload() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Record the modification times before reading the files, so that if a
+	// file is changed while we're reading it we'll notice and read it again.
+	certMod, keyMod, err := m.modTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(m.certFile, m.keyFile)
+	if err != nil {
+		// Remember the modification times anyway, so that we don't try (and
+		// fail) to load the same broken files again on every check.
+		m.certMod, m.keyMod = certMod, keyMod
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+
+	// Parse the leaf certificate now rather than on every handshake. We
+	// need it for the expiry date too.
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		m.certMod, m.keyMod = certMod, keyMod
+		return fmt.Errorf("parsing TLS certificate: %w", err)
+	}
+
+	m.cert.Store(&cert)
+	m.certMod, m.keyMod = certMod, keyMod
+	m.logger.Info("loaded TLS certificate",
+		slog.Any("dns_names", cert.Leaf.DNSNames),
+		slog.Time("not_after", cert.Leaf.NotAfter),
+	)
+
+	// Always check the expiry date of a newly loaded certificate.
+	m.lastWarned = time.Time{}
+	m.checkExpiry(time.Now())
+
+	return nil
+}
+
+// The reloadIfChanged() method reloads the certificate if either the
+// certificate or key file has been modified since it was last loaded.
+func (m *certManager) reloadIfChanged() error {
+	m.mu.Lock()
+	certMod, keyMod, err := m.modTimes()
+	changed := err == nil && (!certMod.Equal(m.certMod) || !keyMod.Equal(m.keyMod))
+	m.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+
+	return m.reload()
+}
+
+// The modTimes() method returns the modification times of the certificate
+// and key files.
+func (m *certManager) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(m.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	keyInfo, err := os.Stat(m.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// The checkExpiry() method logs a warning if the current certificate expires
+// within the expiry warning period. To avoid flooding the logs it warns at
+// most once a day. The caller must hold m.mu.
+func (m *certManager) checkExpiry(now time.Time) {
+	leaf := m.cert.Load().Leaf
+
+	remaining := leaf.NotAfter.Sub(now)
+	if remaining > m.expiryWarning || now.Sub(m.lastWarned) < 24*time.Hour {
+		return
+	}
+	m.lastWarned = now
+
+	if remaining <= 0 {
+		m.logger.Error("TLS certificate has expired", slog.Time("not_after", leaf.NotAfter))
+		return
+	}
+	m.logger.Warn("TLS certificate expires soon",
+		slog.Time("not_after", leaf.NotAfter),
+		slog.Duration("remaining", remaining.Round(time.Hour)),
+	)
+}
+
+// The watch() method checks the certificate files for changes every interval,
+// and reloads the certificate whenever a value is received on the reload
+// channel (in production, when we receive a SIGHUP signal). It returns when
+// the quit channel is closed, so it can be run with app.background().
+func (m *certManager) watch(quit <-chan struct{}, interval time.Duration, reload <-chan os.Signal) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-reload:
+			m.logger.Info("reloading TLS certificate")
+			if err := m.reload(); err != nil {
+				m.logger.Error(err.Error())
+			}
+		case <-ticker.C:
+			if err := m.reloadIfChanged(); err != nil {
+				m.logger.Error(err.Error())
+			}
+			m.mu.Lock()
+			m.checkExpiry(time.Now())
+			m.mu.Unlock()
+		}
+	}
+}
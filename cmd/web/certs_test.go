@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Create a writeTestCert helper which generates a self-signed certificate
+// with the given serial number and expiry time, and writes it and its private
+// key to the given paths. The files' modification times are set to mod, so
+// that tests don't depend on the resolution of the filesystem's clock.
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64, notAfter, mod time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	for path, data := range map[string][]byte{certFile: certPEM, keyFile: keyPEM} {
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// The currentSerial() helper returns the serial number of the certificate
+// currently being served by the certManager.
+func currentSerial(t *testing.T, m *certManager) int64 {
+	cert, err := m.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.SerialNumber.Int64()
+}
+
+func TestCertManagerReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	start := time.Now().Add(-time.Hour)
+	expiry := time.Now().Add(365 * 24 * time.Hour)
+	writeTestCert(t, certFile, keyFile, 1, expiry, start)
+
+	warnings := new(bytes.Buffer)
+	m, err := newCertManager(certFile, keyFile, 30*24*time.Hour, newTestLogger(warnings, "warn"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if serial := currentSerial(t, m); serial != 1 {
+		t.Fatalf("want serial %d; got %d", 1, serial)
+	}
+
+	// Nothing has changed, so nothing should be reloaded.
+	if err := m.reloadIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the certificate. The change should be picked up.
+	writeTestCert(t, certFile, keyFile, 2, expiry, start.Add(time.Minute))
+	if err := m.reloadIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+	if serial := currentSerial(t, m); serial != 2 {
+		t.Errorf("want serial %d; got %d", 2, serial)
+	}
+
+	// Corrupt the certificate. Reloading should fail, and we should carry on
+	// serving the previous certificate.
+	if err := ioutil.WriteFile(certFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(certFile, start.Add(2*time.Minute), start.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.reloadIfChanged(); err == nil {
+		t.Error("want error reloading corrupt certificate; got nil")
+	}
+	if serial := currentSerial(t, m); serial != 2 {
+		t.Errorf("want serial %d; got %d", 2, serial)
+	}
+
+	// Forcing a reload (as SIGHUP does) also keeps the previous certificate.
+	if err := m.reload(); err == nil {
+		t.Error("want error reloading corrupt certificate; got nil")
+	}
+	if serial := currentSerial(t, m); serial != 2 {
+		t.Errorf("want serial %d; got %d", 2, serial)
+	}
+
+	if warnings.Len() != 0 {
+		t.Errorf("want no expiry warnings; got %q", warnings.String())
+	}
+}
+
+func TestCertManagerWatch(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	expiry := time.Now().Add(365 * 24 * time.Hour)
+	writeTestCert(t, certFile, keyFile, 1, expiry, time.Now())
+
+	m, err := newCertManager(certFile, keyFile, time.Hour, newTestLogger(ioutil.Discard, "info"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quit := make(chan struct{})
+	reload := make(chan os.Signal)
+	done := make(chan struct{})
+	go func() {
+		// Use a long interval, so only the reload channel triggers a reload.
+		m.watch(quit, time.Hour, reload)
+		close(done)
+	}()
+
+	// Replace the files but keep the modification time, so that only a
+	// forced reload notices.
+	writeTestCert(t, certFile, keyFile, 2, expiry, m.certMod)
+	reload <- os.Interrupt
+	// Send a second signal; once it has been received the first reload is
+	// guaranteed to have finished.
+	reload <- os.Interrupt
+
+	if serial := currentSerial(t, m); serial != 2 {
+		t.Errorf("want serial %d; got %d", 2, serial)
+	}
+
+	close(quit)
+	<-done
+}
+
+func TestCertManagerExpiryWarning(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	writeTestCert(t, certFile, keyFile, 1, time.Now().Add(10*24*time.Hour), time.Now())
+
+	warnings := new(bytes.Buffer)
+	m, err := newCertManager(certFile, keyFile, 30*24*time.Hour, newTestLogger(warnings, "warn"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(warnings.String(), "TLS certificate expires soon") {
+		t.Errorf("want expiry warning; got %q", warnings.String())
+	}
+
+	// A second check within a day shouldn't warn again...
+	warnings.Reset()
+	m.checkExpiry(time.Now().Add(time.Hour))
+	if warnings.Len() != 0 {
+		t.Errorf("want no repeated warning; got %q", warnings.String())
+	}
+
+	// ...but one after it has expired should.
+	m.checkExpiry(time.Now().Add(11 * 24 * time.Hour))
+	if !strings.Contains(warnings.String(), "TLS certificate has expired") {
+		t.Errorf("want expired warning; got %q", warnings.String())
+	}
+}
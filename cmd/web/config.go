@@ -0,0 +1,694 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"chilliweb.com/snippetbox/pkg/ldapauth"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// The devSecret is the session secret used when none is configured. It's
+// public knowledge (it's right here in the source code), so validate() refuses
+// to use it outside of development mode.
+const devSecret = "j@883r_w0c|<%-@_pO3m4alL8|`|`rQD"
+
+// Every setting can also be given as an environment variable. The variable
+// name is this prefix followed by the flag name in upper case, with dashes
+// replaced by underscores (so -read-timeout becomes SNIPPETBOX_READ_TIMEOUT).
+const envPrefix = "SNIPPETBOX_"
+
+// The defaultCSP is a strict Content-Security-Policy which only allows scripts
+// and inline styles carrying the per-request nonce, plus the stylesheets and
+// fonts from Google Fonts that the base layout uses. Violations are reported
+// to our /csp-report endpoint.
+const defaultCSP = "default-src 'self'; " +
+	"script-src 'nonce-{nonce}' 'strict-dynamic'; " +
+	"style-src 'self' 'nonce-{nonce}' https://fonts.googleapis.com; " +
+	"font-src https://fonts.gstatic.com; " +
+	"img-src 'self'; " +
+	"object-src 'none'; " +
+	"base-uri 'none'; " +
+	"form-action 'self'; " +
+	"frame-ancestors 'none'; " +
+	"report-uri /csp-report"
+
+// The commandLineOnly flags can't be set from the config file or environment,
+// because they say what to do this time rather than how the server is
+// configured (SNIPPETBOX_UNLOCK_USER left in the environment would stop the
+// server from ever starting).
+var commandLineOnly = map[string]bool{
+	"config":          true,
+	"unlock-user":     true,
+	"make-admin":      true,
+	"generate-secret": true,
+}
+
+// Define a config struct to hold all the configuration settings for the
+// application.
+type config struct {
+	env    string
+	addr   string
+	dsn    string
+	secret string
+	// Secrets which have been replaced by secret, but which tokens signed
+	// before the change are still checked against, and the file to read
+	// all of the secrets from instead of the flags, if any.
+	previousSecrets stringList
+	secretFile      string
+	tls             struct {
+		enabled        bool
+		certFile       string
+		keyFile        string
+		reloadInterval time.Duration
+		expiryWarning  time.Duration
+	}
+	// The address of the optional plain HTTP listener which redirects every
+	// request to HTTPS.
+	redirectAddr string
+	// The address of the optional plain HTTP listener which serves the
+	// Prometheus metrics. This should normally be an internal address.
+	metricsAddr string
+	// Whether to set the Secure flag on the session and CSRF cookies. This
+	// should only be turned off when the site is served over plain HTTP.
+	secureCookies bool
+	// The reverse proxies (such as a TLS-terminating load balancer) whose
+	// X-Forwarded-For and X-Forwarded-Proto headers we trust.
+	trustedProxies ipNetList
+
+	// The security headers sent with every response. The CSP may contain
+	// the placeholder {nonce}, which is replaced with a fresh random nonce
+	// for each request.
+	headers struct {
+		csp               string
+		cspReportOnly     bool
+		referrerPolicy    string
+		permissionsPolicy string
+		hstsMaxAge        time.Duration
+	}
+
+	log struct {
+		format string
+		level  string
+	}
+	tracing struct {
+		endpoint    string
+		insecure    bool
+		sampleRatio float64
+	}
+	timeouts struct {
+		read        time.Duration
+		write       time.Duration
+		idle        time.Duration
+		shutdown    time.Duration
+		drain       time.Duration
+		healthCheck time.Duration
+	}
+	session struct {
+		lifetime time.Duration
+		// Where the session data is kept ("mysql" or "memory"), and how
+		// often expired sessions are deleted from it.
+		store           string
+		cleanupInterval time.Duration
+	}
+	// The public URL of the site, used to build the links in emails. We
+	// don't trust the Host header for this, or anyone could get us to send
+	// a password reset link pointing at their own site.
+	baseURL string
+	mail    struct {
+		from         string
+		smtpAddr     string
+		smtpUsername string
+		smtpPassword string
+		dir          string
+	}
+	tokens struct {
+		passwordReset     time.Duration
+		emailVerification time.Duration
+		loginLink         time.Duration
+		// How long a "remember me" login lasts without being used.
+		rememberMe time.Duration
+	}
+	// Whether users must verify their email address before they can create
+	// snippets.
+	requireVerifiedEmail bool
+
+	lockout struct {
+		threshold   int
+		duration    time.Duration
+		maxDuration time.Duration
+	}
+	// If set, unlock the account with this email address and exit, rather
+	// than starting the server.
+	unlockUser string
+	// If set, give the account with this email address the admin role and
+	// exit, so that the first admin can be set up.
+	makeAdmin string
+	// If set, print a new random secret and exit.
+	generateSecret bool
+
+	// Where users' passwords are checked: against the hashes in our own
+	// database ("local"), or by binding to an LDAP directory ("ldap").
+	authBackend string
+	ldap        struct {
+		url           string
+		startTLS      bool
+		caFile        string
+		bindDN        string
+		bindPassword  string
+		baseDN        string
+		userFilter    string
+		nameAttribute string
+		timeout       time.Duration
+	}
+
+	// The OpenID Connect provider users can log in with, if any. Users who
+	// log in for the first time are linked to the account with the same
+	// (verified) email address, or a new account is created for them if
+	// autoProvision is set.
+	oidc struct {
+		issuer        string
+		clientID      string
+		clientSecret  string
+		name          string
+		autoProvision bool
+	}
+
+	db struct {
+		maxOpenConns    int
+		maxIdleConns    int
+		connMaxLifetime time.Duration
+		connMaxIdleTime time.Duration
+		queryTimeout    time.Duration
+	}
+}
+
+// The loadConfig() function builds the application configuration from, in
+// increasing order of precedence, the built-in defaults, an optional YAML,
+// JSON or TOML config file, SNIPPETBOX_* environment variables and command-line flags.
+// The lookupEnv parameter is normally os.LookupEnv, but tests can pass in
+// something else.
+//
+// Every setting is defined once, as a flag. The config file and environment
+// variables are applied by setting the flag of the same name, so they are
+// parsed and validated in exactly the same way as the command-line.
+func loadConfig(args []string, lookupEnv func(string) (string, bool)) (*config, error) {
+	cfg := &config{}
+
+	fs := flag.NewFlagSet("snippetbox", flag.ContinueOnError)
+
+	configFile := fs.String("config", "", "Path to a YAML, JSON or TOML config file")
+
+	fs.StringVar(&cfg.env, "env", "production", "Environment (development|production)")
+	fs.StringVar(&cfg.addr, "addr", ":4000", "HTTP network address")
+	fs.StringVar(&cfg.dsn, "dsn", "", "MySQL data source name")
+
+	// The session secret is a random key which will be used to sign the
+	// tokens in emailed links. It should be 32 bytes long. (Sessions are
+	// kept on the server, so the session cookie only holds a random token.)
+	fs.StringVar(&cfg.secret, "secret", devSecret, "Session secret key (32 bytes)")
+	fs.Var(&cfg.previousSecrets, "previous-secrets", "Comma-separated previous secret keys, still accepted for existing tokens")
+	fs.StringVar(&cfg.secretFile, "secret-file", "", "File with the secret key on the first line and previous keys on the following lines")
+	fs.BoolVar(&cfg.generateSecret, "generate-secret", false, "Print a new random secret key and exit")
+
+	fs.BoolVar(&cfg.tls.enabled, "tls", true, "Serve HTTPS (set to false to serve plain HTTP)")
+	fs.StringVar(&cfg.tls.certFile, "tls-cert", "./tls/cert.pem", "Path to the TLS certificate")
+	fs.StringVar(&cfg.tls.keyFile, "tls-key", "./tls/key.pem", "Path to the TLS private key")
+	fs.DurationVar(&cfg.tls.reloadInterval, "tls-reload-interval", time.Minute, "How often to check the TLS certificate files for changes")
+	fs.DurationVar(&cfg.tls.expiryWarning, "tls-expiry-warning", 30*24*time.Hour, "Warn when the TLS certificate expires within this period")
+
+	fs.StringVar(&cfg.redirectAddr, "redirect-addr", "", "HTTP network address for redirecting to HTTPS (disabled if empty)")
+	fs.StringVar(&cfg.metricsAddr, "metrics-addr", "localhost:9090", "HTTP network address for the /metrics endpoint (disabled if empty)")
+	fs.BoolVar(&cfg.secureCookies, "secure-cookies", true, "Set the Secure flag on cookies")
+	fs.Var(&cfg.trustedProxies, "trusted-proxies", "Comma-separated IP addresses or CIDR ranges of trusted reverse proxies")
+
+	fs.StringVar(&cfg.headers.csp, "csp", defaultCSP, "Content-Security-Policy, with {nonce} for the per-request nonce (disabled if empty)")
+	fs.BoolVar(&cfg.headers.cspReportOnly, "csp-report-only", false, "Only report CSP violations rather than enforcing the policy")
+	fs.StringVar(&cfg.headers.referrerPolicy, "referrer-policy", "strict-origin-when-cross-origin", "Referrer-Policy header (disabled if empty)")
+	fs.StringVar(&cfg.headers.permissionsPolicy, "permissions-policy", "camera=(), geolocation=(), microphone=(), payment=()", "Permissions-Policy header (disabled if empty)")
+	fs.DurationVar(&cfg.headers.hstsMaxAge, "hsts-max-age", 365*24*time.Hour, "Strict-Transport-Security max-age for HTTPS responses (disabled if 0)")
+
+	fs.StringVar(&cfg.log.format, "log-format", "json", "Log format (json|text)")
+	fs.StringVar(&cfg.log.level, "log-level", "info", "Minimum log level (debug|info|warn|error)")
+
+	fs.StringVar(&cfg.tracing.endpoint, "otlp-endpoint", "", "OTLP/HTTP collector host:port for exporting traces (disabled if empty)")
+	fs.BoolVar(&cfg.tracing.insecure, "otlp-insecure", false, "Export traces over plain HTTP rather than HTTPS")
+	fs.Float64Var(&cfg.tracing.sampleRatio, "trace-sample-ratio", 1, "Fraction of new traces to sample, between 0 and 1")
+
+	fs.DurationVar(&cfg.timeouts.read, "read-timeout", 5*time.Second, "HTTP server read timeout")
+	fs.DurationVar(&cfg.timeouts.write, "write-timeout", 10*time.Second, "HTTP server write timeout")
+	fs.DurationVar(&cfg.timeouts.idle, "idle-timeout", time.Minute, "HTTP server keep-alive idle timeout")
+	fs.DurationVar(&cfg.timeouts.shutdown, "shutdown-timeout", 20*time.Second, "Graceful shutdown timeout")
+	fs.DurationVar(&cfg.timeouts.drain, "drain-delay", 0, "How long to keep serving after failing readiness, before shutting down")
+	fs.DurationVar(&cfg.timeouts.healthCheck, "health-check-timeout", 2*time.Second, "Timeout for each readiness check")
+
+	fs.DurationVar(&cfg.session.lifetime, "session-lifetime", 12*time.Hour, "Session lifetime")
+	fs.StringVar(&cfg.session.store, "session-store", "mysql", "Where to keep session data (mysql|memory)")
+	fs.DurationVar(&cfg.session.cleanupInterval, "session-cleanup-interval", 5*time.Minute, "How often to delete expired sessions")
+
+	fs.StringVar(&cfg.baseURL, "base-url", "https://localhost:4000", "Public URL of the site, for links in emails")
+	fs.StringVar(&cfg.mail.from, "mail-from", "Snippetbox <no-reply@localhost>", "From address for emails")
+	fs.StringVar(&cfg.mail.smtpAddr, "smtp-addr", "", "SMTP server host:port (if empty, emails are written to -mail-dir instead)")
+	fs.StringVar(&cfg.mail.smtpUsername, "smtp-username", "", "SMTP username")
+	fs.StringVar(&cfg.mail.smtpPassword, "smtp-password", "", "SMTP password")
+	fs.StringVar(&cfg.mail.dir, "mail-dir", "./tmp/mail", "Directory to write emails to when no SMTP server is configured")
+	fs.DurationVar(&cfg.tokens.passwordReset, "password-reset-ttl", time.Hour, "How long password reset links are valid for")
+	fs.DurationVar(&cfg.tokens.emailVerification, "email-verification-ttl", 48*time.Hour, "How long email verification links are valid for")
+	fs.DurationVar(&cfg.tokens.loginLink, "login-link-ttl", 15*time.Minute, "How long emailed login links are valid for")
+	fs.DurationVar(&cfg.tokens.rememberMe, "remember-me-ttl", 30*24*time.Hour, "How long a \"remember me\" login lasts without being used")
+	fs.BoolVar(&cfg.requireVerifiedEmail, "require-verified-email", true, "Only let users with a verified email address create snippets")
+
+	fs.IntVar(&cfg.lockout.threshold, "lockout-threshold", 5, "Lock an account after this many failed logins in a row (0 disables lockout)")
+	fs.DurationVar(&cfg.lockout.duration, "lockout-duration", time.Minute, "How long to lock an account for, doubling with each further failure")
+	fs.DurationVar(&cfg.lockout.maxDuration, "lockout-max-duration", 24*time.Hour, "The longest an account can be locked for")
+	fs.StringVar(&cfg.unlockUser, "unlock-user", "", "Unlock the account with this email address and exit")
+	fs.StringVar(&cfg.makeAdmin, "make-admin", "", "Give the account with this email address the admin role and exit")
+
+	fs.StringVar(&cfg.authBackend, "auth-backend", "local", "Where to check passwords (local|ldap)")
+	fs.StringVar(&cfg.ldap.url, "ldap-url", "", "LDAP server URL, like ldaps://ldap.example.com")
+	fs.BoolVar(&cfg.ldap.startTLS, "ldap-start-tls", false, "Upgrade ldap:// connections with StartTLS")
+	fs.StringVar(&cfg.ldap.caFile, "ldap-ca-file", "", "PEM file of CA certificates to trust for the LDAP server (system roots if empty)")
+	fs.StringVar(&cfg.ldap.bindDN, "ldap-bind-dn", "", "DN to bind as to search for users (anonymous if empty)")
+	fs.StringVar(&cfg.ldap.bindPassword, "ldap-bind-password", "", "Password for -ldap-bind-dn")
+	fs.StringVar(&cfg.ldap.baseDN, "ldap-base-dn", "", "DN to search for users under")
+	fs.StringVar(&cfg.ldap.userFilter, "ldap-user-filter", "(mail=%s)", "LDAP filter for finding a user, with %s for their email address")
+	fs.StringVar(&cfg.ldap.nameAttribute, "ldap-name-attribute", "cn", "LDAP attribute holding the user's name")
+	fs.DurationVar(&cfg.ldap.timeout, "ldap-timeout", 5*time.Second, "Maximum time for checking a password with the LDAP server")
+
+	fs.StringVar(&cfg.oidc.issuer, "oidc-issuer", "", "OpenID Connect issuer URL for single sign-on (disabled if empty)")
+	fs.StringVar(&cfg.oidc.clientID, "oidc-client-id", "", "OpenID Connect client ID")
+	fs.StringVar(&cfg.oidc.clientSecret, "oidc-client-secret", "", "OpenID Connect client secret")
+	fs.StringVar(&cfg.oidc.name, "oidc-name", "SSO", "Name of the OpenID Connect provider, shown on the login page")
+	fs.BoolVar(&cfg.oidc.autoProvision, "oidc-auto-provision", true, "Create accounts for new users who log in with OpenID Connect")
+
+	fs.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "MySQL max open connections (0 is unlimited)")
+	fs.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "MySQL max idle connections")
+	fs.DurationVar(&cfg.db.connMaxLifetime, "db-conn-max-lifetime", time.Hour, "MySQL max connection lifetime (0 is unlimited)")
+	fs.DurationVar(&cfg.db.connMaxIdleTime, "db-conn-max-idle-time", 15*time.Minute, "MySQL max connection idle time (0 is unlimited)")
+	fs.DurationVar(&cfg.db.queryTimeout, "db-query-timeout", 3*time.Second, "Maximum time a single database query may take")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Generating a secret doesn't need any of the configuration, so don't
+	// insist that it's valid.
+	if cfg.generateSecret {
+		return cfg, nil
+	}
+
+	// Remember which flags were given explicitly on the command-line, so that
+	// we can re-apply them after the config file and environment variables.
+	explicit := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+
+	// Apply the config file, if there is one.
+	path := *configFile
+	if path == "" {
+		path, _ = lookupEnv(envPrefix + "CONFIG")
+	}
+	if path != "" {
+		values, err := readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		// Sort the names so that any error we report is deterministic.
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if commandLineOnly[name] || fs.Lookup(name) == nil {
+				return nil, fmt.Errorf("config file %s: unknown setting %q", path, name)
+			}
+			if err := fs.Set(name, values[name]); err != nil {
+				return nil, fmt.Errorf("config file %s: invalid value for %q: %w", path, name, err)
+			}
+		}
+	}
+
+	// Apply any environment variables.
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if commandLineOnly[f.Name] {
+			return
+		}
+		key := envVar(f.Name)
+		if value, ok := lookupEnv(key); ok {
+			if err := fs.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Errorf("invalid value for %s: %w", key, err))
+			}
+		}
+	})
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	// And finally re-apply the command-line flags, which take precedence over
+	// everything else.
+	for name, value := range explicit {
+		fs.Set(name, value)
+	}
+
+	// The secrets in a secret file replace any given by the other settings.
+	if cfg.secretFile != "" {
+		secrets, err := readSecretFile(cfg.secretFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.secret, cfg.previousSecrets = secrets[0], secrets[1:]
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// The envVar() helper returns the environment variable name for a flag.
+func envVar(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// The readConfigFile() function reads a config file containing a flat mapping
+// of setting names (the same as the flag names) to values. YAML, JSON and
+// TOML files are supported; JSON is a subset of YAML so we use the same
+// parser for both.
+func readConfigFile(path string) (map[string]string, error) {
+	var unmarshal func([]byte) (map[string]string, error)
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+		unmarshal = unmarshalYAML
+	case ".toml":
+		unmarshal = unmarshalTOML
+	default:
+		return nil, fmt.Errorf("config file %s: unsupported format (must be .yaml, .yml, .json or .toml)", path)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := unmarshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	return values, nil
+}
+
+// The unmarshalYAML() function decodes a YAML or JSON config file. Decoding
+// straight into strings turns numbers and booleans into their text, and
+// fails on anything which isn't a single value.
+func unmarshalYAML(data []byte) (map[string]string, error) {
+	values := map[string]string{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// The unmarshalTOML() function decodes a TOML config file. The TOML decoder
+// won't turn numbers and booleans into strings for us, so we decode into
+// interface values and format them ourselves, rejecting tables and arrays
+// so that the file stays a flat mapping like the YAML one.
+func unmarshalTOML(data []byte) (map[string]string, error) {
+	var raw map[string]interface{}
+	if err := toml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	for name, value := range raw {
+		switch value.(type) {
+		case map[string]interface{}, []map[string]interface{}, []interface{}:
+			return nil, fmt.Errorf("setting %q must be a single value", name)
+		}
+		values[name] = fmt.Sprint(value)
+	}
+	return values, nil
+}
+
+// The readSecretFile() function reads a file of secret keys, one per line,
+// with the current key first. Blank lines and lines starting with # are
+// ignored, so the file can say when each key was added.
+func readSecretFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		secrets = append(secrets, line)
+	}
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("secret file %s: no secrets found", path)
+	}
+
+	return secrets, nil
+}
+
+// The validate() method checks that the configuration is complete and safe to
+// run with, returning an error describing every problem it finds.
+func (cfg *config) validate() error {
+	var errs []error
+
+	switch cfg.env {
+	case "development", "production":
+	default:
+		errs = append(errs, fmt.Errorf("env must be \"development\" or \"production\"; got %q", cfg.env))
+	}
+
+	if cfg.addr == "" {
+		errs = append(errs, errors.New("addr must be provided"))
+	}
+
+	if cfg.dsn == "" {
+		errs = append(errs, errors.New("dsn must be provided"))
+	}
+
+	if len(cfg.secret) != 32 {
+		errs = append(errs, fmt.Errorf("secret must be exactly 32 bytes long; got %d", len(cfg.secret)))
+	}
+	if cfg.secret == devSecret && cfg.env != "development" {
+		errs = append(errs, errors.New("secret must be changed from the default outside of development mode"))
+	}
+	for i, secret := range cfg.previousSecrets {
+		if len(secret) != 32 {
+			errs = append(errs, fmt.Errorf("previous secret %d must be exactly 32 bytes long; got %d", i+1, len(secret)))
+		}
+	}
+
+	if cfg.tls.enabled && (cfg.tls.certFile == "" || cfg.tls.keyFile == "") {
+		errs = append(errs, errors.New("tls-cert and tls-key must be provided"))
+	}
+	if cfg.tls.enabled && cfg.tls.reloadInterval <= 0 {
+		errs = append(errs, errors.New("tls-reload-interval must be greater than zero"))
+	}
+
+	if cfg.redirectAddr != "" && !cfg.tls.enabled {
+		errs = append(errs, errors.New("redirect-addr can only be used when tls is enabled"))
+	}
+
+	if cfg.headers.hstsMaxAge < 0 {
+		errs = append(errs, errors.New("hsts-max-age must not be negative"))
+	}
+
+	if _, err := newLogger(io.Discard, cfg.log.format, cfg.log.level); err != nil {
+		errs = append(errs, err)
+	}
+
+	if cfg.tracing.sampleRatio < 0 || cfg.tracing.sampleRatio > 1 {
+		errs = append(errs, errors.New("trace-sample-ratio must be between 0 and 1"))
+	}
+
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"read-timeout", cfg.timeouts.read},
+		{"write-timeout", cfg.timeouts.write},
+		{"idle-timeout", cfg.timeouts.idle},
+		{"shutdown-timeout", cfg.timeouts.shutdown},
+		{"session-lifetime", cfg.session.lifetime},
+		{"session-cleanup-interval", cfg.session.cleanupInterval},
+		{"health-check-timeout", cfg.timeouts.healthCheck},
+		{"db-query-timeout", cfg.db.queryTimeout},
+		{"password-reset-ttl", cfg.tokens.passwordReset},
+		{"email-verification-ttl", cfg.tokens.emailVerification},
+		{"login-link-ttl", cfg.tokens.loginLink},
+		{"remember-me-ttl", cfg.tokens.rememberMe},
+	} {
+		if d.value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be greater than zero", d.name))
+		}
+	}
+
+	if cfg.session.store != "mysql" && cfg.session.store != "memory" {
+		errs = append(errs, fmt.Errorf("session-store must be \"mysql\" or \"memory\"; got %q", cfg.session.store))
+	}
+
+	if cfg.timeouts.drain < 0 {
+		errs = append(errs, errors.New("drain-delay must not be negative"))
+	}
+
+	if u, err := url.Parse(cfg.baseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("base-url must be an absolute http or https URL; got %q", cfg.baseURL))
+	}
+
+	if _, err := mail.ParseAddress(cfg.mail.from); err != nil {
+		errs = append(errs, fmt.Errorf("mail-from must be a valid email address; got %q", cfg.mail.from))
+	}
+
+	if cfg.lockout.threshold < 0 {
+		errs = append(errs, errors.New("lockout-threshold must not be negative"))
+	}
+	if cfg.lockout.threshold > 0 && (cfg.lockout.duration <= 0 || cfg.lockout.maxDuration < cfg.lockout.duration) {
+		errs = append(errs, errors.New("lockout-duration must be greater than zero and no more than lockout-max-duration"))
+	}
+
+	switch cfg.authBackend {
+	case "local":
+	case "ldap":
+		if u, err := url.Parse(cfg.ldap.url); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("ldap-url must be an ldap or ldaps URL; got %q", cfg.ldap.url))
+		} else if cfg.ldap.startTLS && u.Scheme == "ldaps" {
+			errs = append(errs, errors.New("ldap-start-tls can only be used with an ldap:// URL"))
+		}
+		if cfg.ldap.baseDN == "" {
+			errs = append(errs, errors.New("ldap-base-dn must be provided"))
+		}
+		if err := ldapauth.ValidateFilter(cfg.ldap.userFilter); err != nil {
+			errs = append(errs, fmt.Errorf("ldap-user-filter is invalid: %w", err))
+		}
+		if cfg.ldap.timeout <= 0 {
+			errs = append(errs, errors.New("ldap-timeout must be greater than zero"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("auth-backend must be \"local\" or \"ldap\"; got %q", cfg.authBackend))
+	}
+
+	if cfg.oidc.issuer != "" {
+		if u, err := url.Parse(cfg.oidc.issuer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("oidc-issuer must be an absolute http or https URL; got %q", cfg.oidc.issuer))
+		}
+		if cfg.oidc.clientID == "" {
+			errs = append(errs, errors.New("oidc-client-id must be provided when oidc-issuer is set"))
+		}
+	}
+
+	if cfg.db.maxOpenConns < 0 || cfg.db.maxIdleConns < 0 || cfg.db.connMaxLifetime < 0 || cfg.db.connMaxIdleTime < 0 {
+		errs = append(errs, errors.New("db pool limits must not be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// The stringList type is a list of strings which implements the flag.Value
+// interface, so it can be set from a comma-separated list.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	list := stringList{}
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+
+	*l = list
+	return nil
+}
+
+// The ipNetList type is a list of IP networks which implements the flag.Value
+// interface, so it can be set from a comma-separated list of IP addresses and
+// CIDR ranges like "10.0.0.0/8,192.168.1.1". A single IP address is treated as
+// a network containing just that address.
+type ipNetList []*net.IPNet
+
+func (l *ipNetList) String() string {
+	if l == nil {
+		return ""
+	}
+
+	s := make([]string, len(*l))
+	for i, n := range *l {
+		s[i] = n.String()
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *ipNetList) Set(value string) error {
+	list := ipNetList{}
+
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return fmt.Errorf("invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return err
+		}
+		list = append(list, n)
+	}
+
+	*l = list
+	return nil
+}
+
+// The contains() method reports whether ip is in any of the networks.
+func (l ipNetList) contains(ip net.IP) bool {
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The fakeEnv type is a map of environment variables, with a lookup method
+// that can be passed to loadConfig() in place of os.LookupEnv.
+type fakeEnv map[string]string
+
+func (e fakeEnv) lookup(key string) (string, bool) {
+	v, ok := e[key]
+	return v, ok
+}
+
+// Create a writeConfigFile helper which writes a config file with the given
+// name and contents to a temporary directory, and returns its path.
+func writeConfigFile(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := ioutil.WriteFile(path, []byte(contents), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+env: development
+addr: ":5000"
+dsn: "file@/snippetbox"
+read-timeout: 1s
+write-timeout: 2s
+db-max-open-conns: 5
+`)
+
+	env := fakeEnv{
+		"SNIPPETBOX_CONFIG":        path,
+		"SNIPPETBOX_ADDR":          ":6000",
+		"SNIPPETBOX_WRITE_TIMEOUT": "3s",
+	}
+
+	cfg, err := loadConfig([]string{"-addr", ":7000"}, env.lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"Flag beats env and file", cfg.addr, ":7000"},
+		{"Env beats file", cfg.timeouts.write, 3 * time.Second},
+		{"File beats default", cfg.timeouts.read, time.Second},
+		{"File string", cfg.dsn, "file@/snippetbox"},
+		{"File int", cfg.db.maxOpenConns, 5},
+		{"Default", cfg.session.lifetime, 12 * time.Hour},
+		{"Default TLS cert", cfg.tls.certFile, "./tls/cert.pem"},
+		{"Default secure cookies", cfg.secureCookies, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("want %v; got %v", tt.want, tt.got)
+			}
+		})
+	}
+}
+
+func TestLoadConfigJSON(t *testing.T) {
+	path := writeConfigFile(t, "config.json", `{"env": "development", "dsn": "json@/snippetbox", "db-max-idle-conns": 3}`)
+
+	cfg, err := loadConfig([]string{"-config", path}, fakeEnv{}.lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.dsn != "json@/snippetbox" {
+		t.Errorf("want %q; got %q", "json@/snippetbox", cfg.dsn)
+	}
+
+	if cfg.db.maxIdleConns != 3 {
+		t.Errorf("want %d; got %d", 3, cfg.db.maxIdleConns)
+	}
+}
+
+func TestLoadConfigTOML(t *testing.T) {
+	path := writeConfigFile(t, "config.toml", `
+env = "development"
+dsn = "toml@/snippetbox"
+db-max-idle-conns = 3
+session-lifetime = "6h"
+secure-cookies = false
+`)
+
+	cfg, err := loadConfig([]string{"-config", path}, fakeEnv{}.lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.dsn != "toml@/snippetbox" {
+		t.Errorf("want %q; got %q", "toml@/snippetbox", cfg.dsn)
+	}
+
+	if cfg.db.maxIdleConns != 3 {
+		t.Errorf("want %d; got %d", 3, cfg.db.maxIdleConns)
+	}
+
+	if cfg.session.lifetime != 6*time.Hour {
+		t.Errorf("want %v; got %v", 6*time.Hour, cfg.session.lifetime)
+	}
+
+	if cfg.secureCookies {
+		t.Errorf("want %v; got %v", false, cfg.secureCookies)
+	}
+}
+
+func TestLoadConfigSecretFile(t *testing.T) {
+	primary := strings.Repeat("a", 32)
+	previous := strings.Repeat("b", 32)
+	path := writeConfigFile(t, "secrets", "# Added 2020-02-01\n"+primary+"\n\n# Added 2020-01-01\n"+previous+"\n")
+
+	cfg, err := loadConfig([]string{"-dsn", "web@/snippetbox", "-secret-file", path}, fakeEnv{}.lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.secret != primary {
+		t.Errorf("want %q; got %q", primary, cfg.secret)
+	}
+	if len(cfg.previousSecrets) != 1 || cfg.previousSecrets[0] != previous {
+		t.Errorf("want %q; got %q", []string{previous}, cfg.previousSecrets)
+	}
+
+	// A file with only comments is an error, rather than falling back to
+	// the default secret.
+	path = writeConfigFile(t, "empty", "# Nothing here\n")
+	_, err = loadConfig([]string{"-dsn", "web@/snippetbox", "-secret-file", path}, fakeEnv{}.lookup)
+	if err == nil || !strings.Contains(err.Error(), "no secrets found") {
+		t.Errorf("want error containing %q; got %v", "no secrets found", err)
+	}
+}
+
+func TestLoadConfigGenerateSecret(t *testing.T) {
+	// Generating a secret doesn't need a valid configuration.
+	cfg, err := loadConfig([]string{"-generate-secret"}, fakeEnv{}.lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.generateSecret {
+		t.Error("want generateSecret to be set")
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		env     fakeEnv
+		wantErr string
+	}{
+		{
+			name:    "Missing DSN",
+			args:    []string{"-env", "development"},
+			wantErr: "dsn must be provided",
+		},
+		{
+			name:    "Default secret in production",
+			args:    []string{"-dsn", "web@/snippetbox"},
+			wantErr: "secret must be changed from the default",
+		},
+		{
+			name:    "Short secret",
+			args:    []string{"-dsn", "web@/snippetbox", "-secret", "tooshort"},
+			wantErr: "secret must be exactly 32 bytes long",
+		},
+		{
+			name:    "Short previous secret",
+			args:    []string{"-dsn", "web@/snippetbox", "-secret", strings.Repeat("a", 32), "-previous-secrets", strings.Repeat("b", 32) + ",tooshort"},
+			wantErr: "previous secret 2 must be exactly 32 bytes long",
+		},
+		{
+			name:    "Unknown environment",
+			args:    []string{"-dsn", "web@/snippetbox", "-env", "staging"},
+			wantErr: "env must be",
+		},
+		{
+			name:    "Invalid environment variable",
+			args:    []string{"-env", "development", "-dsn", "web@/snippetbox"},
+			env:     fakeEnv{"SNIPPETBOX_READ_TIMEOUT": "soon"},
+			wantErr: "invalid value for SNIPPETBOX_READ_TIMEOUT",
+		},
+		{
+			name:    "Zero timeout",
+			args:    []string{"-env", "development", "-dsn", "web@/snippetbox", "-idle-timeout", "0s"},
+			wantErr: "idle-timeout must be greater than zero",
+		},
+		{
+			name:    "Invalid trusted proxy",
+			args:    []string{"-env", "development", "-dsn", "web@/snippetbox", "-trusted-proxies", "10.0.0.0/8,proxy"},
+			wantErr: `invalid IP address "proxy"`,
+		},
+		{
+			name:    "Redirect without TLS",
+			args:    []string{"-env", "development", "-dsn", "web@/snippetbox", "-tls=false", "-redirect-addr", ":80"},
+			wantErr: "redirect-addr can only be used when tls is enabled",
+		},
+		{
+			name:    "Invalid log format",
+			args:    []string{"-env", "development", "-dsn", "web@/snippetbox", "-log-format", "xml"},
+			wantErr: `invalid log format "xml"`,
+		},
+		{
+			name:    "Lockout longer than maximum",
+			args:    []string{"-env", "development", "-dsn", "web@/snippetbox", "-lockout-duration", "2h", "-lockout-max-duration", "1h"},
+			wantErr: "lockout-duration must be greater than zero and no more than lockout-max-duration",
+		},
+		{
+			name:    "Unknown session store",
+			args:    []string{"-env", "development", "-dsn", "web@/snippetbox", "-session-store", "redis"},
+			wantErr: `session-store must be "mysql" or "memory"`,
+		},
+		{
+			name:    "Unknown auth backend",
+			args:    []string{"-env", "development", "-dsn", "web@/snippetbox", "-auth-backend", "kerberos"},
+			wantErr: `auth-backend must be "local" or "ldap"`,
+		},
+		{
+			name:    "LDAP without base DN",
+			args:    []string{"-env", "development", "-dsn", "web@/snippetbox", "-auth-backend", "ldap", "-ldap-url", "ldaps://ldap.example.com"},
+			wantErr: "ldap-base-dn must be provided",
+		},
+		{
+			name:    "LDAP StartTLS with ldaps",
+			args:    []string{"-env", "development", "-dsn", "web@/snippetbox", "-auth-backend", "ldap", "-ldap-url", "ldaps://ldap.example.com", "-ldap-base-dn", "dc=example,dc=com", "-ldap-start-tls"},
+			wantErr: "ldap-start-tls can only be used with an ldap:// URL",
+		},
+		{
+			name:    "LDAP filter without placeholder",
+			args:    []string{"-env", "development", "-dsn", "web@/snippetbox", "-auth-backend", "ldap", "-ldap-url", "ldap://ldap.example.com", "-ldap-base-dn", "dc=example,dc=com", "-ldap-user-filter", "(mail=alice)"},
+			wantErr: "ldap-user-filter is invalid",
+		},
+		{
+			name:    "OIDC issuer without client ID",
+			args:    []string{"-env", "development", "-dsn", "web@/snippetbox", "-oidc-issuer", "https://idp.example.com"},
+			wantErr: "oidc-client-id must be provided when oidc-issuer is set",
+		},
+		{
+			name:    "Relative OIDC issuer",
+			args:    []string{"-env", "development", "-dsn", "web@/snippetbox", "-oidc-issuer", "idp.example.com", "-oidc-client-id", "snippetbox"},
+			wantErr: "oidc-issuer must be an absolute http or https URL",
+		},
+		{
+			name:    "Unknown flag",
+			args:    []string{"-nope"},
+			wantErr: "flag provided but not defined",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env == nil {
+				tt.env = fakeEnv{}
+			}
+
+			_, err := loadConfig(tt.args, tt.env.lookup)
+			if err == nil {
+				t.Fatalf("want error containing %q; got nil", tt.wantErr)
+			}
+
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("want error containing %q; got %q", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		contents string
+		wantErr  string
+	}{
+		{"Unknown setting", "config.yaml", "colour: blue", `unknown setting "colour"`},
+		{"Invalid value", "config.yaml", "read-timeout: soon", `invalid value for "read-timeout"`},
+		{"Unsupported format", "config.ini", `addr = :4000`, "unsupported format"},
+		{"TOML table", "config.toml", "[db]\nmax-open-conns = 25", `setting "db" must be a single value`},
+		{"TOML syntax error", "config.toml", `addr = `, "config file"},
+		{"Command-line only setting", "config.yaml", "unlock-user: alice@example.com", `unknown setting "unlock-user"`},
+		{"Command-line only admin", "config.yaml", "make-admin: alice@example.com", `unknown setting "make-admin"`},
+		{"Generate secret in file", "config.yaml", "generate-secret: true", `unknown setting "generate-secret"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfigFile(t, tt.file, tt.contents)
+
+			_, err := loadConfig([]string{"-config", path}, fakeEnv{}.lookup)
+			if err == nil {
+				t.Fatalf("want error containing %q; got nil", tt.wantErr)
+			}
+
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("want error containing %q; got %q", tt.wantErr, err)
+			}
+		})
+	}
+}
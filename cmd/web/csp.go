@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// The maxCSPReportSize is the largest violation report we'll read. Real
+// reports are a few hundred bytes, so anything much bigger is junk.
+const maxCSPReportSize = 64 * 1024
+
+// The cspViolation type holds the parts of a Content-Security-Policy violation
+// report which we log. Browsers send reports in one of two formats: the older
+// report-uri format (a "csp-report" object with dashed field names, sent as
+// application/csp-report) and the Reporting API format (an array of reports
+// with camelCase field names, sent as application/reports+json). Both are
+// decoded into this type.
+type cspViolation struct {
+	DocumentURI        string `json:"document-uri"`
+	Referrer           string `json:"referrer"`
+	ViolatedDirective  string `json:"violated-directive"`
+	EffectiveDirective string `json:"effective-directive"`
+	BlockedURI         string `json:"blocked-uri"`
+	SourceFile         string `json:"source-file"`
+	LineNumber         int    `json:"line-number"`
+	Disposition        string `json:"disposition"`
+}
+
+// The reportingAPIViolation type is the body of a csp-violation report in the
+// Reporting API format.
+type reportingAPIViolation struct {
+	DocumentURL        string `json:"documentURL"`
+	Referrer           string `json:"referrer"`
+	EffectiveDirective string `json:"effectiveDirective"`
+	BlockedURL         string `json:"blockedURL"`
+	SourceFile         string `json:"sourceFile"`
+	LineNumber         int    `json:"lineNumber"`
+	Disposition        string `json:"disposition"`
+}
+
+// The cspReport handler receives Content-Security-Policy violation reports
+// from browsers and logs them, so that we can spot both attacks and parts of
+// the site which the policy breaks (which is what the report-only mode is
+// for).
+func (app *application) cspReport(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCSPReportSize))
+	if err != nil {
+		app.clientError(w, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	violations, err := parseCSPReport(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	for _, v := range violations {
+		app.logger.WarnContext(r.Context(), "CSP violation",
+			slog.String("document_uri", v.DocumentURI),
+			slog.String("referrer", v.Referrer),
+			slog.String("violated_directive", v.ViolatedDirective),
+			slog.String("effective_directive", v.EffectiveDirective),
+			slog.String("blocked_uri", v.BlockedURI),
+			slog.String("source_file", v.SourceFile),
+			slog.Int("line_number", v.LineNumber),
+			slog.String("disposition", v.Disposition),
+			slog.String("user_agent", r.UserAgent()),
+		)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// The parseCSPReport() function decodes a violation report in either of the
+// formats browsers use. Reports of other types sent with the Reporting API
+// (like deprecation warnings) are ignored.
+func parseCSPReport(contentType string, body []byte) ([]cspViolation, error) {
+	if strings.HasPrefix(contentType, "application/reports+json") {
+		var reports []struct {
+			Type string                `json:"type"`
+			Body reportingAPIViolation `json:"body"`
+		}
+		if err := json.Unmarshal(body, &reports); err != nil {
+			return nil, err
+		}
+
+		var violations []cspViolation
+		for _, report := range reports {
+			if report.Type != "csp-violation" {
+				continue
+			}
+			violations = append(violations, cspViolation{
+				DocumentURI:        report.Body.DocumentURL,
+				Referrer:           report.Body.Referrer,
+				EffectiveDirective: report.Body.EffectiveDirective,
+				BlockedURI:         report.Body.BlockedURL,
+				SourceFile:         report.Body.SourceFile,
+				LineNumber:         report.Body.LineNumber,
+				Disposition:        report.Body.Disposition,
+			})
+		}
+		return violations, nil
+	}
+
+	var report struct {
+		Violation *cspViolation `json:"csp-report"`
+	}
+	if err := json.Unmarshal(body, &report); err != nil {
+		return nil, err
+	}
+	if report.Violation == nil {
+		return nil, nil
+	}
+	return []cspViolation{*report.Violation}, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCSPReport(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantCode    int
+		wantLog     string
+	}{
+		{
+			name:        "report-uri format",
+			contentType: "application/csp-report",
+			body:        `{"csp-report":{"document-uri":"https://example.com/","violated-directive":"script-src","blocked-uri":"https://evil.example.com/x.js"}}`,
+			wantCode:    http.StatusNoContent,
+			wantLog:     "blocked_uri=https://evil.example.com/x.js",
+		},
+		{
+			name:        "Reporting API format",
+			contentType: "application/reports+json",
+			body:        `[{"type":"csp-violation","body":{"documentURL":"https://example.com/","effectiveDirective":"style-src-elem","blockedURL":"inline"}}]`,
+			wantCode:    http.StatusNoContent,
+			wantLog:     "effective_directive=style-src-elem",
+		},
+		{
+			name:        "Invalid JSON",
+			contentType: "application/csp-report",
+			body:        `{"csp-report":`,
+			wantCode:    http.StatusBadRequest,
+		},
+		{
+			name:        "Too large",
+			contentType: "application/csp-report",
+			body:        strings.Repeat("x", maxCSPReportSize+1),
+			wantCode:    http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			logs := new(bytes.Buffer)
+			app.logger = newTestLogger(logs, "info")
+
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			rs, err := ts.Client().Post(ts.URL+"/csp-report", tt.contentType, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rs.Body.Close()
+
+			if rs.StatusCode != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, rs.StatusCode)
+			}
+
+			if tt.wantLog != "" && !strings.Contains(logs.String(), tt.wantLog) {
+				t.Errorf("want log to contain %q; got %q", tt.wantLog, logs.String())
+			}
+		})
+	}
+}
+
+func TestCSPReportRateLimit(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	body := `{"csp-report":{"document-uri":"https://example.com/","violated-directive":"script-src"}}`
+
+	var code int
+	for i := 0; i < 61; i++ {
+		rs, err := ts.Client().Post(ts.URL+"/csp-report", "application/csp-report", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs.Body.Close()
+		code = rs.StatusCode
+	}
+
+	if code != http.StatusTooManyRequests {
+		t.Errorf("want %d; got %d", http.StatusTooManyRequests, code)
+	}
+}
+
+func TestCSPNonceInPage(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	_, header, body := ts.get(t, "/")
+
+	policy := header.Get("Content-Security-Policy")
+	start := strings.Index(policy, "'nonce-")
+	if start == -1 {
+		t.Fatalf("want a nonce in the policy; got %q", policy)
+	}
+	nonce := strings.SplitN(policy[start+len("'nonce-"):], "'", 2)[0]
+
+	want := []byte("<script src='/static/js/main.js' type='text/javascript' nonce='" + nonce + "'>")
+	if !bytes.Contains(body, want) {
+		t.Errorf("want body to contain %q", want)
+	}
+}
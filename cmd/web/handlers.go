@@ -2,11 +2,20 @@ package main
 
 import (
 	"fmt"
+	"html/template"
+	"image/png"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"time"
 
 	"chilliweb.com/snippetbox/pkg/forms"
+	"chilliweb.com/snippetbox/pkg/mailer"
 	"chilliweb.com/snippetbox/pkg/models"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
 )
 
 // Change the signature of the handler so it is defined as a method against *application
@@ -14,9 +23,9 @@ func (app *application) home(w http.ResponseWriter, r *http.Request) {
 	// The Pat router explicitly matches the "/" path exactly, we can now remove the manual check
 	// of r.URL.Path != "/" from this handler.
 
-	s, err := app.snippets.Latest()
+	s, err := app.snippets.Latest(r.Context())
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 
@@ -40,12 +49,12 @@ func (app *application) showSnippet(w http.ResponseWriter, r *http.Request) {
 	// Use the SnippetModel object's Get method to retrieve data for a
 	// specific record based on its ID. If no matching record is found,
 	// return a 404 Not Found resource
-	s, err := app.snippets.Get(id)
+	s, err := app.snippets.Get(r.Context(), id)
 	if err == models.ErrNoRecord {
 		app.notFound(w)
 		return
 	} else if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
 
@@ -94,11 +103,12 @@ func (app *application) createSnippet(w http.ResponseWriter, r *http.Request) {
 	// Because the form data (with type url.Values) has been anonymously embedded
 	// in the form.Form struct, we use the Get() method to retrieve
 	// the validated value fro a particular form field.
-	id, err := app.snippets.Insert(form.Get("title"), form.Get("content"), form.Get("expires"))
+	id, err := app.snippets.Insert(r.Context(), form.Get("title"), form.Get("content"), form.Get("expires"))
 	if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
+	app.metrics.snippetsCreated.Inc()
 
 	// Uset the Put() method to add a string value ("Snippet successfully created!")
 	// and the corresponding key ("flash") to the session data.
@@ -139,27 +149,33 @@ func (app *application) signupUser(w http.ResponseWriter, r *http.Request) {
 
 	// Try to create a new user in the database. If the email address already exists
 	// add an error message to the form and redisplay it
-	err = app.users.Insert(form.Get("name"), form.Get("email"), form.Get("password"))
+	id, err := app.users.Insert(r.Context(), form.Get("name"), form.Get("email"), form.Get("password"))
 	if err == models.ErrDuplicateEmail {
 		form.Errors.Add("email", "Address is already in use")
 		app.render(w, r, "signup.page.tmpl", &templateData{Form: form})
 		return
 	} else if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
 		return
 	}
+	app.metrics.usersCreated.Inc()
+
+	// Send the user a link to verify their email address.
+	app.sendMail(r.Context(), app.verificationEmail(id, form.Get("email")))
 
 	// Otherwise add a confirmation flash message to the session confirming that
 	// their signup worked and asking them to login.
-	app.session.Put(r, "flash", "Your signup was successful. Please login")
+	app.session.Put(r, "flash", "Your signup was successful. We've emailed you a link to verify your address. Please login")
 
 	// And redirect the user to the login page.
 	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 }
 
+// The loginUserForm handler shows the login form. The next parameter is the
+// page to go to after logging in, which is passed along with the form.
 func (app *application) loginUserForm(w http.ResponseWriter, r *http.Request) {
 	app.render(w, r, "login.page.tmpl", &templateData{
-		Form: forms.New(nil),
+		Form: forms.New(url.Values{"next": {r.URL.Query().Get("next")}}),
 	})
 }
 
@@ -170,35 +186,805 @@ func (app *application) loginUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check whether the credentials are valid. If they're not, add a generic error
-	// message to the form failures map and re-display the login form.
+	// Check whether the credentials are valid. If they're not, or the account
+	// is locked, add a generic error message to the form failures map and
+	// re-display the login form. The message is the same in both cases, so
+	// that it doesn't reveal whether an account exists for the email address.
 	form := forms.New(r.PostForm)
-	id, err := app.users.Authenticate(form.Get("email"), form.Get("password"))
-	if err == models.ErrInvalidCredentials {
-		form.Errors.Add("generic", "Email or Password is incorrect")
+	id, err := app.authenticator.Authenticate(r.Context(), form.Get("email"), form.Get("password"), clientIP(r))
+	if err == models.ErrInvalidCredentials || err == models.ErrAccountLocked {
+		app.metrics.loginFailures.Inc()
+		form.Errors.Add("generic", "Email or Password is incorrect, or the account is temporarily locked after too many failed attempts")
 		app.render(w, r, "login.page.tmpl", &templateData{Form: form})
 		return
 	} else if err != nil {
-		app.serverError(w, err)
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.completeLogin(w, r, id, form.Get("next"), form.Get("remember") != "")
+}
+
+// The completeLogin() helper is called once we know who is logging in, from
+// their password or a login link. If the user has two-factor authentication
+// turned on, they aren't logged in yet. Instead the session holds their ID as
+// a pending login, for a few minutes, until they enter a code from their
+// authenticator app. The expiry is stored as a Unix time, because the session
+// can't encode a time.Time. Otherwise they are logged in and sent on to the
+// page they were going to, if it's safe, or the create snippet page. If
+// remember is true, they are also given a "remember me" token. Users whose
+// account has been deactivated aren't logged in at all.
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, id int, next string, remember bool) {
+	user, err := app.users.Get(r.Context(), id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !user.Active {
+		app.session.Put(r, "flash", "This account has been deactivated")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	if user.TOTPEnabled {
+		app.session.Put(r, "twoFactorUserID", user.ID)
+		app.session.Put(r, "twoFactorExpires", int(time.Now().Add(twoFactorTimeout).Unix()))
+		app.session.Put(r, "twoFactorNext", next)
+		app.session.Put(r, "twoFactorRemember", remember)
+		http.Redirect(w, r, "/user/login/2fa", http.StatusSeeOther)
+		return
+	}
+
+	if err := app.logIn(r, user); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if remember {
+		if err := app.remember(w, r, user); err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+	http.Redirect(w, r, safeRedirect(next), http.StatusSeeOther)
+}
+
+// How long a user has to enter their two-factor authentication code after
+// entering their password.
+const twoFactorTimeout = 5 * time.Minute
+
+// The twoFactorUserID() helper returns the ID of the user whose login is
+// waiting for a two-factor authentication code, or zero if there isn't one
+// or it has timed out.
+func (app *application) twoFactorUserID(r *http.Request) int {
+	if time.Now().Unix() >= int64(app.session.GetInt(r, "twoFactorExpires")) {
+		return 0
+	}
+	return app.session.GetInt(r, "twoFactorUserID")
+}
+
+func (app *application) loginTwoFactorForm(w http.ResponseWriter, r *http.Request) {
+	if app.twoFactorUserID(r) == 0 {
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	app.render(w, r, "logincode.page.tmpl", &templateData{
+		Form: forms.New(nil),
+	})
+}
+
+func (app *application) loginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	id := app.twoFactorUserID(r)
+	if id == 0 {
+		app.session.Put(r, "flash", "Your login timed out. Please log in again")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	err = app.users.AuthenticateTOTP(r.Context(), id, form.Get("code"))
+	if err == models.ErrInvalidCredentials {
+		app.metrics.loginFailures.Inc()
+		form.Errors.Add("code", "Code is incorrect")
+		app.render(w, r, "logincode.page.tmpl", &templateData{Form: form})
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	user, err := app.users.Get(r.Context(), id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.session.Remove(r, "twoFactorUserID")
+	app.session.Remove(r, "twoFactorExpires")
+	remember := app.session.GetBool(r, "twoFactorRemember")
+	app.session.Remove(r, "twoFactorRemember")
+
+	// The account may have been deactivated while the user was finding their
+	// code, so check again, just like completeLogin() does.
+	if !user.Active {
+		app.session.Remove(r, "twoFactorNext")
+		app.session.Put(r, "flash", "This account has been deactivated")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := app.logIn(r, user); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if remember {
+		if err := app.remember(w, r, user); err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	http.Redirect(w, r, safeRedirect(app.session.PopString(r, "twoFactorNext")), http.StatusSeeOther)
+}
+
+// The sendLoginLink handler emails the user a link which logs them in
+// without their password. It's the second submit button on the login form,
+// so the form is re-displayed if the email address is missing.
+func (app *application) sendLoginLink(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email")
+	form.MatchesPattern("email", forms.EmailRX)
+
+	if !form.Valid() {
+		app.render(w, r, "login.page.tmpl", &templateData{Form: form})
+		return
+	}
+
+	// As with password resets, we show the same message whether or not
+	// there's an account for the address.
+	token, err := app.users.CreateLoginToken(r.Context(), form.Get("email"), app.config.tokens.loginLink)
+	if err == nil {
+		app.sendMail(r.Context(), app.loginLinkEmail(form.Get("email"), token, form.Get("next")))
+	} else if err != models.ErrNoRecord {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.session.Put(r, "flash", "If there's an account for that address, we've emailed it a link to log in")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// The loginLinkEmail() helper builds the email containing a login link. The
+// page to go to after logging in is only included if it's safe.
+func (app *application) loginLinkEmail(to, token, next string) mailer.Message {
+	q := url.Values{"token": {token}}
+	if next != "" && safeRedirect(next) == next {
+		q.Set("next", next)
+	}
+	link := app.absoluteURL("/user/login/link/confirm?" + q.Encode())
+
+	return mailer.Message{
+		To:      to,
+		Subject: "Log in to Snippetbox",
+		Body: fmt.Sprintf("Someone (hopefully you) asked for a link to log in to your Snippetbox\n"+
+			"account. To log in, follow this link within %d minutes:\n\n%s\n\n"+
+			"The link only works once. If you didn't ask for it, you can ignore this email.\n",
+			int(app.config.tokens.loginLink.Minutes()), link),
+	}
+}
+
+// The loginLinkForm handler is where login links go. It doesn't log the user
+// in: some email providers follow the links in messages to check them, which
+// would use up the token. Instead it shows a button which does.
+func (app *application) loginLinkForm(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	form := forms.New(url.Values{"token": {q.Get("token")}, "next": {q.Get("next")}})
+	form.Required("token")
+
+	app.render(w, r, "loginlink.page.tmpl", &templateData{Form: form})
+}
+
+func (app *application) loginWithLink(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
 		return
 	}
 
-	// Add the ID of the current user to the session so they are now 'logged in'.
-	app.session.Put(r, "userID", id)
+	form := forms.New(r.PostForm)
+	id, err := app.users.ConsumeLoginToken(r.Context(), form.Get("token"))
+	if err == models.ErrInvalidToken {
+		app.metrics.loginFailures.Inc()
+		app.session.Put(r, "flash", "That login link is invalid or has expired. Each link only works once, so please ask for a new one")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
 
-	// Redirect the user to the create snippet page.
-	http.Redirect(w, r, "/snippet/create", http.StatusSeeOther)
+	app.completeLogin(w, r, id, form.Get("next"), false)
 }
 
 func (app *application) logoutUser(w http.ResponseWriter, r *http.Request) {
-	// Remove the userID from the session data so that the user is 'logged out'
+	// Remove this session from the session registry, so that the cookie
+	// can't be used again even if someone has copied it.
+	err := app.sessionRegistry.Revoke(r.Context(), app.authenticatedUser(r).ID, app.session.GetString(r, "sessionID"))
+	if err != nil && err != models.ErrNoRecord {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// Forget the user on this device, if they asked us to remember them.
+	if cookie, err := r.Cookie(rememberCookie); err == nil {
+		if err := app.rememberTokens.Delete(r.Context(), cookie.Value); err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		app.clearRememberCookie(w)
+	}
+
+	// Remove the userID from the session data so that the user is 'logged
+	// out', and give the session a new token so the old one is no use.
+	app.session.RenewToken(r)
 	app.session.Remove(r, "userID")
+	app.session.Remove(r, "sessionID")
 
 	// Add a flash message to the session to confirm to the user that they've been logged out.
 	app.session.Put(r, "flash", "You've been logged out successfully!")
 	http.Redirect(w, r, "/", 303)
 }
 
+func (app *application) forgotPasswordForm(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, "forgot.page.tmpl", &templateData{
+		Form: forms.New(nil),
+	})
+}
+
+func (app *application) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email")
+	form.MatchesPattern("email", forms.EmailRX)
+
+	if !form.Valid() {
+		app.render(w, r, "forgot.page.tmpl", &templateData{Form: form})
+		return
+	}
+
+	// Create a reset token and email the user a link containing it. If there
+	// is no account with the email address we don't send anything, but we
+	// show the same message, so that the form can't be used to find out who
+	// has an account.
+	token, err := app.users.CreatePasswordReset(r.Context(), form.Get("email"), app.config.tokens.passwordReset)
+	if err == nil {
+		app.sendMail(r.Context(), app.passwordResetEmail(form.Get("email"), token))
+	} else if err != models.ErrNoRecord {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.session.Put(r, "flash", "If there's an account for that address, we've emailed it a link to reset the password")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// The passwordResetEmail() helper builds the email containing a password
+// reset link.
+func (app *application) passwordResetEmail(to, token string) mailer.Message {
+	link := app.absoluteURL("/user/password/reset?token=" + url.QueryEscape(token))
+
+	return mailer.Message{
+		To:      to,
+		Subject: "Reset your Snippetbox password",
+		Body: fmt.Sprintf("Someone (hopefully you) asked to reset the password for your Snippetbox\n"+
+			"account. To choose a new password, follow this link within %d minutes:\n\n%s\n\n"+
+			"If you didn't ask to reset your password, you can ignore this email.\n",
+			int(app.config.tokens.passwordReset.Minutes()), link),
+	}
+}
+
+func (app *application) resetPasswordForm(w http.ResponseWriter, r *http.Request) {
+	form := forms.New(url.Values{"token": {r.URL.Query().Get("token")}})
+	form.Required("token")
+
+	app.render(w, r, "reset.page.tmpl", &templateData{Form: form})
+}
+
+func (app *application) resetPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("token", "password", "confirm_password")
+	form.MinLength("password", 10)
+	if form.Get("password") != form.Get("confirm_password") {
+		form.Errors.Add("confirm_password", "Passwords do not match")
+	}
+
+	if !form.Valid() {
+		app.render(w, r, "reset.page.tmpl", &templateData{Form: form})
+		return
+	}
+
+	// Set the new password. This also logs the user out of any other
+	// sessions, in case someone else has got into their account.
+	id, err := app.users.ResetPassword(r.Context(), form.Get("token"), form.Get("password"))
+	if err == models.ErrInvalidToken {
+		form.Errors.Add("token", "This password reset link is invalid or has expired")
+		app.render(w, r, "reset.page.tmpl", &templateData{Form: form})
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// The old sessions no longer work, so remove them from the session
+	// registry as well, along with any "remember me" tokens.
+	if err := app.sessionRegistry.RevokeOthers(r.Context(), id, ""); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if err := app.rememberTokens.DeleteForUser(r.Context(), id, ""); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// Log this session out too, giving it a new token like logoutUser()
+	// does, and ask the user to login with their new password.
+	app.session.RenewToken(r)
+	app.session.Remove(r, "userID")
+	app.session.Remove(r, "sessionID")
+	app.session.Put(r, "flash", "Your password has been reset. Please login")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// The verificationEmail() helper builds the email containing a link to
+// verify the user's email address. The link contains a signed token with the
+// user's ID and email address, so it stops working if they change address.
+func (app *application) verificationEmail(id int, email string) mailer.Message {
+	ttl := app.config.tokens.emailVerification
+	token := app.signToken("verify-email", time.Now().Add(ttl), strconv.Itoa(id), email)
+	link := app.absoluteURL("/user/verify?token=" + url.QueryEscape(token))
+
+	return mailer.Message{
+		To:      email,
+		Subject: "Verify your Snippetbox email address",
+		Body: fmt.Sprintf("Thanks for signing up to Snippetbox! To verify your email address, follow\n"+
+			"this link within %d hours:\n\n%s\n\n"+
+			"If you didn't sign up, you can ignore this email.\n",
+			int(ttl.Hours()), link),
+	}
+}
+
+func (app *application) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	// Check the token, and then mark the email address in it as verified,
+	// as long as it is still the user's address. We signed the token, so we
+	// know its fields are a user ID and an email address.
+	fields, err := app.verifyToken("verify-email", r.URL.Query().Get("token"), time.Now())
+	if err == nil {
+		id, _ := strconv.Atoi(fields[0])
+		err = app.users.VerifyEmail(r.Context(), id, fields[1])
+	}
+
+	switch err {
+	case nil:
+		app.session.Put(r, "flash", "Thanks, your email address has been verified")
+	case errInvalidSignedToken, models.ErrNoRecord:
+		app.session.Put(r, "flash", "This verification link is invalid or has expired")
+	default:
+		app.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (app *application) resendVerificationForm(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, "verify.page.tmpl", nil)
+}
+
+func (app *application) resendVerification(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+	if user.EmailVerified {
+		app.session.Put(r, "flash", "Your email address is already verified")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	app.sendMail(r.Context(), app.verificationEmail(user.ID, user.Email))
+
+	app.session.Put(r, "flash", fmt.Sprintf("We've sent a new verification link to %s", user.Email))
+	http.Redirect(w, r, "/user/verify/resend", http.StatusSeeOther)
+}
+
+// The account handler shows the user's account details, along with the forms
+// for changing them.
+func (app *application) account(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, "account.page.tmpl", &templateData{
+		Form: forms.New(nil),
+	})
+}
+
+func (app *application) changeName(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("name")
+	form.MaxLength("name", 255)
+
+	if !form.Valid() {
+		app.render(w, r, "account.page.tmpl", &templateData{Form: form})
+		return
+	}
+
+	err = app.users.UpdateName(r.Context(), app.authenticatedUser(r).ID, form.Get("name"))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.session.Put(r, "flash", "Your name has been changed")
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+func (app *application) changeEmail(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email", "email_password")
+	form.MaxLength("email", 255)
+	form.MatchesPattern("email", forms.EmailRX)
+
+	if !form.Valid() {
+		app.render(w, r, "account.page.tmpl", &templateData{Form: form})
+		return
+	}
+
+	user := app.authenticatedUser(r)
+	err = app.users.UpdateEmail(r.Context(), user.ID, form.Get("email_password"), form.Get("email"))
+	if err == models.ErrInvalidCredentials {
+		form.Errors.Add("email_password", "Password is incorrect")
+		app.render(w, r, "account.page.tmpl", &templateData{Form: form})
+		return
+	} else if err == models.ErrDuplicateEmail {
+		form.Errors.Add("email", "Address is already in use")
+		app.render(w, r, "account.page.tmpl", &templateData{Form: form})
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// The new address needs to be verified, so send a link to it.
+	app.sendMail(r.Context(), app.verificationEmail(user.ID, form.Get("email")))
+
+	app.session.Put(r, "flash", fmt.Sprintf("Your email address has been changed. We've sent a link to %s to verify it", form.Get("email")))
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+func (app *application) changePassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("current_password", "new_password", "confirm_password")
+	form.MinLength("new_password", 10)
+	if form.Get("new_password") != form.Get("confirm_password") {
+		form.Errors.Add("confirm_password", "Passwords do not match")
+	}
+
+	if !form.Valid() {
+		app.render(w, r, "account.page.tmpl", &templateData{Form: form})
+		return
+	}
+
+	id := app.authenticatedUser(r).ID
+	err = app.users.ChangePassword(r.Context(), id, form.Get("current_password"), form.Get("new_password"))
+	if err == models.ErrInvalidCredentials {
+		form.Errors.Add("current_password", "Password is incorrect")
+		app.render(w, r, "account.page.tmpl", &templateData{Form: form})
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// Changing the password logs the user out of their other sessions, by
+	// incrementing their session version. Keep this session logged in by
+	// recording the new version in it.
+	user, err := app.users.Get(r.Context(), id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.session.Put(r, "sessionVersion", user.SessionVersion)
+
+	err = app.sessionRegistry.RevokeOthers(r.Context(), id, app.session.GetString(r, "sessionID"))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	err = app.rememberTokens.DeleteForUser(r.Context(), id, app.session.GetString(r, "sessionID"))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.session.Put(r, "flash", "Your password has been changed")
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// The twoFactor handler shows whether two-factor authentication is turned on
+// for the user. If it isn't, it shows the details for setting up their
+// authenticator app, with the secret kept in the session until they have
+// entered a code to prove it works.
+func (app *application) twoFactor(w http.ResponseWriter, r *http.Request) {
+	app.renderTwoFactor(w, r, &templateData{Form: forms.New(nil)})
+}
+
+// The renderTwoFactor() helper renders the two-factor authentication page,
+// generating a new TOTP key for the user to set up if they don't already
+// have one in progress.
+func (app *application) renderTwoFactor(w http.ResponseWriter, r *http.Request, td *templateData) {
+	user := app.authenticatedUser(r)
+	if !user.TOTPEnabled && td.RecoveryCodes == nil {
+		key, err := app.totpSetupKey(r, user)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		td.TOTPSecret = key.Secret()
+		// The otpauth URI is one we generated, so it is safe to use as a
+		// link despite its unusual scheme.
+		td.TOTPURL = template.URL(key.URL())
+	}
+
+	app.render(w, r, "twofactor.page.tmpl", td)
+}
+
+// The totpSetupKey() helper returns the TOTP key which the user is setting
+// up, creating one if necessary. The key is kept in the session until
+// two-factor authentication is turned on. Sessions are stored on the server,
+// so the secret never leaves it in a cookie, but it isn't encrypted there:
+// it's as exposed as it will be in the users table once it's enabled.
+func (app *application) totpSetupKey(r *http.Request, user *models.User) (*otp.Key, error) {
+	if u := app.session.GetString(r, "totpSetupURL"); u != "" {
+		key, err := otp.NewKeyFromURL(u)
+		if err == nil && key.AccountName() == user.Email {
+			return key, nil
+		}
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      "Snippetbox",
+		AccountName: user.Email,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	app.session.Put(r, "totpSetupURL", key.URL())
+	return key, nil
+}
+
+// The twoFactorQR handler serves the QR code of the otpauth URI for the key
+// which the user is setting up, for them to scan with their authenticator
+// app.
+func (app *application) twoFactorQR(w http.ResponseWriter, r *http.Request) {
+	key, err := otp.NewKeyFromURL(app.session.GetString(r, "totpSetupURL"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	img, err := key.Image(200, 200)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	png.Encode(w, img)
+}
+
+func (app *application) enableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("code")
+
+	user := app.authenticatedUser(r)
+	key, err := app.totpSetupKey(r, user)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !form.Valid() {
+		app.renderTwoFactor(w, r, &templateData{Form: form})
+		return
+	}
+
+	codes, err := app.users.EnableTOTP(r.Context(), user.ID, key.Secret(), form.Get("code"))
+	if err == models.ErrInvalidCredentials {
+		form.Errors.Add("code", "Code is incorrect. Check that the time on your device is correct")
+		app.renderTwoFactor(w, r, &templateData{Form: form})
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.session.Remove(r, "totpSetupURL")
+
+	// Show the recovery codes straight away rather than redirecting, because
+	// this is the only time they are available.
+	app.session.Put(r, "flash", "Two-factor authentication is now turned on")
+	app.renderTwoFactor(w, r, &templateData{
+		Form:          forms.New(nil),
+		RecoveryCodes: codes,
+	})
+}
+
+func (app *application) disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("password")
+
+	if !form.Valid() {
+		app.renderTwoFactor(w, r, &templateData{Form: form})
+		return
+	}
+
+	err = app.users.DisableTOTP(r.Context(), app.authenticatedUser(r).ID, form.Get("password"))
+	if err == models.ErrInvalidCredentials {
+		form.Errors.Add("password", "Password is incorrect")
+		app.renderTwoFactor(w, r, &templateData{Form: form})
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.session.Put(r, "flash", "Two-factor authentication is now turned off")
+	http.Redirect(w, r, "/account/2fa", http.StatusSeeOther)
+}
+
+// The sessions handler lists the user's logged in sessions, so that they can
+// log out any they don't recognise.
+func (app *application) sessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := app.sessionRegistry.ForUser(r.Context(), app.authenticatedUser(r).ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.render(w, r, "sessions.page.tmpl", &templateData{
+		Sessions:         sessions,
+		CurrentSessionID: app.session.GetString(r, "sessionID"),
+	})
+}
+
+// The revokeSession handler logs out one of the user's other sessions. The
+// registry only lets users revoke their own sessions, so an ID belonging to
+// someone else is treated as not found.
+func (app *application) revokeSession(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// The current session is logged out with the logout button instead.
+	id := r.PostForm.Get("id")
+	if id == "" || id == app.session.GetString(r, "sessionID") {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err = app.sessionRegistry.Revoke(r.Context(), app.authenticatedUser(r).ID, id)
+	if err == models.ErrNoRecord {
+		app.notFound(w)
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// Otherwise the device could log straight back in with its "remember
+	// me" token.
+	err = app.rememberTokens.DeleteForSession(r.Context(), app.authenticatedUser(r).ID, id)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.session.Put(r, "flash", "The session has been logged out")
+	http.Redirect(w, r, "/account/sessions", http.StatusSeeOther)
+}
+
+// The revokeOtherSessions handler logs out all of the user's sessions except
+// the one making the request, and forgets the other devices which asked to
+// be remembered.
+func (app *application) revokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	err := app.sessionRegistry.RevokeOthers(r.Context(), app.authenticatedUser(r).ID, app.session.GetString(r, "sessionID"))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	err = app.rememberTokens.DeleteForUser(r.Context(), app.authenticatedUser(r).ID, app.session.GetString(r, "sessionID"))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.session.Put(r, "flash", "All of your other sessions have been logged out")
+	http.Redirect(w, r, "/account/sessions", http.StatusSeeOther)
+}
+
 func ping(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
+
+// The redirectToHTTPS handler is used by the optional plain HTTP listener. It
+// sends a 301 Moved Permanently redirect to the same URL on the HTTPS server.
+func (app *application) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	// Strip any port from the requested host...
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// ...and add the HTTPS server's port instead, unless it's the default.
+	if _, port, err := net.SplitHostPort(app.config.addr); err == nil && port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
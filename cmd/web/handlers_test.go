@@ -2,9 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
+
+	"chilliweb.com/snippetbox/pkg/mailer"
+	"chilliweb.com/snippetbox/pkg/models"
+	"chilliweb.com/snippetbox/pkg/models/mock"
 )
 
 func TestPing(t *testing.T) {
@@ -43,6 +51,7 @@ func TestShowSnippet(t *testing.T) {
 	}{
 		{"Valid ID", "/snippet/1", http.StatusOK, []byte("An old and silent pond...")},
 		{"Non-existent ID", "/snippet/2", http.StatusNotFound, nil},
+		{"Query timeout", "/snippet/3", http.StatusServiceUnavailable, []byte("Service Unavailable")},
 		{"Negative ID", "/snippet/-1", http.StatusNotFound, nil},
 		{"Decimal ID", "/snippet/1.23", http.StatusNotFound, nil},
 		{"String ID", "/snippet/foo", http.StatusNotFound, nil},
@@ -65,6 +74,74 @@ func TestShowSnippet(t *testing.T) {
 	}
 }
 
+// The contextSnippetModel type wraps the snippet mock and records the error of
+// the context each Get() call receives, so the tests can check that the
+// request's context is the one passed down to the model.
+type contextSnippetModel struct {
+	mock.SnippetModel
+	ctxErr error
+	called bool
+}
+
+func (m *contextSnippetModel) Get(ctx context.Context, id int) (*models.Snippet, error) {
+	m.called = true
+	m.ctxErr = ctx.Err()
+	return m.SnippetModel.Get(ctx, id)
+}
+
+func TestRequestContextReachesModel(t *testing.T) {
+	tests := []struct {
+		name       string
+		ctx        func() (context.Context, context.CancelFunc)
+		wantErr    error
+		wantCode   int
+		wantHeader string
+	}{
+		{"Cancelled", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx, cancel
+		}, context.Canceled, http.StatusOK, ""},
+		{"Expired", func() (context.Context, context.CancelFunc) {
+			return context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		}, context.DeadlineExceeded, http.StatusServiceUnavailable, "5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			snippets := &contextSnippetModel{}
+			app.snippets = snippets
+
+			ctx, cancel := tt.ctx()
+			defer cancel()
+
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/snippet/1", nil).WithContext(ctx)
+
+			app.routes().ServeHTTP(rr, r)
+
+			if !snippets.called {
+				t.Fatal("want the model to be called")
+			}
+
+			if snippets.ctxErr != tt.wantErr {
+				t.Errorf("want %v; got %v", tt.wantErr, snippets.ctxErr)
+			}
+
+			// A cancelled request is abandoned without writing a response,
+			// while an expired one gets a 503.
+			if rr.Code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, rr.Code)
+			}
+
+			if retry := rr.Header().Get("Retry-After"); retry != tt.wantHeader {
+				t.Errorf("want %q; got %q", tt.wantHeader, retry)
+			}
+		})
+	}
+}
+
 func TestSignupUser(t *testing.T) {
 	// Create the application struct containing our mocked dependencies and set
 	// up the test server for running an end-to-end test.
@@ -119,3 +196,1164 @@ func TestSignupUser(t *testing.T) {
 		})
 	}
 }
+
+func TestLoginUser(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	_, _, body := ts.get(t, "/user/login")
+	csrfToken := extractCSRFToken(t, body)
+
+	// A locked account gets exactly the same response as a wrong password,
+	// so the response doesn't reveal which accounts exist.
+	generic := []byte("Email or Password is incorrect")
+
+	tests := []struct {
+		name     string
+		email    string
+		wantCode int
+		wantBody []byte
+	}{
+		{"Wrong password", "bob@example.com", http.StatusOK, generic},
+		{"Locked account", "locked@example.com", http.StatusOK, generic},
+		{"Valid credentials", "alice@example.com", http.StatusSeeOther, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			form.Add("email", tt.email)
+			form.Add("password", "validPa$$word")
+			form.Add("csrf_token", csrfToken)
+
+			code, _, body := ts.postForm(t, "/user/login", form)
+
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+
+			if !bytes.Contains(body, tt.wantBody) {
+				t.Errorf("want body %s to contain %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestForgotPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		wantCode int
+		wantBody []byte
+		wantMail bool
+	}{
+		{"Existing account", "alice@example.com", http.StatusSeeOther, nil, true},
+		{"Unknown account", "nobody@example.com", http.StatusSeeOther, nil, false},
+		{"Invalid email", "nobody@", http.StatusOK, []byte("This field is invalid"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			_, _, body := ts.get(t, "/user/password/forgot")
+			csrfToken := extractCSRFToken(t, body)
+
+			form := url.Values{}
+			form.Add("email", tt.email)
+			form.Add("csrf_token", csrfToken)
+
+			code, _, body := ts.postForm(t, "/user/password/forgot", form)
+
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+
+			if !bytes.Contains(body, tt.wantBody) {
+				t.Errorf("want body %s to contain %q", body, tt.wantBody)
+			}
+
+			// The email is sent in the background, so wait for it.
+			app.wg.Wait()
+			messages := app.mailer.(*mailer.Memory).Messages()
+
+			if !tt.wantMail {
+				if len(messages) != 0 {
+					t.Errorf("want no email; got %d", len(messages))
+				}
+				return
+			}
+
+			if len(messages) != 1 {
+				t.Fatalf("want 1 email; got %d", len(messages))
+			}
+
+			wantLink := "https://localhost:4000/user/password/reset?token=valid-token"
+			if messages[0].To != tt.email || !strings.Contains(messages[0].Body, wantLink) {
+				t.Errorf("want email to %q containing %q; got %+v", tt.email, wantLink, messages[0])
+			}
+		})
+	}
+}
+
+func TestSendLoginLink(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		next     string
+		wantCode int
+		wantBody []byte
+		wantLink string
+	}{
+		{"Existing account", "alice@example.com", "", http.StatusSeeOther, nil, "https://localhost:4000/user/login/link/confirm?token=valid-login-token\n"},
+		{"With next page", "alice@example.com", "/snippet/1", http.StatusSeeOther, nil, "https://localhost:4000/user/login/link/confirm?next=%2Fsnippet%2F1&token=valid-login-token\n"},
+		{"Unsafe next page", "alice@example.com", "//evil.example.com", http.StatusSeeOther, nil, "https://localhost:4000/user/login/link/confirm?token=valid-login-token\n"},
+		{"Unknown account", "nobody@example.com", "", http.StatusSeeOther, nil, ""},
+		{"Invalid email", "nobody@", "", http.StatusOK, []byte("This field is invalid"), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			_, _, body := ts.get(t, "/user/login")
+
+			form := url.Values{}
+			form.Add("email", tt.email)
+			form.Add("next", tt.next)
+			form.Add("csrf_token", extractCSRFToken(t, body))
+
+			code, _, body := ts.postForm(t, "/user/login/link", form)
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+
+			if !bytes.Contains(body, tt.wantBody) {
+				t.Errorf("want body %s to contain %q", body, tt.wantBody)
+			}
+
+			// The email is sent in the background, so wait for it.
+			app.wg.Wait()
+			messages := app.mailer.(*mailer.Memory).Messages()
+
+			if tt.wantLink == "" {
+				if len(messages) != 0 {
+					t.Errorf("want no email; got %d", len(messages))
+				}
+				return
+			}
+
+			if len(messages) != 1 {
+				t.Fatalf("want 1 email; got %d", len(messages))
+			}
+
+			// The link is followed by a line break, so that we know there's
+			// nothing more on the end of it.
+			if messages[0].To != tt.email || !strings.Contains(messages[0].Body, tt.wantLink) {
+				t.Errorf("want email to %q containing %q; got %+v", tt.email, tt.wantLink, messages[0])
+			}
+		})
+	}
+}
+
+func TestLoginWithLink(t *testing.T) {
+	tests := []struct {
+		name         string
+		token        string
+		next         string
+		wantLocation string
+		wantLoggedIn bool
+	}{
+		{"Valid token", "valid-login-token", "", "/snippet/create", true},
+		{"Valid token with next page", "valid-login-token", "/snippet/1", "/snippet/1", true},
+		{"Open redirect", "valid-login-token", "https://evil.example.com/", "/snippet/create", true},
+		{"Invalid token", "expired-token", "/snippet/1", "/user/login", false},
+		{"Two-factor authentication", "totp-login-token", "/snippet/1", "/user/login/2fa", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			// Following the link only shows a button, so that a mail scanner
+			// fetching the link doesn't use the token up.
+			code, _, body := ts.get(t, "/user/login/link/confirm?"+url.Values{"token": {tt.token}, "next": {tt.next}}.Encode())
+			if code != http.StatusOK {
+				t.Fatalf("want %d; got %d", http.StatusOK, code)
+			}
+			if code, _, _ := ts.get(t, "/account"); code != http.StatusFound {
+				t.Errorf("want not logged in by following the link; got %d", code)
+			}
+
+			form := url.Values{}
+			form.Add("token", tt.token)
+			form.Add("next", tt.next)
+			form.Add("csrf_token", extractCSRFToken(t, body))
+
+			code, header, _ := ts.postForm(t, "/user/login/link/confirm", form)
+			if code != http.StatusSeeOther || header.Get("Location") != tt.wantLocation {
+				t.Errorf("want %d to %q; got %d to %q", http.StatusSeeOther, tt.wantLocation, code, header.Get("Location"))
+			}
+
+			code, _, _ = ts.get(t, "/account")
+			if loggedIn := code == http.StatusOK; loggedIn != tt.wantLoggedIn {
+				t.Errorf("want logged in %v; got %v", tt.wantLoggedIn, loggedIn)
+			}
+		})
+	}
+}
+
+func TestLoginNextAfterTwoFactor(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	_, _, body := ts.get(t, "/user/login?next=/snippet/1")
+	if !bytes.Contains(body, []byte("value='/snippet/1'")) {
+		t.Errorf("want login form to carry the next page")
+	}
+
+	form := url.Values{}
+	form.Add("email", "totp@example.com")
+	form.Add("password", "validPa$$word")
+	form.Add("next", "/snippet/1")
+	form.Add("csrf_token", extractCSRFToken(t, body))
+	ts.postForm(t, "/user/login", form)
+
+	_, _, body = ts.get(t, "/user/login/2fa")
+	form = url.Values{}
+	form.Add("code", "123456")
+	form.Add("csrf_token", extractCSRFToken(t, body))
+
+	code, header, _ := ts.postForm(t, "/user/login/2fa", form)
+	if code != http.StatusSeeOther || header.Get("Location") != "/snippet/1" {
+		t.Errorf("want %d to %q; got %d to %q", http.StatusSeeOther, "/snippet/1", code, header.Get("Location"))
+	}
+}
+
+func TestLoginRenewsSessionToken(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Entering the password for a user with two-factor authentication
+	// starts a session before they are logged in.
+	_, _, body := ts.get(t, "/user/login")
+	form := url.Values{}
+	form.Add("email", "totp@example.com")
+	form.Add("password", "validPa$$word")
+	form.Add("csrf_token", extractCSRFToken(t, body))
+	ts.postForm(t, "/user/login", form)
+
+	before := ts.sessionToken(t)
+	if before == "" {
+		t.Fatal("want a session cookie before logging in")
+	}
+
+	_, _, body = ts.get(t, "/user/login/2fa")
+	form = url.Values{}
+	form.Add("code", "123456")
+	form.Add("csrf_token", extractCSRFToken(t, body))
+	ts.postForm(t, "/user/login/2fa", form)
+
+	after := ts.sessionToken(t)
+	if after == "" || after == before {
+		t.Fatal("want a new session token after logging in")
+	}
+
+	// Someone who knew the token from before the login isn't logged in.
+	attacker := newTestServer(t, app.routes())
+	defer attacker.Close()
+	attacker.setSessionToken(t, before)
+	if code, _, _ := attacker.get(t, "/account"); code != http.StatusFound {
+		t.Errorf("old token: want %d; got %d", http.StatusFound, code)
+	}
+
+	// And once the user logs out, the token they were logged in with
+	// doesn't work any more either.
+	_, _, body = ts.get(t, "/account")
+	form = url.Values{}
+	form.Add("csrf_token", extractCSRFToken(t, body))
+	ts.postForm(t, "/user/logout", form)
+
+	attacker.setSessionToken(t, after)
+	if code, _, _ := attacker.get(t, "/account"); code != http.StatusFound {
+		t.Errorf("logged out token: want %d; got %d", http.StatusFound, code)
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Start from a logged in session, so that we can check the reset logs
+	// it out with a new token.
+	ts.login(t, "alice@example.com")
+
+	_, _, body := ts.get(t, "/user/password/reset?token=valid-token")
+	csrfToken := extractCSRFToken(t, body)
+
+	if !bytes.Contains(body, []byte("value='valid-token'")) {
+		t.Errorf("want form to contain the token")
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		password string
+		confirm  string
+		wantCode int
+		wantBody []byte
+	}{
+		{"Invalid token", "expired-token", "newPa$$word1", "newPa$$word1", http.StatusOK, []byte("This password reset link is invalid or has expired")},
+		{"Mismatched passwords", "valid-token", "newPa$$word1", "newPa$$word2", http.StatusOK, []byte("Passwords do not match")},
+		{"Short password", "valid-token", "short", "short", http.StatusOK, []byte("This field is too short")},
+		{"Valid reset", "valid-token", "newPa$$word1", "newPa$$word1", http.StatusSeeOther, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			form.Add("token", tt.token)
+			form.Add("password", tt.password)
+			form.Add("confirm_password", tt.confirm)
+			form.Add("csrf_token", csrfToken)
+
+			before := ts.sessionToken(t)
+			code, _, body := ts.postForm(t, "/user/password/reset", form)
+
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+
+			if !bytes.Contains(body, tt.wantBody) {
+				t.Errorf("want body %s to contain %q", body, tt.wantBody)
+			}
+
+			// A successful reset should give the session a new token and
+			// log it out.
+			if tt.wantCode == http.StatusSeeOther {
+				if ts.sessionToken(t) == before {
+					t.Errorf("want session token to be renewed")
+				}
+				if code, _, _ := ts.get(t, "/account"); code != http.StatusFound {
+					t.Errorf("want %d; got %d", http.StatusFound, code)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Sign up, and pick the verification link out of the email.
+	_, _, body := ts.get(t, "/user/signup")
+	form := url.Values{}
+	form.Add("name", "Bob")
+	form.Add("email", "unverified@example.com")
+	form.Add("password", "validPa$$word")
+	form.Add("csrf_token", extractCSRFToken(t, body))
+
+	code, _, _ := ts.postForm(t, "/user/signup", form)
+	if code != http.StatusSeeOther {
+		t.Fatalf("want %d; got %d", http.StatusSeeOther, code)
+	}
+
+	app.wg.Wait()
+	messages := app.mailer.(*mailer.Memory).Messages()
+	if len(messages) != 1 {
+		t.Fatalf("want 1 email; got %d", len(messages))
+	}
+	prefix := app.config.baseURL + "/user/verify?token="
+	start := strings.Index(messages[0].Body, prefix)
+	if start == -1 {
+		t.Fatalf("want verification link in email; got %q", messages[0].Body)
+	}
+	link := strings.Fields(messages[0].Body[start:])[0]
+	validToken, err := url.QueryUnescape(strings.TrimPrefix(link, prefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changedEmail := app.signToken("verify-email", time.Now().Add(time.Hour), "2", "old@example.com")
+	expired := app.signToken("verify-email", time.Now().Add(-time.Hour), "2", "unverified@example.com")
+
+	tests := []struct {
+		name      string
+		token     string
+		wantFlash string
+	}{
+		{"Valid token", validToken, "your email address has been verified"},
+		{"Changed email address", changedEmail, "This verification link is invalid or has expired"},
+		{"Expired token", expired, "This verification link is invalid or has expired"},
+		{"Tampered token", validToken + "x", "This verification link is invalid or has expired"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, header, _ := ts.get(t, "/user/verify?token="+url.QueryEscape(tt.token))
+			if code != http.StatusSeeOther || header.Get("Location") != "/" {
+				t.Errorf("want %d to %q; got %d to %q", http.StatusSeeOther, "/", code, header.Get("Location"))
+			}
+
+			// The result is shown in a flash message on the next page.
+			_, _, body := ts.get(t, "/")
+			if !bytes.Contains(body, []byte(tt.wantFlash)) {
+				t.Errorf("want body to contain %q", tt.wantFlash)
+			}
+		})
+	}
+}
+
+func TestRequireVerifiedUser(t *testing.T) {
+	tests := []struct {
+		name         string
+		email        string
+		requirement  bool
+		wantCode     int
+		wantLocation string
+	}{
+		{"Verified user", "alice@example.com", true, http.StatusOK, ""},
+		{"Unverified user", "unverified@example.com", true, http.StatusSeeOther, "/user/verify/resend"},
+		{"Unverified user allowed", "unverified@example.com", false, http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.requireVerifiedEmail = tt.requirement
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			ts.login(t, tt.email)
+
+			code, header, _ := ts.get(t, "/snippet/create")
+
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+
+			if loc := header.Get("Location"); loc != tt.wantLocation {
+				t.Errorf("want Location %q; got %q", tt.wantLocation, loc)
+			}
+		})
+	}
+}
+
+func TestResendVerification(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		wantMail int
+	}{
+		{"Unverified user", "unverified@example.com", 1},
+		{"Verified user", "alice@example.com", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			ts.login(t, tt.email)
+
+			_, _, body := ts.get(t, "/user/verify/resend")
+			form := url.Values{}
+			form.Add("csrf_token", extractCSRFToken(t, body))
+
+			code, _, _ := ts.postForm(t, "/user/verify/resend", form)
+			if code != http.StatusSeeOther {
+				t.Errorf("want %d; got %d", http.StatusSeeOther, code)
+			}
+
+			app.wg.Wait()
+			if n := len(app.mailer.(*mailer.Memory).Messages()); n != tt.wantMail {
+				t.Errorf("want %d emails; got %d", tt.wantMail, n)
+			}
+		})
+	}
+}
+
+func TestAccount(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Anonymous users are sent to the login page.
+	code, header, _ := ts.get(t, "/account")
+	if code != http.StatusFound || header.Get("Location") != "/user/login" {
+		t.Errorf("want %d to %q; got %d to %q", http.StatusFound, "/user/login", code, header.Get("Location"))
+	}
+
+	ts.login(t, "alice@example.com")
+
+	code, _, body := ts.get(t, "/account")
+	if code != http.StatusOK {
+		t.Errorf("want %d; got %d", http.StatusOK, code)
+	}
+
+	for _, want := range []string{"Alice", "alice@example.com", "Joined"} {
+		if !bytes.Contains(body, []byte(want)) {
+			t.Errorf("want body to contain %q", want)
+		}
+	}
+}
+
+func TestChangeName(t *testing.T) {
+	tests := []struct {
+		name     string
+		userName string
+		wantCode int
+		wantBody []byte
+	}{
+		{"Valid submission", "Alice Jones", http.StatusSeeOther, nil},
+		{"Empty name", "", http.StatusOK, []byte("This field cannot be left blank")},
+		{"Long name", strings.Repeat("a", 256), http.StatusOK, []byte("This field is too long")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			ts.login(t, "alice@example.com")
+
+			_, _, body := ts.get(t, "/account")
+			form := url.Values{}
+			form.Add("name", tt.userName)
+			form.Add("csrf_token", extractCSRFToken(t, body))
+
+			code, _, body := ts.postForm(t, "/account/name", form)
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+
+			if !bytes.Contains(body, tt.wantBody) {
+				t.Errorf("want body %s to contain %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestChangeEmail(t *testing.T) {
+	tests := []struct {
+		name         string
+		email        string
+		userPassword string
+		wantCode     int
+		wantBody     []byte
+		wantMail     int
+	}{
+		{"Valid submission", "alice@example.org", "validPa$$word", http.StatusSeeOther, nil, 1},
+		{"Empty email", "", "validPa$$word", http.StatusOK, []byte("This field cannot be left blank"), 0},
+		{"Invalid email", "alice@example.", "validPa$$word", http.StatusOK, []byte("This field is invalid"), 0},
+		{"Wrong password", "alice@example.org", "wrongPa$$word", http.StatusOK, []byte("Password is incorrect"), 0},
+		{"Duplicate email", "dupe@example.com", "validPa$$word", http.StatusOK, []byte("Address is already in use"), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			ts.login(t, "alice@example.com")
+
+			_, _, body := ts.get(t, "/account")
+			form := url.Values{}
+			form.Add("email", tt.email)
+			form.Add("email_password", tt.userPassword)
+			form.Add("csrf_token", extractCSRFToken(t, body))
+
+			code, _, body := ts.postForm(t, "/account/email", form)
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+
+			if !bytes.Contains(body, tt.wantBody) {
+				t.Errorf("want body %s to contain %q", body, tt.wantBody)
+			}
+
+			// A valid change sends a verification link to the new address.
+			app.wg.Wait()
+			msgs := app.mailer.(*mailer.Memory).Messages()
+			if len(msgs) != tt.wantMail {
+				t.Fatalf("want %d emails; got %d", tt.wantMail, len(msgs))
+			}
+			if tt.wantMail > 0 && msgs[0].To != tt.email {
+				t.Errorf("want email to %q; got %q", tt.email, msgs[0].To)
+			}
+		})
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	tests := []struct {
+		name            string
+		currentPassword string
+		newPassword     string
+		confirmPassword string
+		wantCode        int
+		wantBody        []byte
+	}{
+		{"Valid submission", "validPa$$word", "newPa$$word1", "newPa$$word1", http.StatusSeeOther, nil},
+		{"Empty current password", "", "newPa$$word1", "newPa$$word1", http.StatusOK, []byte("This field cannot be left blank")},
+		{"Wrong current password", "wrongPa$$word", "newPa$$word1", "newPa$$word1", http.StatusOK, []byte("Password is incorrect")},
+		{"Short new password", "validPa$$word", "pa$$word", "pa$$word", http.StatusOK, []byte("This field is too short")},
+		{"Mismatched confirmation", "validPa$$word", "newPa$$word1", "newPa$$word2", http.StatusOK, []byte("Passwords do not match")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			ts.login(t, "alice@example.com")
+
+			_, _, body := ts.get(t, "/account")
+			form := url.Values{}
+			form.Add("current_password", tt.currentPassword)
+			form.Add("new_password", tt.newPassword)
+			form.Add("confirm_password", tt.confirmPassword)
+			form.Add("csrf_token", extractCSRFToken(t, body))
+
+			code, _, body := ts.postForm(t, "/account/password", form)
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+
+			if !bytes.Contains(body, tt.wantBody) {
+				t.Errorf("want body %s to contain %q", body, tt.wantBody)
+			}
+
+			// The session which changed the password stays logged in.
+			if code, _, _ := ts.get(t, "/account"); code != http.StatusOK {
+				t.Errorf("want %d; got %d", http.StatusOK, code)
+			}
+		})
+	}
+}
+
+// The loginRemembered() helper logs in to the test server as the user with
+// the given email address, ticking "remember me", and entering the
+// two-factor code if the login asks for one.
+func loginRemembered(t *testing.T, ts *testServer, email string) {
+	_, _, body := ts.get(t, "/user/login")
+	form := url.Values{}
+	form.Add("email", email)
+	form.Add("password", "validPa$$word")
+	form.Add("remember", "on")
+	form.Add("csrf_token", extractCSRFToken(t, body))
+
+	_, header, _ := ts.postForm(t, "/user/login", form)
+	if header.Get("Location") != "/user/login/2fa" {
+		return
+	}
+
+	_, _, body = ts.get(t, "/user/login/2fa")
+	form = url.Values{}
+	form.Add("code", "123456")
+	form.Add("csrf_token", extractCSRFToken(t, body))
+	ts.postForm(t, "/user/login/2fa", form)
+}
+
+// The useRememberToken() helper makes a request to the account page from a
+// new browser which only has the given "remember me" token, and returns the
+// status code and the token the browser has afterwards.
+func useRememberToken(t *testing.T, h http.Handler, token string) (int, string) {
+	ts := newTestServer(t, h)
+	defer ts.Close()
+
+	ts.setCookie(t, rememberCookie, token)
+	code, _, _ := ts.get(t, "/account")
+	return code, ts.cookie(t, rememberCookie)
+}
+
+func TestRememberMe(t *testing.T) {
+	for _, email := range []string{"alice@example.com", "totp@example.com"} {
+		t.Run(email, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			loginRemembered(t, ts, email)
+			first := ts.cookie(t, rememberCookie)
+			if first == "" {
+				t.Fatal("want a remember me cookie")
+			}
+
+			// A browser whose session has gone is logged back in, and the
+			// token is replaced.
+			code, second := useRememberToken(t, app.routes(), first)
+			if code != http.StatusOK {
+				t.Errorf("want %d; got %d", http.StatusOK, code)
+			}
+			if second == "" || second == first {
+				t.Fatalf("want a new token; got %q", second)
+			}
+
+			// A request sent at the same time with the old token still
+			// works.
+			if code, _ := useRememberToken(t, app.routes(), first); code != http.StatusOK {
+				t.Errorf("grace period: want %d; got %d", http.StatusOK, code)
+			}
+
+			// Once the token has been replaced twice, the first one is
+			// stale, so using it revokes the whole family.
+			_, third := useRememberToken(t, app.routes(), second)
+			code, cookie := useRememberToken(t, app.routes(), first)
+			if code != http.StatusFound || cookie != "" {
+				t.Errorf("reused token: want %d and no cookie; got %d and %q", http.StatusFound, code, cookie)
+			}
+			if code, _ := useRememberToken(t, app.routes(), third); code != http.StatusFound {
+				t.Errorf("revoked family: want %d; got %d", http.StatusFound, code)
+			}
+		})
+	}
+}
+
+func TestRememberMeRevoked(t *testing.T) {
+	app := newTestApplication(t)
+
+	// Without ticking the box there's no cookie.
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+	ts.login(t, "alice@example.com")
+	if token := ts.cookie(t, rememberCookie); token != "" {
+		t.Errorf("want no remember me cookie; got %q", token)
+	}
+
+	other := newTestServer(t, app.routes())
+	defer other.Close()
+	loginRemembered(t, other, "alice@example.com")
+	token := other.cookie(t, rememberCookie)
+
+	// Logging out the other sessions forgets the other browser.
+	_, _, body := ts.get(t, "/account/sessions")
+	form := url.Values{}
+	form.Add("csrf_token", extractCSRFToken(t, body))
+	ts.postForm(t, "/account/sessions/revoke-others", form)
+
+	if code, _ := useRememberToken(t, app.routes(), token); code != http.StatusFound {
+		t.Errorf("revoked session: want %d; got %d", http.StatusFound, code)
+	}
+
+	// And logging out forgets this one.
+	loginRemembered(t, ts, "alice@example.com")
+	token = ts.cookie(t, rememberCookie)
+
+	_, _, body = ts.get(t, "/account")
+	form = url.Values{}
+	form.Add("csrf_token", extractCSRFToken(t, body))
+	ts.postForm(t, "/user/logout", form)
+
+	if cookie := ts.cookie(t, rememberCookie); cookie != "" {
+		t.Errorf("want the cookie cleared; got %q", cookie)
+	}
+	if code, _ := useRememberToken(t, app.routes(), token); code != http.StatusFound {
+		t.Errorf("logged out: want %d; got %d", http.StatusFound, code)
+	}
+}
+
+func TestRememberMeGracePeriod(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	loginRemembered(t, ts, "alice@example.com")
+	token := ts.cookie(t, rememberCookie)
+
+	// Two requests sent at the same time with the same token both log in,
+	// but as the one session, which the token family belongs to.
+	if code, _ := useRememberToken(t, app.routes(), token); code != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, code)
+	}
+	if code, _ := useRememberToken(t, app.routes(), token); code != http.StatusOK {
+		t.Fatalf("grace period: want %d; got %d", http.StatusOK, code)
+	}
+
+	sessions, err := app.sessionRegistry.ForUser(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Errorf("want %d sessions; got %d", 2, len(sessions))
+	}
+}
+
+func TestRememberMeReused(t *testing.T) {
+	app := newTestApplication(t)
+
+	victim := newTestServer(t, app.routes())
+	defer victim.Close()
+	loginRemembered(t, victim, "alice@example.com")
+	stolen := victim.cookie(t, rememberCookie)
+
+	// The thief logs in with a copy of the token, and keeps using the
+	// replacement it's given, so the victim's copy goes stale.
+	thief := newTestServer(t, app.routes())
+	defer thief.Close()
+	thief.setCookie(t, rememberCookie, stolen)
+	if code, _, _ := thief.get(t, "/account"); code != http.StatusOK {
+		t.Fatalf("stolen token: want %d; got %d", http.StatusOK, code)
+	}
+	thief.setSessionToken(t, "")
+	if code, _, _ := thief.get(t, "/account"); code != http.StatusOK {
+		t.Fatalf("replaced token: want %d; got %d", http.StatusOK, code)
+	}
+
+	// When the victim's session expires and their browser uses its copy of
+	// the token, the thief is logged out too.
+	victim.setSessionToken(t, "")
+	if code, _, _ := victim.get(t, "/account"); code != http.StatusFound {
+		t.Errorf("reused token: want %d; got %d", http.StatusFound, code)
+	}
+	if code, _, _ := thief.get(t, "/account"); code != http.StatusFound {
+		t.Errorf("thief's session: want %d; got %d", http.StatusFound, code)
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	// The mock session registry numbers the sessions in the order they are
+	// created: session-1 is the browser making the requests, session-2 is
+	// Alice's other browser and session-3 is Bob's.
+	tests := []struct {
+		name              string
+		id                string
+		wantCode          int
+		wantOtherLoggedIn bool
+	}{
+		{"Other session", "session-2", http.StatusSeeOther, false},
+		{"Current session", "session-1", http.StatusBadRequest, true},
+		{"Someone else's session", "session-3", http.StatusNotFound, true},
+		{"Unknown session", "session-99", http.StatusNotFound, true},
+		{"Empty ID", "", http.StatusBadRequest, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+			other := newTestServer(t, app.routes())
+			defer other.Close()
+			bob := newTestServer(t, app.routes())
+			defer bob.Close()
+
+			ts.login(t, "alice@example.com")
+			other.login(t, "alice@example.com")
+			bob.login(t, "unverified@example.com")
+
+			_, _, body := ts.get(t, "/account/sessions")
+			form := url.Values{}
+			form.Add("id", tt.id)
+			form.Add("csrf_token", extractCSRFToken(t, body))
+
+			code, _, _ := ts.postForm(t, "/account/sessions/revoke", form)
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+
+			code, _, _ = other.get(t, "/account")
+			if loggedIn := code == http.StatusOK; loggedIn != tt.wantOtherLoggedIn {
+				t.Errorf("other session: want logged in %v; got %v", tt.wantOtherLoggedIn, loggedIn)
+			}
+
+			for name, ts := range map[string]*testServer{"current": ts, "Bob's": bob} {
+				if code, _, _ := ts.get(t, "/account"); code != http.StatusOK {
+					t.Errorf("%s session: want %d; got %d", name, http.StatusOK, code)
+				}
+			}
+		})
+	}
+}
+
+func TestSessions(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+	other := newTestServer(t, app.routes())
+	defer other.Close()
+
+	ts.login(t, "alice@example.com")
+	other.login(t, "alice@example.com")
+
+	code, _, body := ts.get(t, "/account/sessions")
+	if code != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, code)
+	}
+	for _, want := range []string{"This session", "value='session-2'", "Go-http-client"} {
+		if !bytes.Contains(body, []byte(want)) {
+			t.Errorf("want body to contain %q", want)
+		}
+	}
+
+	form := url.Values{}
+	form.Add("csrf_token", extractCSRFToken(t, body))
+	code, header, _ := ts.postForm(t, "/account/sessions/revoke-others", form)
+	if code != http.StatusSeeOther || header.Get("Location") != "/account/sessions" {
+		t.Errorf("want %d to %q; got %d to %q", http.StatusSeeOther, "/account/sessions", code, header.Get("Location"))
+	}
+
+	if code, _, _ := other.get(t, "/account"); code != http.StatusFound {
+		t.Errorf("other session: want %d; got %d", http.StatusFound, code)
+	}
+	if code, _, _ := ts.get(t, "/account"); code != http.StatusOK {
+		t.Errorf("current session: want %d; got %d", http.StatusOK, code)
+	}
+
+	// Logging out removes the session from the registry.
+	_, _, body = ts.get(t, "/account")
+	form = url.Values{}
+	form.Add("csrf_token", extractCSRFToken(t, body))
+	ts.postForm(t, "/user/logout", form)
+
+	sessions, err := app.sessionRegistry.ForUser(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 0 {
+		t.Errorf("want 0 sessions; got %d", len(sessions))
+	}
+}
+
+func TestLoginTwoFactor(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Without a pending login, the code form sends the user back to log in.
+	code, header, _ := ts.get(t, "/user/login/2fa")
+	if code != http.StatusSeeOther || header.Get("Location") != "/user/login" {
+		t.Errorf("want %d to %q; got %d to %q", http.StatusSeeOther, "/user/login", code, header.Get("Location"))
+	}
+
+	_, _, body := ts.get(t, "/user/login")
+	form := url.Values{}
+	form.Add("email", "totp@example.com")
+	form.Add("password", "validPa$$word")
+	form.Add("csrf_token", extractCSRFToken(t, body))
+
+	code, header, _ = ts.postForm(t, "/user/login", form)
+	if code != http.StatusSeeOther || header.Get("Location") != "/user/login/2fa" {
+		t.Fatalf("want %d to %q; got %d to %q", http.StatusSeeOther, "/user/login/2fa", code, header.Get("Location"))
+	}
+
+	// The password alone doesn't log the user in.
+	if code, _, _ := ts.get(t, "/account"); code != http.StatusFound {
+		t.Errorf("want %d; got %d", http.StatusFound, code)
+	}
+
+	tests := []struct {
+		name         string
+		code         string
+		wantCode     int
+		wantLocation string
+		wantBody     []byte
+	}{
+		{"Wrong code", "000000", http.StatusOK, "", []byte("Code is incorrect")},
+		{"Empty code", "", http.StatusOK, "", []byte("Code is incorrect")},
+		{"Valid code", "123456", http.StatusSeeOther, "/snippet/create", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, body := ts.get(t, "/user/login/2fa")
+			form := url.Values{}
+			form.Add("code", tt.code)
+			form.Add("csrf_token", extractCSRFToken(t, body))
+
+			code, header, body := ts.postForm(t, "/user/login/2fa", form)
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+
+			if loc := header.Get("Location"); loc != tt.wantLocation {
+				t.Errorf("want Location %q; got %q", tt.wantLocation, loc)
+			}
+
+			if !bytes.Contains(body, tt.wantBody) {
+				t.Errorf("want body %s to contain %q", body, tt.wantBody)
+			}
+		})
+	}
+
+	if code, _, _ := ts.get(t, "/account"); code != http.StatusOK {
+		t.Errorf("want %d; got %d", http.StatusOK, code)
+	}
+}
+
+func TestLoginTwoFactorDeactivatedUser(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	_, _, body := ts.get(t, "/user/login")
+	form := url.Values{}
+	form.Add("email", "totp@example.com")
+	form.Add("password", "validPa$$word")
+	form.Add("csrf_token", extractCSRFToken(t, body))
+
+	code, header, _ := ts.postForm(t, "/user/login", form)
+	if code != http.StatusSeeOther || header.Get("Location") != "/user/login/2fa" {
+		t.Fatalf("want %d to %q; got %d to %q", http.StatusSeeOther, "/user/login/2fa", code, header.Get("Location"))
+	}
+
+	// Deactivate the user while their login is waiting for a code.
+	app.users = &inactiveUserModel{}
+
+	_, _, body = ts.get(t, "/user/login/2fa")
+	form = url.Values{}
+	form.Add("code", "123456")
+	form.Add("csrf_token", extractCSRFToken(t, body))
+
+	code, header, _ = ts.postForm(t, "/user/login/2fa", form)
+	if code != http.StatusSeeOther || header.Get("Location") != "/user/login" {
+		t.Errorf("want %d to %q; got %d to %q", http.StatusSeeOther, "/user/login", code, header.Get("Location"))
+	}
+
+	_, _, body = ts.get(t, "/user/login")
+	if !bytes.Contains(body, []byte("This account has been deactivated")) {
+		t.Errorf("want body %s to contain %q", body, "This account has been deactivated")
+	}
+
+	if code, _, _ := ts.get(t, "/account"); code != http.StatusFound {
+		t.Errorf("want %d; got %d", http.StatusFound, code)
+	}
+}
+
+func TestEnableTwoFactor(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     string
+		wantCode int
+		wantBody []byte
+	}{
+		{"Valid code", "123456", http.StatusOK, []byte("abcde-fghij")},
+		{"Wrong code", "000000", http.StatusOK, []byte("Code is incorrect")},
+		{"Empty code", "", http.StatusOK, []byte("This field cannot be left blank")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			ts.login(t, "alice@example.com")
+
+			_, _, body := ts.get(t, "/account/2fa")
+			if !bytes.Contains(body, []byte("otpauth://totp/Snippetbox:alice@example.com")) {
+				t.Errorf("want body %s to contain otpauth URI", body)
+			}
+
+			code, header, _ := ts.get(t, "/account/2fa/qr.png")
+			if code != http.StatusOK || header.Get("Content-Type") != "image/png" {
+				t.Errorf("want %d image/png; got %d %s", http.StatusOK, code, header.Get("Content-Type"))
+			}
+
+			form := url.Values{}
+			form.Add("code", tt.code)
+			form.Add("csrf_token", extractCSRFToken(t, body))
+
+			code, _, body = ts.postForm(t, "/account/2fa/enable", form)
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+
+			if !bytes.Contains(body, tt.wantBody) {
+				t.Errorf("want body %s to contain %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestDisableTwoFactor(t *testing.T) {
+	tests := []struct {
+		name         string
+		userPassword string
+		wantCode     int
+		wantBody     []byte
+	}{
+		{"Valid password", "validPa$$word", http.StatusSeeOther, nil},
+		{"Wrong password", "wrongPa$$word", http.StatusOK, []byte("Password is incorrect")},
+		{"Empty password", "", http.StatusOK, []byte("This field cannot be left blank")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			ts.login(t, "totp@example.com")
+			_, _, body := ts.get(t, "/user/login/2fa")
+			form := url.Values{}
+			form.Add("code", "abcde-fghij")
+			form.Add("csrf_token", extractCSRFToken(t, body))
+			ts.postForm(t, "/user/login/2fa", form)
+
+			_, _, body = ts.get(t, "/account/2fa")
+			form = url.Values{}
+			form.Add("password", tt.userPassword)
+			form.Add("csrf_token", extractCSRFToken(t, body))
+
+			code, _, body := ts.postForm(t, "/account/2fa/disable", form)
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+
+			if !bytes.Contains(body, tt.wantBody) {
+				t.Errorf("want body %s to contain %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		name         string
+		addr         string
+		target       string
+		wantCode     int
+		wantLocation string
+	}{
+		{"Default port", ":443", "http://example.com/snippet/1?x=y", http.StatusMovedPermanently, "https://example.com/snippet/1?x=y"},
+		{"Custom port", ":4000", "http://example.com:8080/", http.StatusMovedPermanently, "https://example.com:4000/"},
+		{"IPv6 host", ":4000", "http://[::1]:8080/ping", http.StatusMovedPermanently, "https://[::1]:4000/ping"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.addr = tt.addr
+
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", tt.target, nil)
+
+			app.redirectToHTTPS(rr, r)
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, rr.Code)
+			}
+
+			if location := rr.Header().Get("Location"); location != tt.wantLocation {
+				t.Errorf("want %q; got %q", tt.wantLocation, location)
+			}
+		})
+	}
+}
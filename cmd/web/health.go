@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// The checkResult type holds the outcome of a single health check, as
+// reported in the JSON response from /healthz and /readyz.
+type checkResult struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// The healthResponse type is the JSON response from /healthz and /readyz.
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// The healthz handler is the liveness check. It only tells the orchestrator
+// whether the process is alive and able to serve requests, so it doesn't
+// depend on anything external like the database; restarting the process
+// wouldn't fix an unreachable database anyway.
+func (app *application) healthz(w http.ResponseWriter, r *http.Request) {
+	app.writeHealth(w, map[string]checkResult{
+		"process": {Status: "ok"},
+	})
+}
+
+// The readyz handler is the readiness check, which load balancers use to
+// decide whether to send us traffic. It checks that the database is
+// reachable, the templates are loaded and the background workers are running,
+// and it fails as soon as we start shutting down so that the load balancer
+// drains the instance.
+func (app *application) readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]func(context.Context) error{
+		"database":  app.checkDatabase,
+		"templates": app.checkTemplates,
+		"workers":   app.checkWorkers,
+		"shutdown":  app.checkShutdown,
+	}
+
+	results := map[string]checkResult{}
+	for name, check := range checks {
+		results[name] = runCheck(r.Context(), app.config.timeouts.healthCheck, check)
+	}
+
+	app.writeHealth(w, results)
+}
+
+// The runCheck() function runs a single check with a timeout, timing how long
+// it takes.
+func runCheck(ctx context.Context, timeout time.Duration, check func(context.Context) error) checkResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check(ctx)
+	result := checkResult{
+		Status:    "ok",
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		result.Status = "failing"
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// The writeHealth() helper writes the check results as JSON. If any check is
+// failing, the response has a 503 Service Unavailable status.
+func (app *application) writeHealth(w http.ResponseWriter, results map[string]checkResult) {
+	resp := healthResponse{Status: "ok", Checks: results}
+	status := http.StatusOK
+	for _, result := range results {
+		if result.Status != "ok" {
+			resp.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+func (app *application) checkDatabase(ctx context.Context) error {
+	return app.db.PingContext(ctx)
+}
+
+func (app *application) checkTemplates(ctx context.Context) error {
+	if len(app.templateCache) == 0 {
+		return errors.New("no templates are loaded")
+	}
+	return nil
+}
+
+func (app *application) checkWorkers(ctx context.Context) error {
+	if failed := app.workersFailed.Load(); failed > 0 {
+		return fmt.Errorf("%d background worker(s) stopped unexpectedly", failed)
+	}
+	return nil
+}
+
+func (app *application) checkShutdown(ctx context.Context) error {
+	if app.shuttingDown.Load() {
+		return errors.New("server is shutting down")
+	}
+	return nil
+}
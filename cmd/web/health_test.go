@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHealthz(t *testing.T) {
+	app := newTestApplication(t)
+	// Liveness shouldn't depend on the database.
+	app.db = &fakeDB{err: errors.New("connection refused")}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	code, header, body := ts.get(t, "/healthz")
+
+	if code != http.StatusOK {
+		t.Errorf("want %d; got %d", http.StatusOK, code)
+	}
+
+	if ct := header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("want Content-Type %q; got %q", "application/json", ct)
+	}
+
+	var resp healthResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Status != "ok" {
+		t.Errorf("want status %q; got %q", "ok", resp.Status)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name        string
+		setup       func(app *application)
+		wantCode    int
+		wantFailing string
+	}{
+		{"Ready", func(app *application) {}, http.StatusOK, ""},
+		{"Database down", func(app *application) {
+			app.db = &fakeDB{err: errors.New("connection refused")}
+		}, http.StatusServiceUnavailable, "database"},
+		{"Database slow", func(app *application) {
+			app.db = &fakeDB{block: true}
+			app.config.timeouts.healthCheck = 10 * time.Millisecond
+		}, http.StatusServiceUnavailable, "database"},
+		{"No templates", func(app *application) {
+			app.templateCache = nil
+		}, http.StatusServiceUnavailable, "templates"},
+		{"Worker failed", func(app *application) {
+			done := make(chan struct{})
+			app.background(func(quit <-chan struct{}) {
+				close(done)
+			})
+			<-done
+			app.wg.Wait()
+		}, http.StatusServiceUnavailable, "workers"},
+		{"Shutting down", func(app *application) {
+			app.shuttingDown.Store(true)
+		}, http.StatusServiceUnavailable, "shutdown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			tt.setup(app)
+
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			code, _, body := ts.get(t, "/readyz")
+
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+
+			var resp healthResponse
+			if err := json.Unmarshal(body, &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, name := range []string{"database", "templates", "workers", "shutdown"} {
+				result, ok := resp.Checks[name]
+				if !ok {
+					t.Errorf("want %s check in response", name)
+					continue
+				}
+
+				wantStatus := "ok"
+				if name == tt.wantFailing {
+					wantStatus = "failing"
+				}
+				if result.Status != wantStatus {
+					t.Errorf("want %s check %q; got %q (%s)", name, wantStatus, result.Status, result.Error)
+				}
+			}
+		})
+	}
+}
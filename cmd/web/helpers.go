@@ -2,23 +2,61 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"regexp"
 	"runtime/debug"
+	"strings"
 	"time"
 
+	"chilliweb.com/snippetbox/pkg/mailer"
 	"chilliweb.com/snippetbox/pkg/models"
 
 	"github.com/justinas/nosurf" // CSRF Management
+	"go.opentelemetry.io/otel/codes"
 )
 
-// The serverError helper writes an error message and stack trace to the errorLog,
-// then sends a generic 500 Internal Server Error response to the user.
-func (app *application) serverError(w http.ResponseWriter, err error) {
-	trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
-	// Using Output() with a level of 2 to take one step back and report the
-	// actual origin of the error rather than the file and calling position
-	app.errorLog.Output(2, trace)
+// The serverError helper writes an error message and stack trace to the log,
+// along with the request ID so the error can be matched up with the access log
+// entry, then sends a generic 500 Internal Server Error response to the user.
+//
+// Errors caused by a context ending are handled differently. If a database
+// query took too long and hit its deadline, we send a 503 Service Unavailable
+// response instead, asking the client to try again shortly. If the client went
+// away before we finished, there's nobody to send a response to, and it's not
+// a problem with our application, so we only log it at the debug level.
+func (app *application) serverError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		app.logger.WarnContext(r.Context(), err.Error(),
+			slog.String("method", r.Method),
+			slog.String("uri", r.URL.RequestURI()),
+		)
+		w.Header().Set("Retry-After", "5")
+		app.clientError(w, http.StatusServiceUnavailable)
+		return
+	case errors.Is(err, context.Canceled) && r.Context().Err() != nil:
+		app.logger.DebugContext(r.Context(), "request cancelled by client",
+			slog.String("method", r.Method),
+			slog.String("uri", r.URL.RequestURI()),
+		)
+		return
+	}
+
+	app.logger.ErrorContext(r.Context(), err.Error(),
+		slog.String("method", r.Method),
+		slog.String("uri", r.URL.RequestURI()),
+		slog.String("trace", string(debug.Stack())),
+	)
 
 	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
@@ -45,8 +83,12 @@ func (app *application) addDefaultData(td *templateData, r *http.Request) *templ
 
 	td.AuthenticatedUser = app.authenticatedUser(r)
 	td.CSRFToken = nosurf.Token(r)
+	td.CSPNonce = cspNonce(r)
 	td.CurrentYear = time.Now().Year()
 	td.Flash = app.session.PopString(r, "flash")
+	if app.oidc != nil {
+		td.SSOName = app.oidc.name
+	}
 
 	return td
 }
@@ -57,7 +99,7 @@ func (app *application) render(w http.ResponseWriter, r *http.Request, name stri
 	// call the serverError helper method
 	ts, ok := app.templateCache[name]
 	if !ok {
-		app.serverError(w, fmt.Errorf("The template %s does not exist", name))
+		app.serverError(w, r, fmt.Errorf("The template %s does not exist", name))
 		return
 	}
 
@@ -65,10 +107,19 @@ func (app *application) render(w http.ResponseWriter, r *http.Request, name stri
 	buf := new(bytes.Buffer)
 
 	// Write the template to the buffer, instead of straight to the http.ResponseWriter.
-	// If there's an error, call the serverError helper and then return
+	// If there's an error, call the serverError helper and then return.
+	// We also record how long it takes, for the metrics, and in a trace span.
+	_, span := tracer.Start(r.Context(), "render "+name)
+	start := time.Now()
 	err := ts.Execute(buf, app.addDefaultData(td, r))
+	app.metrics.renderDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
 	if err != nil {
-		app.serverError(w, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	if err != nil {
+		app.serverError(w, r, err)
 		return
 	}
 
@@ -78,6 +129,21 @@ func (app *application) render(w http.ResponseWriter, r *http.Request, name stri
 	buf.WriteTo(w)
 }
 
+// The writeJSON() helper encodes v as JSON and writes it with the given
+// status code, for the handlers which are called from JavaScript.
+func (app *application) writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
 // We are now looking for a *models.User struct in the request context.
 // If it is present, we know we have a logged in authenticated user
 // We can return the corresponding user details
@@ -88,3 +154,260 @@ func (app *application) authenticatedUser(r *http.Request) *models.User {
 	}
 	return user
 }
+
+// The logIn() helper adds the user's ID to the session, so that they are now
+// 'logged in', along with their session version. If their password changes
+// the version changes too, and this session stops being authenticated. The
+// session is also added to the session registry, and its ID stored in the
+// session, so that the user can see it on their sessions page and revoke it
+// from another device. The session gets a new token first, so that a token
+// someone else planted in the user's browser before they logged in (session
+// fixation) isn't logged in too.
+func (app *application) logIn(r *http.Request, user *models.User) error {
+	id, err := app.sessionRegistry.Create(r.Context(), user.ID, clientIP(r), r.UserAgent(), app.config.session.lifetime)
+	if err != nil {
+		return err
+	}
+
+	app.joinSession(r, user, id)
+	return nil
+}
+
+// The joinSession() helper logs the request's session in as the user, as
+// the session in the registry with the given ID.
+func (app *application) joinSession(r *http.Request, user *models.User, id string) {
+	app.session.RenewToken(r)
+	app.session.Put(r, "userID", user.ID)
+	app.session.Put(r, "sessionVersion", user.SessionVersion)
+	app.session.Put(r, "sessionID", id)
+}
+
+// The name of the cookie holding the user's "remember me" token.
+const rememberCookie = "remember"
+
+// The remember() helper starts a "remember me" token family for the logged
+// in session, and sends the token to the browser, so that the user is logged
+// back in when the session expires. It must be called after logIn().
+func (app *application) remember(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	token, err := app.rememberTokens.Create(r.Context(), user.ID, app.session.GetString(r, "sessionID"), app.config.tokens.rememberMe)
+	if err != nil {
+		return err
+	}
+
+	app.setRememberCookie(w, token)
+	return nil
+}
+
+// The setRememberCookie() helper sends the "remember me" token cookie, which
+// lasts as long as the token does unless it is used. Like the session cookie
+// it is HttpOnly, so scripts can't read it.
+func (app *application) setRememberCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     rememberCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(app.config.tokens.rememberMe.Seconds()),
+		Secure:   app.config.secureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// The clearRememberCookie() helper tells the browser to delete the "remember
+// me" token cookie.
+func (app *application) clearRememberCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     rememberCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   app.config.secureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// The logInRemembered() helper logs the user in with their "remember me"
+// token, if the request has one, and returns them. The token is replaced
+// with a new one each time it's used. If it has already been replaced (and
+// it isn't a request the browser sent at the same time), someone has copied
+// it, so the token family has been deleted, logging out both the user and
+// whoever copied it. A nil user means the request isn't logged in.
+func (app *application) logInRemembered(w http.ResponseWriter, r *http.Request) (*models.User, error) {
+	cookie, err := r.Cookie(rememberCookie)
+	if err != nil {
+		return nil, nil
+	}
+
+	login, err := app.rememberTokens.Use(r.Context(), cookie.Value, app.config.tokens.rememberMe)
+	if err == models.ErrInvalidToken {
+		app.clearRememberCookie(w)
+		return nil, nil
+	} else if err == models.ErrTokenReused {
+		// Either this browser or the one which used the token last has a
+		// stolen copy, and we can't tell which, so log out the session the
+		// other one started as well.
+		app.logger.WarnContext(r.Context(), "remember me token reused; token family revoked",
+			slog.Int("user_id", login.UserID), slog.String("remote_addr", r.RemoteAddr))
+		app.clearRememberCookie(w)
+
+		err := app.sessionRegistry.Revoke(r.Context(), login.UserID, login.SessionID)
+		if err != nil && err != models.ErrNoRecord {
+			return nil, err
+		}
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	user, err := app.users.Get(r.Context(), login.UserID)
+	if err == models.ErrNoRecord || (err == nil && !user.Active) {
+		app.clearRememberCookie(w)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// An empty token means the token was replaced a moment ago, by a request
+	// the browser sent at the same time, which has already logged in. This
+	// request joins the session that one started, rather than adding
+	// another to the registry which the token family doesn't belong to. If
+	// that session isn't there, the other request hasn't got as far as
+	// recording it yet, and we log in as usual.
+	if login.Token == "" {
+		err := app.sessionRegistry.Touch(r.Context(), user.ID, login.SessionID, clientIP(r))
+		if err == nil {
+			app.joinSession(r, user, login.SessionID)
+			return user, nil
+		} else if err != models.ErrNoRecord {
+			return nil, err
+		}
+	}
+
+	if err := app.logIn(r, user); err != nil {
+		return nil, err
+	}
+
+	// An empty token means the browser should keep the one it has.
+	token := login.Token
+	if token == "" {
+		token = cookie.Value
+	} else {
+		app.setRememberCookie(w, token)
+	}
+
+	// The family now belongs to the new session, so that revoking the
+	// session revokes the family too.
+	err = app.rememberTokens.SetSession(r.Context(), token, app.session.GetString(r, "sessionID"))
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// The remoteIP() helper returns the IP address from r.RemoteAddr, or nil if
+// it can't be parsed. The address normally includes a port, but won't if it
+// has been replaced by the trustProxy middleware.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// The clientIP() helper returns the client's IP address as a string, or the
+// raw RemoteAddr if it can't be parsed.
+func clientIP(r *http.Request) string {
+	if ip := remoteIP(r); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
+
+// The isHTTPS() helper reports whether the client made the request over HTTPS,
+// either directly to us or to a trusted reverse proxy in front of us.
+func isHTTPS(r *http.Request) bool {
+	if forwarded, ok := r.Context().Value(contextKeyForwardedHTTPS).(bool); ok {
+		return forwarded
+	}
+	return r.TLS != nil
+}
+
+// The requestIDRX regular expression matches the request IDs we're willing to
+// accept from clients: between 1 and 128 letters, digits and simple
+// punctuation, so they can't be used to inject anything into our logs.
+var requestIDRX = regexp.MustCompile(`^[a-zA-Z0-9._:-]{1,128}$`)
+
+// The newRequestID() helper generates a random 128-bit request ID, encoded
+// as hex.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// The newNonce() helper generates a random 128-bit nonce for the
+// Content-Security-Policy. It is encoded with the URL-safe base64 alphabet
+// (which CSP allows) so that html/template leaves it unescaped in attributes.
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// The cspNonce() helper returns the Content-Security-Policy nonce for the
+// request, or the empty string if the secureHeaders middleware hasn't run.
+func cspNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(contextKeyCSPNonce).(string)
+	return nonce
+}
+
+// The absoluteURL() helper returns the absolute URL for a path on the site,
+// using the configured base URL, for links in emails.
+func (app *application) absoluteURL(path string) string {
+	return strings.TrimSuffix(app.config.baseURL, "/") + path
+}
+
+// The safeRedirect() helper returns next if it's a path on this site, or the
+// create snippet page (where users go after logging in) otherwise. Without
+// this check, a link to our login page could send users on to any site once
+// they'd logged in: an open redirect, which is useful for phishing. Browsers
+// treat paths starting with // or /\ as URLs on another host, and ignore
+// tabs and newlines in URLs, so those are refused too.
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.ContainsAny(next, "\\\t\r\n") {
+		return "/snippet/create"
+	}
+
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return "/snippet/create"
+	}
+	return next
+}
+
+// The sendMail() helper sends an email in the background, so that the
+// response isn't held up by the mail server and its timing doesn't reveal
+// whether we sent anything. The goroutine is tracked in the application's
+// WaitGroup so that emails in flight are sent before we shut down. Failures
+// are logged with the request ID from ctx.
+func (app *application) sendMail(ctx context.Context, msg mailer.Message) {
+	ctx = context.WithoutCancel(ctx)
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.ErrorContext(ctx, fmt.Sprintf("sending email panicked: %s", err))
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+
+		if err := app.mailer.Send(ctx, msg); err != nil {
+			app.logger.ErrorContext(ctx, "sending email failed", slog.String("error", err.Error()))
+		}
+	}()
+}
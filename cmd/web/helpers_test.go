@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServerError(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		cancelRequest  bool
+		wantCode       int
+		wantRetryAfter string
+		wantLevel      string
+	}{
+		{"Generic error", errors.New("boom"), false, http.StatusInternalServerError, "", "level=ERROR"},
+		{"Query deadline", fmt.Errorf("query: %w", context.DeadlineExceeded), false, http.StatusServiceUnavailable, "5", "level=WARN"},
+		{"Client went away", context.Canceled, true, 0, "", "level=DEBUG"},
+		{"Cancelled elsewhere", context.Canceled, false, http.StatusInternalServerError, "", "level=ERROR"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			logs := new(bytes.Buffer)
+			app.logger = newTestLogger(logs, "debug")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancelRequest {
+				cancel()
+			}
+
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+
+			app.serverError(rr, r, tt.err)
+
+			// If nothing was written, the recorder's Code is still its
+			// default of 200, so check whether a body was written instead.
+			code := rr.Code
+			if rr.Body.Len() == 0 {
+				code = 0
+			}
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+
+			if ra := rr.Header().Get("Retry-After"); ra != tt.wantRetryAfter {
+				t.Errorf("want Retry-After %q; got %q", tt.wantRetryAfter, ra)
+			}
+
+			if !strings.Contains(logs.String(), tt.wantLevel) {
+				t.Errorf("want log at %s; got %q", tt.wantLevel, logs.String())
+			}
+		})
+	}
+}
+
+func TestSafeRedirect(t *testing.T) {
+	tests := []struct {
+		next string
+		want string
+	}{
+		{"/snippet/42", "/snippet/42"},
+		{"/account?tab=passkeys", "/account?tab=passkeys"},
+		{"", "/snippet/create"},
+		{"https://evil.example.com/", "/snippet/create"},
+		{"//evil.example.com/", "/snippet/create"},
+		{"/\\evil.example.com/", "/snippet/create"},
+		{"/\t/evil.example.com/", "/snippet/create"},
+		{"javascript:alert(1)", "/snippet/create"},
+		{"snippet/42", "/snippet/create"},
+	}
+
+	for _, tt := range tests {
+		if got := safeRedirect(tt.next); got != tt.want {
+			t.Errorf("safeRedirect(%q): want %q; got %q", tt.next, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The newLogger() function creates a structured, leveled logger which writes
+// to w in either "json" or "text" (logfmt) format. Only messages at or above
+// the given level ("debug", "info", "warn" or "error") are written.
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+
+	return slog.New(contextHandler{h}), nil
+}
+
+// The contextHandler type wraps a slog.Handler and adds request-scoped values
+// from the context (such as the request ID) to every record logged with one
+// of the *Context methods, like app.logger.InfoContext(r.Context(), ...).
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, ok := ctx.Value(contextKeyRequestID).(string); ok {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(
+			slog.String("trace_id", sc.TraceID().String()),
+			slog.String("span_id", sc.SpanID().String()),
+		)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// The accessLogEntry type holds the details of a request which are only known
+// further down the middleware chain, so that the logRequest middleware can
+// include them in the access log (and the trace middleware in its span). A
+// pointer to it is stored in the request context, so that inner middleware
+// like authenticate can fill it in.
+type accessLogEntry struct {
+	route  string
+	userID int
+}
+
+// The logEntry() helper returns the accessLogEntry for the request, or a
+// throwaway one if the request isn't being logged.
+func logEntry(r *http.Request) *accessLogEntry {
+	entry, ok := r.Context().Value(contextKeyAccessLog).(*accessLogEntry)
+	if !ok {
+		return &accessLogEntry{}
+	}
+	return entry
+}
+
+// The withLogEntry() helper returns the request's accessLogEntry, first
+// adding a new one to the request context if there isn't one already.
+func withLogEntry(r *http.Request) (*http.Request, *accessLogEntry) {
+	if entry, ok := r.Context().Value(contextKeyAccessLog).(*accessLogEntry); ok {
+		return r, entry
+	}
+
+	entry := &accessLogEntry{}
+	return r.WithContext(context.WithValue(r.Context(), contextKeyAccessLog, entry)), entry
+}
+
+// The sensitiveParams are the query string parameters which carry secrets,
+// like the tokens in emailed links, and so must be kept out of the logs.
+var sensitiveParams = []string{"token"}
+
+// The redactedURI() helper returns the request URI for logging, with the
+// values of any sensitive query string parameters replaced.
+func redactedURI(u *url.URL) string {
+	query := u.Query()
+	redacted := false
+	for _, name := range sensitiveParams {
+		if query.Has(name) {
+			query.Set(name, "REDACTED")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return u.RequestURI()
+	}
+
+	c := *u
+	c.RawQuery = query.Encode()
+	return c.RequestURI()
+}
+
+// The responseRecorder type wraps a http.ResponseWriter to record the status
+// code and number of bytes written, for the access log.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rw *responseRecorder) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseRecorder) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += n
+	return n, err
+}
+
+// The Unwrap() method lets http.ResponseController reach the underlying
+// http.ResponseWriter.
+func (rw *responseRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
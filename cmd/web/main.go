@@ -1,170 +1,495 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
 	"flag"
+	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"chilliweb.com/snippetbox/pkg/ldapauth"
+	"chilliweb.com/snippetbox/pkg/mailer"
 	"chilliweb.com/snippetbox/pkg/models"
 
 	"chilliweb.com/snippetbox/pkg/models/mysql"
+	"chilliweb.com/snippetbox/pkg/session"
 
 	// If we try to import this normally the Go compiler will raise an error.
 	// However, we need the driver's init() function to run so that it can register itself with the database/sql package.
 	// The trick to getting around this is to alias the package name to the blank identifier
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/golangcollege/sessions"
+	"github.com/go-webauthn/webauthn/webauthn"
 )
 
 type contextKey string
 
 var contextKeyUser = contextKey("user")
+var contextKeyForwardedHTTPS = contextKey("forwardedHTTPS")
+var contextKeyRequestID = contextKey("requestID")
+var contextKeyAccessLog = contextKey("accessLog")
+var contextKeyCSPNonce = contextKey("cspNonce")
+
+// The authenticator interface is implemented by anything which can check a
+// user's email address and password when they log in, returning their user
+// ID. The mysql.UserModel checks the password hashes in our own database, and
+// ldapauth.Authenticator binds to an LDAP directory.
+type authenticator interface {
+	Authenticate(ctx context.Context, email, password, ip string) (int, error)
+}
 
 // Define an application struct to hold the application-wide dependencies for the
 // web application. User Model has now been added
 type application struct {
-	errorLog *log.Logger
-	infoLog  *log.Logger
-	session  *sessions.Session
+	config   *config
+	logger   *slog.Logger
+	session  *session.Manager
 	snippets interface {
-		Insert(string, string, string) (int, error)
-		Get(int) (*models.Snippet, error)
-		Latest() ([]*models.Snippet, error)
+		Insert(context.Context, string, string, string) (int, error)
+		Get(context.Context, int) (*models.Snippet, error)
+		Latest(context.Context) ([]*models.Snippet, error)
+		Search(context.Context, string, int) ([]*models.Snippet, error)
+		Delete(context.Context, int) error
 	}
+	metrics       *metrics
+	rateLimits    rateLimitStore
 	templateCache map[string]*template.Template
 	users         interface {
-		Insert(string, string, string) error
-		Authenticate(string, string) (int, error)
-		Get(int) (*models.User, error)
+		Insert(context.Context, string, string, string) (int, error)
+		Get(context.Context, int) (*models.User, error)
+		CreatePasswordReset(context.Context, string, time.Duration) (string, error)
+		ResetPassword(context.Context, string, string) (int, error)
+		CreateLoginToken(context.Context, string, time.Duration) (string, error)
+		ConsumeLoginToken(context.Context, string) (int, error)
+		VerifyEmail(context.Context, int, string) error
+		UpdateName(context.Context, int, string) error
+		UpdateEmail(context.Context, int, string, string) error
+		ChangePassword(context.Context, int, string, string) error
+		EnableTOTP(context.Context, int, string, string) ([]string, error)
+		DisableTOTP(context.Context, int, string) error
+		AuthenticateTOTP(context.Context, int, string) error
+		AuthenticateIdentity(context.Context, *models.Identity, bool) (int, error)
+		Search(context.Context, string, int) ([]*models.User, error)
+		SetRole(context.Context, int, string) error
+		SetActive(context.Context, int, bool) error
+		UnlockID(context.Context, int) error
+	}
+	// The counts of users, snippets and sessions for the admin dashboard.
+	stats interface {
+		Get(context.Context) (*models.Stats, error)
+	}
+	// The authenticator checks email addresses and passwords when users log
+	// in.
+	authenticator authenticator
+	credentials   interface {
+		Insert(context.Context, *models.Credential) error
+		ForUser(context.Context, int) ([]*models.Credential, error)
+		RecordUse(context.Context, []byte, uint32, bool) error
+		Delete(context.Context, int, []byte) error
+	}
+	// The registry of logged in sessions, which authenticate checks on
+	// every request, so that sessions can be revoked before their cookie
+	// expires.
+	sessionRegistry interface {
+		Create(context.Context, int, string, string, time.Duration) (string, error)
+		Touch(context.Context, int, string, string) error
+		ForUser(context.Context, int) ([]*models.Session, error)
+		Revoke(context.Context, int, string) error
+		RevokeOthers(context.Context, int, string) error
+	}
+	// The "remember me" tokens, which log users back in when their session
+	// has expired. Each token family belongs to a session in the registry.
+	rememberTokens interface {
+		Create(context.Context, int, string, time.Duration) (string, error)
+		Use(context.Context, string, time.Duration) (*models.RememberedLogin, error)
+		SetSession(context.Context, string, string) error
+		Delete(context.Context, string) error
+		DeleteForSession(context.Context, int, string) error
+		DeleteForUser(context.Context, int, string) error
+	}
+	// The WebAuthn relying party, for registering and logging in with
+	// passkeys.
+	webAuthn *webauthn.WebAuthn
+	// The OpenID Connect provider for single sign-on, or nil if it isn't
+	// configured.
+	oidc *oidcProvider
+	// The mailer for sending emails, like password reset links.
+	mailer mailer.Mailer
+	// The database connection pool, used directly by the readiness check.
+	db interface {
+		PingContext(context.Context) error
 	}
+	// The channel and WaitGroup used to stop and track background workers
+	// when shutting down, a count of workers which have stopped unexpectedly,
+	// and whether we are shutting down, for the readiness check.
+	quit          chan struct{}
+	wg            sync.WaitGroup
+	workersFailed atomic.Int64
+	shuttingDown  atomic.Bool
+	// When the server started, for the uptime on the admin dashboard.
+	started time.Time
 }
 
 func main() {
-	// Define a new command-line flag with the name 'addr', a default value of ":4000"
-	// and some short help text explaining what the flag controls.
-	// The value of he flag will be stored in the addr variable at runtime
-	addr := flag.String("addr", ":4000", "HTTP network address")
-
-	// Define a new command-line flag for the MySQL DSN string
-	dsn := flag.String("dsn", "web:jiwa@/snippetbox?parseTime=true", "MySQL data source name")
-
-	// Define a new command-line flag for the session secret (a random key which
-	// will be used to encrypt and authenticate session cookies).
-	// It should be 32 bytes long
-	secret := flag.String("secret", "j@883r_w0c|<%-@_pO3m4alL8|`|`rQD", "Secret key")
-
-	// Importantly, we use the flag.Parse() function to parse the command-line flag.
-	// This reads in the command-line flag value and assigns it to the addr variable.
-	// This needs to be called *before* you use the addr variable
-	// otherwise it will always contain the default value of ":4000".
-	// If any errors are encountered during parsing the application will be terminated
-	flag.Parse()
-
-	// Use log.New() to create a logger for writing information messages.
-	// This takes three parameters: the destination to write the logs to (os.Stdout),
-	// a string prefix for message (INFO followed by a tab), and flags to indicate what
-	// additional information to include (local date and time).
-	// Note that the flags are joined using the bitwise OR operator |.
-	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
-
-	// Create a logger for writing error messages in the same way. but use stderr as
-	// the destination amd also ther log.Lshortfile flag to include the relevant
-	// file name and line number
-	// If we wanted the full file path we can use log.Llongfile instead
-	// If we want to force UTC datetimes, we can use the log.LUTC flag
-	errorLog := log.New(os.Stderr, "Error\t", log.Ldate|log.Ltime|log.Lshortfile)
+	// Load the configuration from the config file, environment variables and
+	// command-line flags. If the -h flag was given, the usage has already been
+	// printed so we just exit. Any other error means the configuration is
+	// invalid and we refuse to start. We haven't got a configured logger yet,
+	// so the error is written using the default one.
+	cfg, err := loadConfig(os.Args[1:], os.LookupEnv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		slog.Error(err.Error())
+		os.Exit(2)
+	}
+
+	// If we've been asked for a new secret key, print one and exit. It's
+	// written on its own to stdout, so that it can be redirected to a file.
+	if cfg.generateSecret {
+		fmt.Println(newSecret())
+		os.Exit(0)
+	}
+
+	// Create a structured logger for writing both information and error
+	// messages to stdout, in the configured format (JSON or logfmt-style text)
+	// and at the configured minimum level. The configuration has already been
+	// validated, so this can't fail.
+	logger, _ := newLogger(os.Stdout, cfg.log.format, cfg.log.level)
+
+	// The http.Server (and a few other things) need a standard library
+	// *log.Logger for their error messages, so create one which writes to our
+	// structured logger at the error level.
+	errorLog := slog.NewLogLogger(logger.Handler(), slog.LevelError)
 
 	// To keep the main() fnction tidy, the code for creating a connection pool
-	// has been put into the separate openDB() function below. We pass openDB() the DSN
-	// from the command-line flag.
-	db, err := openDB(*dsn)
+	// has been put into the separate openDB() function below. We pass openDB() the
+	// configuration, which holds the DSN and the connection pool limits.
+	db, err := openDB(cfg)
 	if err != nil {
-		errorLog.Fatal(err)
+		logger.Error(err.Error())
+		os.Exit(1)
 	}
 
-	// We also defer a call to db.Close() so that the connection pool is closed
-	// before the main() function exits.
-	// This is a bit superfluous. Our application is only ever terminated by a signal interrupt
-	// (i.e. Ctrl+c) or by errorLog.Fatal().
-	// In both of those cases, the program exits immediately and deferred functions are never run
-	defer db.Close()
+	// Initialize a mysql.UserModel instance, with the account lockout policy
+	users := &mysql.UserModel{
+		DB:      db,
+		Timeout: cfg.db.queryTimeout,
+		Lockout: mysql.Lockout{
+			Threshold:   cfg.lockout.threshold,
+			Duration:    cfg.lockout.duration,
+			MaxDuration: cfg.lockout.maxDuration,
+		},
+	}
+
+	// If we've been asked to unlock a user's account, do that and exit
+	// without starting the server.
+	if cfg.unlockUser != "" {
+		err := users.Unlock(context.Background(), cfg.unlockUser)
+		db.Close()
+		if err != nil {
+			logger.Error(err.Error(), slog.String("email", cfg.unlockUser))
+			os.Exit(1)
+		}
+		logger.Info("unlocked account", slog.String("email", cfg.unlockUser))
+		os.Exit(0)
+	}
+
+	// Likewise if we've been asked to make a user an admin.
+	if cfg.makeAdmin != "" {
+		err := users.MakeAdmin(context.Background(), cfg.makeAdmin)
+		db.Close()
+		if err != nil {
+			logger.Error(err.Error(), slog.String("email", cfg.makeAdmin))
+			os.Exit(1)
+		}
+		logger.Info("made account an admin", slog.String("email", cfg.makeAdmin))
+		os.Exit(0)
+	}
+
+	// Check passwords against the LDAP directory if it's configured, rather
+	// than our own database.
+	var auth authenticator = users
+	if cfg.authBackend == "ldap" {
+		auth, err = newLDAPAuthenticator(cfg, users)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	// Send emails through the SMTP server if one is configured. Otherwise
+	// they are written to files, which is what we want in development.
+	var appMailer mailer.Mailer = &mailer.File{Dir: cfg.mail.dir, From: cfg.mail.from}
+	if cfg.mail.smtpAddr != "" {
+		appMailer = &mailer.SMTP{
+			Addr:     cfg.mail.smtpAddr,
+			Username: cfg.mail.smtpUsername,
+			Password: cfg.mail.smtpPassword,
+			From:     cfg.mail.from,
+		}
+	} else if cfg.env == "production" {
+		logger.Warn("no SMTP server configured; emails will be written to files", slog.String("dir", cfg.mail.dir))
+	}
 
 	// Initialize a new template cache
 	templateCache, err := newTemplateCache("./ui/html/")
 	if err != nil {
-		errorLog.Fatal(err)
+		logger.Error(err.Error())
+		os.Exit(1)
 	}
 
 	// Use the session.New() function to initialize a new session manager,
-	// passing in the scret key as the parameter. Then we configure it so
-	// sessions always expire after 12 hours
-	session := sessions.New([]byte(*secret))
-	session.Lifetime = 12 * time.Hour
-	session.Secure = true // Set the Secure flag on session cookies
+	// keeping the session data in the database (or in memory, for a single
+	// instance in development). Then we configure it so sessions always
+	// expire after the configured lifetime (12 hours by default)
+	var sessionStore session.Store = &mysql.SessionStore{DB: db, Timeout: cfg.db.queryTimeout}
+	if cfg.session.store == "memory" {
+		sessionStore = session.NewMemoryStore()
+	}
+	sessionManager := session.New(sessionStore)
+	sessionManager.Lifetime = cfg.session.lifetime
+	sessionManager.Cookie.Secure = cfg.secureCookies // Set the Secure flag on session cookies
+
+	// Set up tracing, exporting spans to the OTLP collector if one is
+	// configured.
+	tp, err := newTracerProvider(context.Background(), cfg)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// Create the WebAuthn relying party for passkeys, which are tied to the
+	// host name in the base URL.
+	webAuthn, err := newWebAuthn(cfg.baseURL)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// Fetch the OpenID Connect provider's configuration, if single sign-on
+	// is configured.
+	oidcProvider, err := newOIDCProvider(context.Background(), cfg, &http.Client{Timeout: 10 * time.Second})
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// Create the Prometheus metrics, including the connection pool statistics
+	appMetrics := newMetrics()
+	appMetrics.registerDB(db)
 
 	// Initialize a new instance of application containing the dependencies
 	app := &application{
+		// The configuration settings
+		config: cfg,
 		// Logging dependencies
-		errorLog: errorLog,
-		infoLog:  infoLog,
+		logger: logger,
+		// Prometheus metrics
+		metrics: appMetrics,
+		// The token buckets for rate limiting
+		rateLimits: newMemoryRateLimitStore(time.Now),
 		// Session management
-		session: session,
+		session: sessionManager,
 		// Add the mysql.SnippetModel instance to the dependencies
-		snippets: &mysql.SnippetModel{DB: db},
+		snippets: &mysql.SnippetModel{DB: db, Timeout: cfg.db.queryTimeout},
 		// Add the template cache to the dependencies
 		templateCache: templateCache,
-		// Initialize a mysql.UserModel instance and add to the dependencies
-		users: &mysql.UserModel{DB: db},
+		// Add the mysql.UserModel instance to the dependencies
+		users: users,
+		// And the authenticator for checking passwords
+		authenticator: auth,
+		// The session registry
+		sessionRegistry: &mysql.SessionModel{DB: db, Timeout: cfg.db.queryTimeout},
+		rememberTokens:  &mysql.RememberTokenModel{DB: db, Timeout: cfg.db.queryTimeout},
+		// The counts for the admin dashboard
+		stats: &mysql.StatsModel{DB: db, Timeout: cfg.db.queryTimeout},
+		// The passkeys, and the WebAuthn relying party
+		credentials: &mysql.CredentialModel{DB: db, Timeout: cfg.db.queryTimeout},
+		webAuthn:    webAuthn,
+		// Single sign-on
+		oidc: oidcProvider,
+		// The mailer
+		mailer: appMailer,
+		// The connection pool, for health checks
+		db: db,
+		// Background worker management
+		quit:    make(chan struct{}),
+		started: time.Now(),
 	}
 
-	// Initialize A tls.Config struct to hold the non-default TLS settings
-	// we want the server to use
-	tlsConfig := &tls.Config{
-		PreferServerCipherSuites: true,
-		CurvePreferences:         []tls.CurveID{tls.X25519, tls.CurveP256},
-	}
+	// Report errors loading and saving sessions like any other server error,
+	// and delete expired sessions from the store in the background.
+	sessionManager.ErrorFunc = app.serverError
+	app.background(func(quit <-chan struct{}) {
+		app.cleanupSessions(quit, cfg.session.cleanupInterval)
+	})
 
 	// Initialze a new http.Server struct. We will set the Addr and Handler fields so
 	// that the server uses the same network address and routes as before, and set
 	// the ErrorLog field so that the server now uses the custom errorLog Logger
 	// in the event of any problems
-	srv := &http.Server{
-		Addr:     *addr,
+	srv := &server{Server: &http.Server{
+		Addr:     cfg.addr,
 		ErrorLog: errorLog,
 		Handler:  app.routes(),
-		// Set the server's TLSConfig field to use the variable just created
-		TLSConfig: tlsConfig,
 		// Adding Idle, Read & Write timeouts to the server
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-	}
-
-	// Call the ListenAndServe() method on our new http.Server struct
-	infoLog.Printf("Starting server on %s", *addr)
-	// Using the ListenAndServeTLS() method to start the HTTPS server.
-	// We pass in the paths to the TLS certificate and corresponding
-	// private key as the two parameters
-	err = srv.ListenAndServeTLS("./tls/cert.pem", "./tls/key.pem")
-	errorLog.Fatal(err)
+		IdleTimeout:  cfg.timeouts.idle,
+		ReadTimeout:  cfg.timeouts.read,
+		WriteTimeout: cfg.timeouts.write,
+	}}
+
+	if cfg.tls.enabled {
+		// Load the TLS certificate and private key using a certManager,
+		// which reloads them when the files change on disk or when we receive
+		// a SIGHUP signal, so that certificates can be rotated without
+		// restarting the server.
+		certs, err := newCertManager(cfg.tls.certFile, cfg.tls.keyFile, cfg.tls.expiryWarning, logger)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		app.background(func(quit <-chan struct{}) {
+			certs.watch(quit, cfg.tls.reloadInterval, hup)
+		})
+
+		// Set the server's TLSConfig field to hold the non-default TLS
+		// settings we want the server to use, including the certManager
+		srv.TLSConfig = &tls.Config{
+			PreferServerCipherSuites: true,
+			CurvePreferences:         []tls.CurveID{tls.X25519, tls.CurveP256},
+			GetCertificate:           certs.GetCertificate,
+		}
+		// Using the ListenAndServeTLS() method to start the HTTPS server.
+		// The certificate comes from TLSConfig.GetCertificate, so we pass
+		// empty strings for the certificate and key file paths
+		srv.listen = func() error {
+			return srv.ListenAndServeTLS("", "")
+		}
+	} else {
+		// Otherwise serve plain HTTP, for example when running behind a
+		// TLS-terminating load balancer.
+		srv.listen = srv.ListenAndServe
+	}
+	servers := []*server{srv}
+
+	// If a redirect address was given, also start a plain HTTP server which
+	// redirects every request to the HTTPS server.
+	if cfg.redirectAddr != "" {
+		redirectSrv := &server{Server: &http.Server{
+			Addr:         cfg.redirectAddr,
+			ErrorLog:     errorLog,
+			Handler:      http.HandlerFunc(app.redirectToHTTPS),
+			IdleTimeout:  cfg.timeouts.idle,
+			ReadTimeout:  cfg.timeouts.read,
+			WriteTimeout: cfg.timeouts.write,
+		}}
+		redirectSrv.listen = redirectSrv.ListenAndServe
+		servers = append(servers, redirectSrv)
+		logger.Info("redirecting HTTP requests to HTTPS", slog.String("addr", cfg.redirectAddr))
+	}
+
+	// If a metrics address was given, serve the /metrics endpoint on a
+	// separate plain HTTP server, so that it can be kept off the public
+	// network.
+	if cfg.metricsAddr != "" {
+		metricsSrv := &server{Server: &http.Server{
+			Addr:         cfg.metricsAddr,
+			ErrorLog:     errorLog,
+			Handler:      appMetrics.handler(),
+			IdleTimeout:  cfg.timeouts.idle,
+			ReadTimeout:  cfg.timeouts.read,
+			WriteTimeout: cfg.timeouts.write,
+		}}
+		metricsSrv.listen = metricsSrv.ListenAndServe
+		servers = append(servers, metricsSrv)
+		logger.Info("serving metrics", slog.String("addr", cfg.metricsAddr))
+	}
+
+	// Create a context which is cancelled when we receive a SIGINT (Ctrl+c)
+	// or SIGTERM signal, so that we can shut down gracefully instead of
+	// cutting off any in-flight requests.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	logger.Info("starting server", slog.String("addr", cfg.addr), slog.String("env", cfg.env))
+	err = app.serve(ctx, servers...)
+
+	// Now that the server has stopped and no more requests can arrive, flush
+	// any remaining spans and close the connection pool. Then exit with a
+	// non-zero status code if anything went wrong.
+	flushCtx, cancel := context.WithTimeout(context.Background(), cfg.timeouts.shutdown)
+	if err := tp.Shutdown(flushCtx); err != nil {
+		logger.Error(err.Error())
+	}
+	cancel()
+	db.Close()
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	logger.Info("server stopped")
 }
 
 // The OpenDB() function wraps sql.Open() and returns a sql.DB connection pool
-// for a given DSN.
-func openDB(dsn string) (*sql.DB, error) {
-	db, err := sql.Open("mysql", dsn)
+// for the configured DSN, with the configured connection pool limits.
+func openDB(cfg *config) (*sql.DB, error) {
+	db, err := sql.Open("mysql", cfg.dsn)
 	if err != nil {
 		return nil, err
 	}
 
+	db.SetMaxOpenConns(cfg.db.maxOpenConns)
+	db.SetMaxIdleConns(cfg.db.maxIdleConns)
+	db.SetConnMaxLifetime(cfg.db.connMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.db.connMaxIdleTime)
+
 	if err = db.Ping(); err != nil {
 		return nil, err
 	}
 
 	return db, nil
 }
+
+// The newLDAPAuthenticator() function returns an authenticator which checks
+// passwords against the configured LDAP directory, creating local users in
+// the UserModel for them as they log in.
+func newLDAPAuthenticator(cfg *config, users *mysql.UserModel) (*ldapauth.Authenticator, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.ldap.caFile != "" {
+		pem, err := os.ReadFile(cfg.ldap.caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ldap-ca-file %s: no certificates found", cfg.ldap.caFile)
+		}
+	}
+
+	return &ldapauth.Authenticator{
+		URL:           cfg.ldap.url,
+		StartTLS:      cfg.ldap.startTLS,
+		TLSConfig:     tlsConfig,
+		BindDN:        cfg.ldap.bindDN,
+		BindPassword:  cfg.ldap.bindPassword,
+		BaseDN:        cfg.ldap.baseDN,
+		UserFilter:    cfg.ldap.userFilter,
+		NameAttribute: cfg.ldap.nameAttribute,
+		Timeout:       cfg.ldap.timeout,
+		Users:         users,
+	}, nil
+}
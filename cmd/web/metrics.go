@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bmizerany/pat"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Define a metrics struct to hold the Prometheus metrics for the application.
+// Each application has its own registry rather than using the global default
+// one, so that tests can create as many applications as they like.
+type metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	inFlight        prometheus.Gauge
+	renderDuration  *prometheus.HistogramVec
+	snippetsCreated prometheus.Counter
+	usersCreated    prometheus.Counter
+	loginFailures   prometheus.Counter
+	rateLimited     *prometheus.CounterVec
+}
+
+// The newMetrics() function creates and registers the application metrics,
+// along with the standard Go runtime and process metrics.
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "snippetbox_http_requests_total",
+			Help: "Total number of HTTP requests, by route pattern, method and status code.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "snippetbox_http_request_duration_seconds",
+			Help:    "HTTP request latency, by route pattern, method and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "snippetbox_http_requests_in_flight",
+			Help: "Number of HTTP requests currently being served.",
+		}),
+		renderDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "snippetbox_template_render_duration_seconds",
+			Help:    "Time taken to render each page template.",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25},
+		}, []string{"template"}),
+		snippetsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "snippetbox_snippets_created_total",
+			Help: "Total number of snippets created.",
+		}),
+		usersCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "snippetbox_users_created_total",
+			Help: "Total number of user accounts created.",
+		}),
+		loginFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "snippetbox_login_failures_total",
+			Help: "Total number of failed login attempts.",
+		}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "snippetbox_rate_limited_total",
+			Help: "Total number of requests rejected by rate limiting, by policy.",
+		}, []string{"policy"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.inFlight,
+		m.renderDuration,
+		m.snippetsCreated,
+		m.usersCreated,
+		m.loginFailures,
+		m.rateLimited,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// The registerDB() method adds gauges for the sql.DB connection pool
+// statistics (open, in use and idle connections, wait counts and so on).
+func (m *metrics) registerDB(db *sql.DB) {
+	m.registry.MustRegister(collectors.NewDBStatsCollector(db, "snippetbox"))
+}
+
+// The handler() method returns the http.Handler which serves the metrics in
+// the Prometheus text format, for the /metrics endpoint.
+func (m *metrics) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	return mux
+}
+
+// The instrument middleware records the number, latency and status of
+// requests. It must come after logRequest in the middleware chain, because it
+// reads the matched route pattern from the request's accessLogEntry.
+func (app *application) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		app.metrics.inFlight.Inc()
+		defer app.metrics.inFlight.Dec()
+
+		rw := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+
+		// Requests which didn't match any route are grouped together, so that
+		// a scan for random URLs can't create an unbounded number of series.
+		route := logEntry(r).route
+		if route == "" {
+			route = "unmatched"
+		}
+
+		labels := prometheus.Labels{
+			"route":  route,
+			"method": r.Method,
+			"status": strconv.Itoa(rw.status),
+		}
+		app.metrics.requests.With(labels).Inc()
+		app.metrics.requestDuration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
+
+// The router type wraps the pat router so that each handler records the
+// pattern of the route it was registered with. The pattern (like
+// "/snippet/:id") is used to label the metrics and access log, rather than
+// the URL path, which would create a separate series for every snippet.
+type router struct {
+	*pat.PatternServeMux
+}
+
+func (rt router) Get(pattern string, h http.Handler) {
+	rt.PatternServeMux.Get(pattern, withRoute(pattern, h))
+}
+
+func (rt router) Post(pattern string, h http.Handler) {
+	rt.PatternServeMux.Post(pattern, withRoute(pattern, h))
+}
+
+// The withRoute() function wraps a handler so that it records the route
+// pattern in the request's accessLogEntry.
+func withRoute(pattern string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logEntry(r).route = pattern
+		next.ServeHTTP(w, r)
+	})
+}
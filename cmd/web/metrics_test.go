@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Make some requests: a page render, a 404 for an unmatched path, and a
+	// failed login.
+	ts.get(t, "/snippet/1")
+	ts.get(t, "/snippet/2")
+	ts.get(t, "/no/such/page")
+
+	_, _, body := ts.get(t, "/user/login")
+	form := url.Values{}
+	form.Add("email", "nobody@example.com")
+	form.Add("password", "wrong")
+	form.Add("csrf_token", extractCSRFToken(t, body))
+	ts.postForm(t, "/user/login", form)
+
+	// Scrape the metrics endpoint.
+	metricsServer := newTestServer(t, app.metrics.handler())
+	defer metricsServer.Close()
+
+	code, _, metrics := metricsServer.get(t, "/metrics")
+	if code != 200 {
+		t.Fatalf("want %d; got %d", 200, code)
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Request count", `snippetbox_http_requests_total{method="GET",route="/snippet/:id",status="200"} 1`},
+		{"Not found count", `snippetbox_http_requests_total{method="GET",route="/snippet/:id",status="404"} 1`},
+		{"Unmatched count", `snippetbox_http_requests_total{method="GET",route="unmatched",status="404"} 1`},
+		{"Latency histogram", `snippetbox_http_request_duration_seconds_count{method="POST",route="/user/login",status="200"} 1`},
+		{"In flight", `snippetbox_http_requests_in_flight 0`},
+		{"Template render", `snippetbox_template_render_duration_seconds_count{template="show.page.tmpl"} 1`},
+		{"Login failures", `snippetbox_login_failures_total 1`},
+		{"Snippets created", `snippetbox_snippets_created_total 0`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !strings.Contains(string(metrics), tt.want) {
+				t.Errorf("want metrics to contain %q", tt.want)
+			}
+		})
+	}
+}
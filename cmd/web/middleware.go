@@ -3,14 +3,50 @@ package main
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	"chilliweb.com/snippetbox/pkg/models"
 	"github.com/justinas/nosurf" // CSRF management
 )
 
-func secureHeaders(next http.Handler) http.Handler {
+// The secureHeaders middleware sets the security headers on every response.
+// It generates a fresh nonce for each request, which is substituted into the
+// Content-Security-Policy and made available to the templates (via
+// templateData.CSPNonce) so that our own <script> and <style> tags are allowed
+// to run while anything injected into the page isn't.
+func (app *application) secureHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce := newNonce()
+		r = r.WithContext(context.WithValue(r.Context(), contextKeyCSPNonce, nonce))
+
+		h := app.config.headers
+
+		if h.csp != "" {
+			name := "Content-Security-Policy"
+			if h.cspReportOnly {
+				name = "Content-Security-Policy-Report-Only"
+			}
+			w.Header().Set(name, strings.ReplaceAll(h.csp, "{nonce}", nonce))
+		}
+		if h.referrerPolicy != "" {
+			w.Header().Set("Referrer-Policy", h.referrerPolicy)
+		}
+		if h.permissionsPolicy != "" {
+			w.Header().Set("Permissions-Policy", h.permissionsPolicy)
+		}
+
+		// Browsers ignore Strict-Transport-Security over plain HTTP, and
+		// sending it to a client which connected over HTTP to a proxy would
+		// be misleading, so we only send it on HTTPS responses.
+		if h.hstsMaxAge > 0 && isHTTPS(r) {
+			w.Header().Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d; includeSubDomains", int(h.hstsMaxAge.Seconds())))
+		}
+
+		w.Header().Set("X-Content-Type-Options", "nosniff")
 		w.Header().Set("X-XSS-Protection", "1; mode=block")
 		w.Header().Set("X-Frame-Options", "deny")
 
@@ -20,14 +56,109 @@ func secureHeaders(next http.Handler) http.Handler {
 	})
 }
 
-func (app *application) logRequest(next http.Handler) http.Handler {
+// The trustProxy middleware handles requests which have come through one of
+// our trusted reverse proxies. For these requests we replace r.RemoteAddr with
+// the real client IP address from the X-Forwarded-For header, and record
+// whether the client connected to the proxy over HTTPS from the
+// X-Forwarded-Proto header. The headers are ignored for any other request,
+// because anyone can set them.
+func (app *application) trustProxy(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		app.infoLog.Printf("%s - %s %s %s", r.RemoteAddr, r.Proto, r.Method, r.URL.RequestURI())
+		ip := remoteIP(r)
+		if ip == nil || !app.config.trustedProxies.contains(ip) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Each proxy appends the address it received the request from to the
+		// X-Forwarded-For header, so we walk the list from right to left and
+		// stop at the first address which isn't one of our proxies. Anything
+		// to the left of that could have been made up by the client.
+		var forwarded []string
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			forwarded = append(forwarded, strings.Split(v, ",")...)
+		}
+		for i := len(forwarded) - 1; i >= 0; i-- {
+			addr := net.ParseIP(strings.TrimSpace(forwarded[i]))
+			if addr == nil {
+				break
+			}
+			r.RemoteAddr = addr.String()
+			if !app.config.trustedProxies.contains(addr) {
+				break
+			}
+		}
+
+		switch strings.ToLower(r.Header.Get("X-Forwarded-Proto")) {
+		case "https":
+			r = r.WithContext(context.WithValue(r.Context(), contextKeyForwardedHTTPS, true))
+		case "http":
+			r = r.WithContext(context.WithValue(r.Context(), contextKeyForwardedHTTPS, false))
+		}
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+// The requestID middleware makes sure every request has an ID, which is
+// included in every log line written for the request and sent back to the
+// client in the X-Request-ID header. If the request already has a (sensible
+// looking) X-Request-ID header, for example because a load balancer in front
+// of us set one, we keep using it so requests can be traced across services.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDRX.MatchString(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		ctx := context.WithValue(r.Context(), contextKeyRequestID, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// The logRequest middleware writes an access log entry once the response has
+// been sent, so that we can include the status code, response size, duration
+// and (if they're logged in) the user's ID.
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		r, entry := withLogEntry(r)
+		rw := &responseRecorder{ResponseWriter: w}
+
+		// Log the request even if a later middleware or handler panics, in
+		// which case recoverPanic has already sent a 500 response.
+		defer func() {
+			if rw.status == 0 {
+				rw.status = http.StatusOK
+			}
+
+			attrs := []any{
+				slog.String("remote_addr", r.RemoteAddr),
+				slog.String("proto", r.Proto),
+				slog.String("method", r.Method),
+				slog.String("uri", redactedURI(r.URL)),
+				slog.Int("status", rw.status),
+				slog.Int("bytes", rw.bytes),
+				slog.Duration("duration", time.Since(start)),
+			}
+			if entry.route != "" {
+				attrs = append(attrs, slog.String("route", entry.route))
+			}
+			if entry.userID != 0 {
+				attrs = append(attrs, slog.Int("user_id", entry.userID))
+			}
+
+			app.logger.InfoContext(r.Context(), "request", attrs...)
+		}()
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Create a deferred function
@@ -40,7 +171,7 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 				w.Header().Set("Connection", "close")
 				// Call the app.ServerError helper method to return a
 				// 500 Internal Server Error response
-				app.serverError(w, fmt.Errorf("%s", err))
+				app.serverError(w, r, fmt.Errorf("%s", err))
 			}
 		}()
 
@@ -63,14 +194,50 @@ func (app *application) requireAuthenticatedUser(next http.Handler) http.Handler
 	})
 }
 
+// The requireVerifiedUser middleware stops users who haven't verified their
+// email address from going any further, if the configuration requires it,
+// and sends them to the page where they can ask for a new verification link.
+// It must come after requireAuthenticatedUser.
+func (app *application) requireVerifiedUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.config.requireVerifiedEmail && !app.authenticatedUser(r).EmailVerified {
+			app.session.Put(r, "flash", "Please verify your email address first")
+			http.Redirect(w, r, "/user/verify/resend", http.StatusSeeOther)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The requireRole() function returns middleware which only lets users with
+// the given role (or a more privileged one) through, and sends everyone else
+// a 403 Forbidden response. Like requireVerifiedUser, it must come after
+// requireAuthenticatedUser, as in
+//
+//	dynamicMiddleware.Append(app.requireAuthenticatedUser, app.requireRole(models.RoleAdmin))
+func (app *application) requireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !app.authenticatedUser(r).HasRole(role) {
+				app.clientError(w, http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 // Create a NoSurf middleware function which uses a customized CSRF cookie with
-// the Secure, OPath and HttpOnly flags set.
-func noSurf(next http.Handler) http.Handler {
+// the Path and HttpOnly flags set, and the Secure flag set unless secure
+// cookies have been turned off in the configuration.
+func (app *application) noSurf(next http.Handler) http.Handler {
 	csrfHandler := nosurf.New(next)
 	csrfHandler.SetBaseCookie(http.Cookie{
 		HttpOnly: true,
 		Path:     "/",
-		Secure:   true,
+		Secure:   app.config.secureCookies,
 	})
 
 	return csrfHandler
@@ -79,25 +246,64 @@ func noSurf(next http.Handler) http.Handler {
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Check if a userID exists in the session. If this *isn't present*
-		// then call the next handler in the chain
+		// then try to log the user back in with their "remember me" token,
+		// and otherwise call the next handler in the chain
 		exists := app.session.Exists(r, "userID")
 		if !exists {
-			next.ServeHTTP(w, r)
+			user, err := app.logInRemembered(w, r)
+			if err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+			if user == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			logEntry(r).userID = user.ID
+			ctx := context.WithValue(r.Context(), contextKeyUser, user)
+			next.ServeHTTP(w, r.WithContext(ctx))
 			return
 		}
 
 		// Fetch the details of the current user from the database.
 		// If no matching record is found, remove the (invalid) userID from
 		// their session and call the next handler in the chain as normal.
-		user, err := app.users.Get(app.session.GetInt(r, "userID"))
+		user, err := app.users.Get(r.Context(), app.session.GetInt(r, "userID"))
+		if err == models.ErrNoRecord {
+			app.session.Remove(r, "userID")
+			return
+		} else if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		// If the user's password has been reset since they logged in with
+		// this session, or their account has been deactivated, the session
+		// is no longer valid, so we log it out.
+		if app.session.GetInt(r, "sessionVersion") != user.SessionVersion || !user.Active {
+			app.session.Remove(r, "userID")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The session must also still be in the session registry. If the
+		// user has revoked it from another device (or it was created before
+		// the registry existed) we log it out in the same way.
+		err = app.sessionRegistry.Touch(r.Context(), user.ID, app.session.GetString(r, "sessionID"), clientIP(r))
 		if err == models.ErrNoRecord {
 			app.session.Remove(r, "userID")
+			app.session.Remove(r, "sessionID")
+			next.ServeHTTP(w, r)
 			return
 		} else if err != nil {
-			app.serverError(w, err)
+			app.serverError(w, r, err)
 			return
 		}
 
+		// Record the user's ID for the access log.
+		logEntry(r).userID = user.ID
+
 		// Otherwise, we know that the request is coming from a valid,
 		// authenticated (logged in) user. We create a new copy of the
 		// request with teh user information added to the request context,
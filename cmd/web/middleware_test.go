@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+
+	"github.com/justinas/alice"
 )
 
 func TestSecureHeaders(t *testing.T) {
@@ -13,6 +21,8 @@ func TestSecureHeaders(t *testing.T) {
 	// *other tests marked in the same way*
 	t.Parallel()
 
+	app := newTestApplication(t)
+
 	// Initialze a new httptest.ResponseRecorder and dummy http.Request.
 	rr := httptest.NewRecorder()
 
@@ -31,7 +41,7 @@ func TestSecureHeaders(t *testing.T) {
 	// secureHeaders *returns* a http.Handler we can call its ServerHTTP()
 	// method, passing in the http.ResponseRecorder and dummy http.Request to
 	// execute it.
-	secureHeaders(next).ServeHTTP(rr, r)
+	app.secureHeaders(next).ServeHTTP(rr, r)
 
 	// Call the Result() method on the http.ResponseRecorder to get the results
 	// of the test
@@ -51,6 +61,17 @@ func TestSecureHeaders(t *testing.T) {
 		t.Errorf("want %q; got %q", "1; mode=block", xssProtection)
 	}
 
+	// Check the other headers which are always sent.
+	for name, want := range map[string]string{
+		"X-Content-Type-Options": "nosniff",
+		"Referrer-Policy":        app.config.headers.referrerPolicy,
+		"Permissions-Policy":     app.config.headers.permissionsPolicy,
+	} {
+		if got := rs.Header.Get(name); got != want {
+			t.Errorf("want %s %q; got %q", name, want, got)
+		}
+	}
+
 	// Check that he middleware has correctly called the next handler in line
 	// and the response status code and body are as expected
 	if rs.StatusCode != http.StatusOK {
@@ -67,3 +88,265 @@ func TestSecureHeaders(t *testing.T) {
 		t.Errorf("want body to equal %q", "OK")
 	}
 }
+
+func TestSecureHeadersCSP(t *testing.T) {
+	tests := []struct {
+		name       string
+		reportOnly bool
+		https      bool
+		wantHeader string
+		wantHSTS   bool
+	}{
+		{"Enforced", false, false, "Content-Security-Policy", false},
+		{"Report only", true, false, "Content-Security-Policy-Report-Only", false},
+		{"HTTPS", false, true, "Content-Security-Policy", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.headers.cspReportOnly = tt.reportOnly
+
+			var nonces []string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nonces = append(nonces, cspNonce(r))
+			})
+
+			var policies []string
+			for i := 0; i < 2; i++ {
+				rr := httptest.NewRecorder()
+				r := httptest.NewRequest("GET", "/", nil)
+				if tt.https {
+					r.TLS = &tls.ConnectionState{}
+				}
+
+				app.secureHeaders(next).ServeHTTP(rr, r)
+
+				policies = append(policies, rr.Header().Get(tt.wantHeader))
+
+				if hsts := rr.Header().Get("Strict-Transport-Security"); (hsts != "") != tt.wantHSTS {
+					t.Errorf("want HSTS %t; got %q", tt.wantHSTS, hsts)
+				}
+			}
+
+			if nonces[0] == "" || nonces[0] == nonces[1] {
+				t.Errorf("want a different nonce for each request; got %q", nonces)
+			}
+
+			for i, policy := range policies {
+				want := "'nonce-" + nonces[i] + "'"
+				if !strings.Contains(policy, want) {
+					t.Errorf("want %s to contain %q; got %q", tt.wantHeader, want, policy)
+				}
+			}
+		})
+	}
+}
+
+func TestTrustProxy(t *testing.T) {
+	app := newTestApplication(t)
+	err := app.config.trustedProxies.Set("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		proto      string
+		wantAddr   string
+		wantHTTPS  bool
+	}{
+		{"Untrusted peer", "203.0.113.9:1234", "198.51.100.1", "https", "203.0.113.9:1234", false},
+		{"Trusted peer", "10.1.2.3:1234", "198.51.100.1", "https", "198.51.100.1", true},
+		{"Trusted single IP", "192.168.1.1:1234", "198.51.100.1", "http", "198.51.100.1", false},
+		{"Spoofed left-most entry", "10.1.2.3:1234", "1.2.3.4, 198.51.100.1, 10.9.9.9", "", "198.51.100.1", false},
+		{"No header", "10.1.2.3:1234", "", "", "10.1.2.3:1234", false},
+		{"Invalid entry", "10.1.2.3:1234", "nonsense", "", "10.1.2.3:1234", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest("GET", "/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+
+			var gotAddr string
+			var gotHTTPS bool
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotAddr = r.RemoteAddr
+				gotHTTPS = isHTTPS(r)
+			})
+
+			app.trustProxy(next).ServeHTTP(httptest.NewRecorder(), r)
+
+			if gotAddr != tt.wantAddr {
+				t.Errorf("want %q; got %q", tt.wantAddr, gotAddr)
+			}
+
+			if gotHTTPS != tt.wantHTTPS {
+				t.Errorf("want HTTPS %t; got %t", tt.wantHTTPS, gotHTTPS)
+			}
+		})
+	}
+}
+
+func TestNoSurfSecureCookie(t *testing.T) {
+	for _, secure := range []bool{true, false} {
+		app := newTestApplication(t)
+		app.config.secureCookies = secure
+
+		rr := httptest.NewRecorder()
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("OK"))
+		})
+		app.noSurf(next).ServeHTTP(rr, r)
+
+		cookies := rr.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("want 1 cookie; got %d", len(cookies))
+		}
+
+		if cookies[0].Secure != secure {
+			t.Errorf("want Secure %t; got %t", secure, cookies[0].Secure)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string
+		wantKept bool
+	}{
+		{"No header", "", false},
+		{"Valid header", "lb-1234:abcd", true},
+		{"Invalid header", "bad id\nINFO forged", false},
+		{"Overlong header", strings.Repeat("a", 129), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r, err := http.NewRequest("GET", "/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.incoming != "" {
+				r.Header.Set("X-Request-ID", tt.incoming)
+			}
+
+			var ctxID string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ctxID, _ = r.Context().Value(contextKeyRequestID).(string)
+			})
+
+			requestID(next).ServeHTTP(rr, r)
+
+			headerID := rr.Header().Get("X-Request-ID")
+			if headerID == "" || headerID != ctxID {
+				t.Errorf("want matching non-empty IDs; got header %q and context %q", headerID, ctxID)
+			}
+
+			if kept := headerID == tt.incoming; kept != tt.wantKept {
+				t.Errorf("want incoming ID kept %t; got ID %q", tt.wantKept, headerID)
+			}
+		})
+	}
+}
+
+func TestLogRequest(t *testing.T) {
+	app := newTestApplication(t)
+	buf := new(bytes.Buffer)
+	app.logger = slog.New(contextHandler{slog.NewJSONHandler(buf, nil)})
+
+	// Create a handler which records a user ID for the access log, in the
+	// same way as the authenticate middleware, and then panics.
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logEntry(r).userID = 7
+		panic("oops")
+	})
+
+	rr := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "/snippet/1?x=y", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("X-Request-ID", "req-1")
+
+	alice.New(requestID, app.logRequest, app.recoverPanic).Then(next).ServeHTTP(rr, r)
+
+	// We expect two log entries: the error from serverError, and then the
+	// access log entry. Both should include the request ID.
+	dec := json.NewDecoder(buf)
+	var errorEntry, accessEntry map[string]interface{}
+	if err := dec.Decode(&errorEntry); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(&accessEntry); err != nil {
+		t.Fatal(err)
+	}
+
+	if errorEntry["level"] != "ERROR" || errorEntry["msg"] != "oops" || errorEntry["request_id"] != "req-1" {
+		t.Errorf("unexpected error entry %v", errorEntry)
+	}
+
+	if trace, _ := errorEntry["trace"].(string); !strings.Contains(trace, "goroutine") {
+		t.Errorf("want stack trace in error entry; got %q", trace)
+	}
+
+	want := map[string]interface{}{
+		"msg":        "request",
+		"method":     "GET",
+		"uri":        "/snippet/1?x=y",
+		"status":     float64(http.StatusInternalServerError),
+		"bytes":      float64(len(http.StatusText(http.StatusInternalServerError)) + 1),
+		"user_id":    float64(7),
+		"request_id": "req-1",
+	}
+	for k, v := range want {
+		if accessEntry[k] != v {
+			t.Errorf("want access log %s %v; got %v", k, v, accessEntry[k])
+		}
+	}
+
+	if _, ok := accessEntry["duration"]; !ok {
+		t.Error("want duration in access log")
+	}
+}
+
+func TestRedactedURI(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"/snippet/1?x=y", "/snippet/1?x=y"},
+		{"/user/password/reset?token=secret", "/user/password/reset?token=REDACTED"},
+		{"/user/password/reset?a=1&token=secret", "/user/password/reset?a=1&token=REDACTED"},
+	}
+
+	for _, tt := range tests {
+		u, err := url.Parse(tt.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := redactedURI(u); got != tt.want {
+			t.Errorf("want %q; got %q", tt.want, got)
+		}
+	}
+}
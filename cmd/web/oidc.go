@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"chilliweb.com/snippetbox/pkg/models"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// The oidcProvider type holds everything we need to log users in with an
+// OpenID Connect provider.
+type oidcProvider struct {
+	name          string
+	autoProvision bool
+	oauth2        oauth2.Config
+	// The verifier checks the signature of ID tokens against the provider's
+	// published keys (which it fetches and caches), along with their issuer,
+	// audience and expiry.
+	verifier *oidc.IDTokenVerifier
+	// The HTTP client for talking to the provider.
+	client *http.Client
+}
+
+// The newOIDCProvider() function fetches the discovery document of the
+// configured OpenID Connect provider and returns an oidcProvider for it, or
+// nil if single sign-on isn't configured.
+func newOIDCProvider(ctx context.Context, cfg *config, client *http.Client) (*oidcProvider, error) {
+	if cfg.oidc.issuer == "" {
+		return nil, nil
+	}
+
+	provider, err := oidc.NewProvider(oidc.ClientContext(ctx, client), cfg.oidc.issuer)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: %w", err)
+	}
+
+	return &oidcProvider{
+		name:          cfg.oidc.name,
+		autoProvision: cfg.oidc.autoProvision,
+		oauth2: oauth2.Config{
+			ClientID:     cfg.oidc.clientID,
+			ClientSecret: cfg.oidc.clientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  strings.TrimSuffix(cfg.baseURL, "/") + "/user/oidc/callback",
+			Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.oidc.clientID}),
+		client:   client,
+	}, nil
+}
+
+// The errOIDCLogin error is returned by oidcIdentity() when the provider
+// didn't give us a valid ID token for the login we started.
+var errOIDCLogin = errors.New("oidc: login failed")
+
+// The oidcLogin handler starts logging in with the OpenID Connect provider,
+// by redirecting the user to its authorization endpoint. The state, nonce
+// and PKCE verifier are kept in the session, so that the callback can check
+// that the response is for a login this browser started.
+func (app *application) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.notFound(w)
+		return
+	}
+
+	state, nonce, verifier := newNonce(), newNonce(), oauth2.GenerateVerifier()
+	app.session.Put(r, "oidcState", state)
+	app.session.Put(r, "oidcNonce", nonce)
+	app.session.Put(r, "oidcVerifier", verifier)
+
+	url := app.oidc.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// The oidcCallback handler is where the provider sends the user back to
+// with an authorization code. We exchange the code for an ID token, and log
+// in the user it identifies the same way as a password login, so users with
+// two-factor authentication are still asked for a code and deactivated users
+// are turned away.
+func (app *application) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.notFound(w)
+		return
+	}
+
+	identity, err := app.oidcIdentity(r)
+	if err != nil {
+		app.metrics.loginFailures.Inc()
+		app.logger.InfoContext(r.Context(), "oidc login failed", slog.String("error", err.Error()))
+		app.session.Put(r, "flash", fmt.Sprintf("Logging in with %s failed. Please try again.", app.oidc.name))
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	id, err := app.users.AuthenticateIdentity(r.Context(), identity, app.oidc.autoProvision)
+	if err == models.ErrDuplicateEmail {
+		app.metrics.loginFailures.Inc()
+		app.session.Put(r, "flash", fmt.Sprintf("There is already an account for %s. Please log in with your password.", identity.Email))
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	} else if err == models.ErrNoRecord {
+		app.metrics.loginFailures.Inc()
+		app.session.Put(r, "flash", fmt.Sprintf("There is no account for %s. Please sign up first.", identity.Email))
+		http.Redirect(w, r, "/user/signup", http.StatusSeeOther)
+		return
+	} else if err == models.ErrUnverifiedEmail {
+		app.metrics.loginFailures.Inc()
+		app.session.Put(r, "flash", fmt.Sprintf("%s hasn't verified %s, so we can't create an account for it. Please sign up instead.", app.oidc.name, identity.Email))
+		http.Redirect(w, r, "/user/signup", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.completeLogin(w, r, id, "", false)
+}
+
+// The oidcIdentity() helper checks the provider's response to the login
+// started by oidcLogin, exchanges the authorization code for an ID token
+// and returns the identity in it.
+func (app *application) oidcIdentity(r *http.Request) (*models.Identity, error) {
+	// Each login can only be completed once, so take the state, nonce and
+	// verifier out of the session whatever happens.
+	state := app.session.PopString(r, "oidcState")
+	nonce := app.session.PopString(r, "oidcNonce")
+	verifier := app.session.PopString(r, "oidcVerifier")
+
+	q := r.URL.Query()
+	if state == "" || subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(state)) != 1 {
+		return nil, fmt.Errorf("%w: state mismatch", errOIDCLogin)
+	}
+	if e := q.Get("error"); e != "" {
+		return nil, fmt.Errorf("%w: provider returned %s", errOIDCLogin, e)
+	}
+
+	ctx := oidc.ClientContext(r.Context(), app.oidc.client)
+	token, err := app.oidc.oauth2.Exchange(ctx, q.Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errOIDCLogin, err)
+	}
+
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: no id_token in token response", errOIDCLogin)
+	}
+
+	idToken, err := app.oidc.verifier.Verify(ctx, raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errOIDCLogin, err)
+	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("%w: nonce mismatch", errOIDCLogin)
+	}
+
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Name          string `json:"name"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("%w: %w", errOIDCLogin, err)
+	}
+	if claims.Email == "" {
+		return nil, fmt.Errorf("%w: no email claim", errOIDCLogin)
+	}
+	if claims.Name == "" {
+		claims.Name = claims.Email
+	}
+
+	return &models.Identity{
+		Issuer:        idToken.Issuer,
+		Subject:       idToken.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Name:          claims.Name,
+	}, nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The fakeOIDCProvider type is an in-process OpenID Connect provider for
+// tests. It serves the discovery document, its signing key and the
+// authorization and token endpoints, checking the PKCE verifier like a real
+// provider would. The ID tokens it issues contain the claims in claims,
+// which tests can change (or use to override the standard ones), and are
+// signed with signWith instead of the published key if it is set.
+type fakeOIDCProvider struct {
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	signWith *rsa.PrivateKey
+	clientID string
+	claims   map[string]interface{}
+
+	mu    sync.Mutex
+	codes map[string]fakeOIDCCode
+}
+
+// The fakeOIDCCode type is what the provider remembers about an
+// authorization code until it is exchanged.
+type fakeOIDCCode struct {
+	nonce       string
+	challenge   string
+	redirectURI string
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &fakeOIDCProvider{
+		key:      key,
+		clientID: "snippetbox",
+		claims:   map[string]interface{}{},
+		codes:    map[string]fakeOIDCCode{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+
+	return p
+}
+
+func (p *fakeOIDCProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                p.server.URL,
+		"authorization_endpoint":                p.server.URL + "/authorize",
+		"token_endpoint":                        p.server.URL + "/token",
+		"jwks_uri":                              p.server.URL + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (p *fakeOIDCProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+// The authorize() handler logs the user straight in, redirecting back to
+// the client with a new authorization code.
+func (p *fakeOIDCProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != p.clientID || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	code := newNonce()
+	p.mu.Lock()
+	p.codes[code] = fakeOIDCCode{nonce: q.Get("nonce"), challenge: q.Get("code_challenge"), redirectURI: q.Get("redirect_uri")}
+	p.mu.Unlock()
+
+	v := url.Values{"code": {code}, "state": {q.Get("state")}}
+	http.Redirect(w, r, q.Get("redirect_uri")+"?"+v.Encode(), http.StatusFound)
+}
+
+func (p *fakeOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	p.mu.Lock()
+	c, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || c.redirectURI != r.PostForm.Get("redirect_uri") || base64.RawURLEncoding.EncodeToString(verifier[:]) != c.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	claims := map[string]interface{}{
+		"iss":   p.server.URL,
+		"sub":   "user-1",
+		"aud":   p.clientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": c.nonce,
+	}
+	for k, v := range p.claims {
+		claims[k] = v
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": newNonce(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     p.sign(claims),
+	})
+}
+
+// The sign() method returns a JWT with the given claims, signed with RS256.
+func (p *fakeOIDCProvider) sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+	key := p.key
+	if p.signWith != nil {
+		key = p.signWith
+	}
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// The newOIDCTestServer() helper returns a test server for an application
+// which uses the fake provider for single sign-on.
+func newOIDCTestServer(t *testing.T, p *fakeOIDCProvider, autoProvision bool) *testServer {
+	app := newTestApplication(t)
+	app.config.oidc.issuer = p.server.URL
+	app.config.oidc.clientID = p.clientID
+	app.config.oidc.clientSecret = "secret"
+	app.config.oidc.name = "Example"
+	app.config.oidc.autoProvision = autoProvision
+
+	var err error
+	app.oidc, err = newOIDCProvider(context.Background(), app.config, p.server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newTestServer(t, app.routes())
+}
+
+// The oidcLogin() method goes through the login flow with the fake
+// provider, passing the provider's response through edit (if it isn't nil)
+// on its way back to the callback. It returns the callback's response.
+func (ts *testServer) oidcLogin(t *testing.T, edit func(url.Values)) (int, http.Header) {
+	code, header, _ := ts.get(t, "/user/oidc/login")
+	if code != http.StatusFound {
+		t.Fatalf("login: want %d; got %d", http.StatusFound, code)
+	}
+
+	// Follow the redirect to the provider, which redirects straight back.
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	rs, err := client.Get(header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Body.Close()
+	if rs.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: want %d; got %d", http.StatusFound, rs.StatusCode)
+	}
+
+	callback, err := url.Parse(rs.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if callback.Path != "/user/oidc/callback" {
+		t.Fatalf("want redirect to /user/oidc/callback; got %q", callback.Path)
+	}
+
+	q := callback.Query()
+	if edit != nil {
+		edit(q)
+	}
+
+	code, header, _ = ts.get(t, "/user/oidc/callback?"+q.Encode())
+	return code, header
+}
+
+func TestOIDCLogin(t *testing.T) {
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		claims        map[string]interface{}
+		autoProvision bool
+		edit          func(url.Values)
+		signWith      *rsa.PrivateKey
+		wantLocation  string
+		wantLoggedIn  bool
+	}{
+		{"Linked by verified email", map[string]interface{}{"email": "alice@example.com", "email_verified": true}, true, nil, nil, "/snippet/create", true},
+		{"Two-factor user", map[string]interface{}{"email": "totp@example.com", "email_verified": true}, true, nil, nil, "/user/login/2fa", false},
+		{"Deactivated user", map[string]interface{}{"email": "deactivated@example.com", "email_verified": true}, true, nil, nil, "/user/login", false},
+		{"Unverified email", map[string]interface{}{"email": "alice@example.com"}, true, nil, nil, "/user/login", false},
+		{"Provisioned", map[string]interface{}{"email": "new@example.com", "email_verified": true, "name": "New"}, true, nil, nil, "/snippet/create", true},
+		{"Provisioning unverified email", map[string]interface{}{"email": "new@example.com"}, true, nil, nil, "/user/signup", false},
+		{"Provisioning off", map[string]interface{}{"email": "new@example.com", "email_verified": true}, false, nil, nil, "/user/signup", false},
+		{"No email", map[string]interface{}{}, true, nil, nil, "/user/login", false},
+		{"Wrong nonce", map[string]interface{}{"email": "alice@example.com", "email_verified": true, "nonce": "abc"}, true, nil, nil, "/user/login", false},
+		{"Wrong audience", map[string]interface{}{"email": "alice@example.com", "email_verified": true, "aud": "other"}, true, nil, nil, "/user/login", false},
+		{"Expired", map[string]interface{}{"email": "alice@example.com", "email_verified": true, "exp": time.Now().Add(-time.Hour).Unix()}, true, nil, nil, "/user/login", false},
+		{"Wrong key", map[string]interface{}{"email": "alice@example.com", "email_verified": true}, true, nil, other, "/user/login", false},
+		{"Wrong state", map[string]interface{}{"email": "alice@example.com", "email_verified": true}, true, func(q url.Values) { q.Set("state", "abc") }, nil, "/user/login", false},
+		{"Provider error", map[string]interface{}{"email": "alice@example.com", "email_verified": true}, true, func(q url.Values) { q.Del("code"); q.Set("error", "access_denied") }, nil, "/user/login", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newFakeOIDCProvider(t)
+			p.claims = tt.claims
+			p.signWith = tt.signWith
+			ts := newOIDCTestServer(t, p, tt.autoProvision)
+			defer ts.Close()
+
+			code, header := ts.oidcLogin(t, tt.edit)
+			if code != http.StatusSeeOther {
+				t.Errorf("want %d; got %d", http.StatusSeeOther, code)
+			}
+			if loc := header.Get("Location"); loc != tt.wantLocation {
+				t.Errorf("want location %q; got %q", tt.wantLocation, loc)
+			}
+
+			code, _, _ = ts.get(t, "/account")
+			if loggedIn := code == http.StatusOK; loggedIn != tt.wantLoggedIn {
+				t.Errorf("want logged in %v; got %v", tt.wantLoggedIn, loggedIn)
+			}
+		})
+	}
+}
+
+func TestOIDCUnverifiedEmail(t *testing.T) {
+	p := newFakeOIDCProvider(t)
+	p.claims = map[string]interface{}{"email": "new@example.com"}
+	ts := newOIDCTestServer(t, p, true)
+	defer ts.Close()
+
+	ts.oidcLogin(t, nil)
+
+	_, _, body := ts.get(t, "/user/signup")
+	want := "Example hasn&#39;t verified new@example.com"
+	if !strings.Contains(string(body), want) {
+		t.Errorf("want body to contain %q", want)
+	}
+}
+
+func TestOIDCNotConfigured(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	for _, path := range []string{"/user/oidc/login", "/user/oidc/callback"} {
+		code, _, _ := ts.get(t, path)
+		if code != http.StatusNotFound {
+			t.Errorf("%s: want %d; got %d", path, http.StatusNotFound, code)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"chilliweb.com/snippetbox/pkg/models"
+)
+
+// The rateLimit type describes a token bucket: a client may make up to burst
+// requests in quick succession, after which they get one more request every
+// interval.
+type rateLimit struct {
+	burst    int
+	interval time.Duration
+}
+
+// The rateLimitStore interface is implemented by anything which can keep
+// track of token buckets. The in-memory store below is fine for a single
+// instance; running several instances behind a load balancer needs a shared
+// store (like Redis) so that the limits apply across all of them.
+type rateLimitStore interface {
+	// Take removes a token from the bucket with the given key, creating a
+	// full bucket if there isn't one. If the bucket is empty it returns false
+	// and how long until the next token is available.
+	Take(ctx context.Context, key string, limit rateLimit) (bool, time.Duration, error)
+}
+
+// The rateLimitRule type is one of the limits in a rate limiting policy. The
+// key function returns the part of the request the limit applies to, like
+// the client IP address, or the empty string if the rule doesn't apply to
+// the request (for example, a per-user limit for an anonymous request).
+type rateLimitRule struct {
+	kind  string
+	key   func(r *http.Request) string
+	limit rateLimit
+}
+
+// The perIP() function returns a rule allowing n requests per period from
+// each client IP address.
+func perIP(n int, period time.Duration) rateLimitRule {
+	return rateLimitRule{
+		kind:  "ip",
+		key:   clientIP,
+		limit: newRateLimit(n, period),
+	}
+}
+
+// The perUser() function returns a rule allowing n requests per period from
+// each authenticated user. It must come after the authenticate middleware.
+func perUser(n int, period time.Duration) rateLimitRule {
+	return rateLimitRule{
+		kind: "user",
+		key: func(r *http.Request) string {
+			user, ok := r.Context().Value(contextKeyUser).(*models.User)
+			if !ok {
+				return ""
+			}
+			return strconv.Itoa(user.ID)
+		},
+		limit: newRateLimit(n, period),
+	}
+}
+
+// The perEmail() function returns a rule allowing n requests per period for
+// each email address submitted in the "email" form field. This limits
+// password guessing against a single account from many IP addresses.
+func perEmail(n int, period time.Duration) rateLimitRule {
+	return rateLimitRule{
+		kind: "email",
+		key: func(r *http.Request) string {
+			if err := r.ParseForm(); err != nil {
+				return ""
+			}
+			return strings.ToLower(strings.TrimSpace(r.PostForm.Get("email")))
+		},
+		limit: newRateLimit(n, period),
+	}
+}
+
+// The perTwoFactorUser() method returns a rule allowing n requests per period
+// for each login waiting for a two-factor authentication code. Without it,
+// an attacker who knows a user's password could spread their guesses at the
+// code across many IP addresses.
+func (app *application) perTwoFactorUser(n int, period time.Duration) rateLimitRule {
+	return rateLimitRule{
+		kind: "2fa-user",
+		key: func(r *http.Request) string {
+			id := app.twoFactorUserID(r)
+			if id == 0 {
+				return ""
+			}
+			return strconv.Itoa(id)
+		},
+		limit: newRateLimit(n, period),
+	}
+}
+
+func newRateLimit(n int, period time.Duration) rateLimit {
+	return rateLimit{burst: n, interval: period / time.Duration(n)}
+}
+
+// The rateLimit() method returns middleware which applies the rules of the
+// named policy to each request, responding with 429 Too Many Requests and a
+// Retry-After header once any of them is exceeded. The name is included in
+// the bucket keys, so the same client has separate buckets for each policy.
+//
+// If the store fails we let the request through rather than taking the site
+// down with it.
+func (app *application) rateLimit(name string, rules ...rateLimitRule) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, rule := range rules {
+				key := rule.key(r)
+				if key == "" {
+					continue
+				}
+
+				ok, retryAfter, err := app.rateLimits.Take(r.Context(), name+":"+rule.kind+":"+key, rule.limit)
+				if err != nil {
+					app.logger.ErrorContext(r.Context(), "rate limit store failed", slog.String("error", err.Error()))
+					continue
+				}
+				if !ok {
+					app.metrics.rateLimited.WithLabelValues(name).Inc()
+					app.logger.InfoContext(r.Context(), "rate limit exceeded",
+						slog.String("policy", name),
+						slog.String("rule", rule.kind),
+					)
+
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+					app.clientError(w, http.StatusTooManyRequests)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// The memoryRateLimitStore type is a rateLimitStore which keeps the token
+// buckets in memory. The now function is normally time.Now, but tests can
+// pass in a fake clock.
+type memoryRateLimitStore struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// The tokenBucket type holds the state of a single bucket. Rather than
+// adding tokens on a timer, we work out how many have been added since the
+// bucket was last used whenever we take one.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// When the bucket will be full again, after which it can be forgotten.
+	full time.Time
+}
+
+// How often the memory store removes buckets which have filled up again.
+const rateLimitSweepInterval = time.Minute
+
+func newMemoryRateLimitStore(now func() time.Time) *memoryRateLimitStore {
+	return &memoryRateLimitStore{
+		now:       now,
+		buckets:   map[string]*tokenBucket{},
+		lastSweep: now(),
+	}
+}
+
+func (s *memoryRateLimitStore) Take(ctx context.Context, key string, limit rateLimit) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.burst), last: now}
+		s.buckets[key] = b
+	}
+
+	// Refill the bucket for the time since it was last used, up to burst.
+	elapsed := now.Sub(b.last)
+	b.tokens = math.Min(float64(limit.burst), b.tokens+float64(elapsed)/float64(limit.interval))
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) * float64(limit.interval))
+		return false, wait, nil
+	}
+
+	b.tokens--
+	b.full = now.Add(time.Duration((float64(limit.burst) - b.tokens) * float64(limit.interval)))
+	return true, 0, nil
+}
+
+// The sweep() method removes the buckets which are full again, because a
+// missing bucket behaves exactly like a full one. This stops the map growing
+// without limit as new clients come and go. The caller must hold s.mu.
+func (s *memoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	s.lastSweep = now
+
+	for key, b := range s.buckets {
+		if !now.Before(b.full) {
+			delete(s.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The fakeClock type is a clock for tests which only moves when told to.
+type fakeClock struct {
+	t time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	clock := newFakeClock()
+	store := newMemoryRateLimitStore(clock.now)
+	limit := newRateLimit(3, 30*time.Second)
+
+	take := func() (bool, time.Duration) {
+		ok, wait, err := store.Take(context.Background(), "key", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok, wait
+	}
+
+	// The first burst of requests is allowed.
+	for i := 0; i < 3; i++ {
+		if ok, _ := take(); !ok {
+			t.Fatalf("want request %d allowed", i+1)
+		}
+	}
+
+	// Then the bucket is empty, and refills one token every 10 seconds.
+	if ok, wait := take(); ok || wait != 10*time.Second {
+		t.Errorf("want denied for 10s; got allowed %t for %s", ok, wait)
+	}
+
+	clock.advance(4 * time.Second)
+	if ok, wait := take(); ok || wait != 6*time.Second {
+		t.Errorf("want denied for 6s; got allowed %t for %s", ok, wait)
+	}
+
+	clock.advance(6 * time.Second)
+	if ok, _ := take(); !ok {
+		t.Error("want allowed after refill")
+	}
+
+	// Once the bucket has filled up again it is forgotten.
+	clock.advance(rateLimitSweepInterval)
+	store.Take(context.Background(), "other", limit)
+	if _, ok := store.buckets["key"]; ok {
+		t.Error("want full bucket removed")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	clock := newFakeClock()
+	app := newTestApplication(t)
+	app.rateLimits = newMemoryRateLimitStore(clock.now)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	h := app.rateLimit("login", perIP(2, time.Minute), perUser(1, time.Minute), perEmail(3, time.Minute))(next)
+
+	post := func(remoteAddr, email string) *httptest.ResponseRecorder {
+		form := url.Values{"email": {email}}
+		r := httptest.NewRequest("POST", "/user/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = remoteAddr
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, r)
+		return rr
+	}
+
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		email          string
+		wantCode       int
+		wantRetryAfter string
+	}{
+		{"First from IP", "192.0.2.1:1234", "alice@example.com", http.StatusOK, ""},
+		{"Second from IP", "192.0.2.1:5678", "ALICE@example.com ", http.StatusOK, ""},
+		{"IP limit", "192.0.2.1:1234", "bob@example.com", http.StatusTooManyRequests, "30"},
+		{"New IP, same email", "192.0.2.2:1234", "alice@example.com", http.StatusOK, ""},
+		{"Email limit", "192.0.2.3:1234", "alice@example.com", http.StatusTooManyRequests, "20"},
+		{"Other email", "192.0.2.3:1234", "bob@example.com", http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := post(tt.remoteAddr, tt.email)
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, rr.Code)
+			}
+
+			if ra := rr.Header().Get("Retry-After"); ra != tt.wantRetryAfter {
+				t.Errorf("want Retry-After %q; got %q", tt.wantRetryAfter, ra)
+			}
+		})
+	}
+
+	// After the Retry-After period the IP can try again.
+	clock.advance(30 * time.Second)
+	if rr := post("192.0.2.1:1234", "carol@example.com"); rr.Code != http.StatusOK {
+		t.Errorf("want %d; got %d", http.StatusOK, rr.Code)
+	}
+}
+
+// The failingRateLimitStore type is a rateLimitStore which always fails.
+type failingRateLimitStore struct{}
+
+func (failingRateLimitStore) Take(context.Context, string, rateLimit) (bool, time.Duration, error) {
+	return false, 0, errors.New("store unavailable")
+}
+
+func TestRateLimitStoreFailure(t *testing.T) {
+	app := newTestApplication(t)
+	app.rateLimits = failingRateLimitStore{}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+
+	rr := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	app.rateLimit("test", perIP(1, time.Minute))(next).ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("want %d; got %d", http.StatusOK, rr.Code)
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"net/http"
+	"time"
 
+	"chilliweb.com/snippetbox/pkg/models"
 	"github.com/bmizerany/pat"
 	"github.com/justinas/alice"
 )
@@ -11,31 +13,111 @@ import (
 // a http.Handler instead of the original *http.ServeMux
 func (app *application) routes() http.Handler {
 	// Create a middleware chain containing our 'standard' middleware
-	// which will be used for every request our application receives
-	standardMiddleware := alice.New(app.recoverPanic, app.logRequest, secureHeaders)
+	// which will be used for every request our application receives.
+	// recoverPanic comes after logRequest so that requests which panic are
+	// still logged, with their 500 status, and trace comes before logRequest
+	// so that the access log includes the trace ID.
+	standardMiddleware := alice.New(app.trustProxy, requestID, app.trace, app.logRequest, app.instrument, app.recoverPanic, app.secureHeaders)
 
 	// A new middleware chain containing the middelware specific to
 	// our dynamic application routes.
-	dynamicMiddleware := alice.New(app.session.Enable, noSurf, app.authenticate)
+	dynamicMiddleware := alice.New(app.session.Enable, app.noSurf, app.authenticate)
 
-	mux := pat.New()
+	// The rate limiting policies for the routes which are expensive or open
+	// to abuse. They come after the dynamic middleware, so that the per-user
+	// limits know who the user is and requests with a bad CSRF token don't
+	// use up anyone's allowance.
+	loginLimit := app.rateLimit("login", perIP(10, time.Minute), perEmail(20, time.Hour))
+	signupLimit := app.rateLimit("signup", perIP(20, time.Hour))
+	forgotLimit := app.rateLimit("forgot", perIP(10, time.Hour), perEmail(3, time.Hour))
+	loginLinkLimit := app.rateLimit("login-link", perIP(10, time.Hour), perEmail(3, time.Hour))
+	resetLimit := app.rateLimit("reset", perIP(10, time.Hour))
+	verifyLimit := app.rateLimit("verify", perUser(3, time.Hour))
+	accountLimit := app.rateLimit("account", perUser(10, time.Hour))
+	passkeyLimit := app.rateLimit("passkey", perIP(10, time.Minute))
+	ssoLimit := app.rateLimit("sso", perIP(10, time.Minute))
+	twoFactorLimit := app.rateLimit("2fa", perIP(20, time.Minute), app.perTwoFactorUser(5, time.Minute))
+	snippetLimit := app.rateLimit("snippet", perUser(30, time.Hour), perIP(60, time.Hour))
+	// A page can break the policy several times over, so this is generous,
+	// but it stops a client filling the logs with made-up reports.
+	cspLimit := app.rateLimit("csp", perIP(60, time.Minute))
+
+	// Wrap the pat router so that each route records its pattern for the
+	// metrics and access log.
+	mux := router{pat.New()}
 	// These routes will use the new dynamic middleware chain followed
 	// by the appropriate handler function.
 	mux.Get("/", dynamicMiddleware.ThenFunc(app.home))
-	mux.Get("/snippet/create", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.createSnippetForm))
-	mux.Post("/snippet/create", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.createSnippet))
+	mux.Get("/snippet/create", dynamicMiddleware.Append(app.requireAuthenticatedUser, app.requireVerifiedUser).ThenFunc(app.createSnippetForm))
+	mux.Post("/snippet/create", dynamicMiddleware.Append(app.requireAuthenticatedUser, app.requireVerifiedUser, snippetLimit).ThenFunc(app.createSnippet))
 	mux.Get("/snippet/:id", dynamicMiddleware.ThenFunc(app.showSnippet))
 
 	// Authentication handling routes
 	mux.Get("/user/signup", dynamicMiddleware.ThenFunc(app.signupUserForm))
-	mux.Post("/user/signup", dynamicMiddleware.ThenFunc(app.signupUser))
+	mux.Post("/user/signup", dynamicMiddleware.Append(signupLimit).ThenFunc(app.signupUser))
 	mux.Get("/user/login", dynamicMiddleware.ThenFunc(app.loginUserForm))
-	mux.Post("/user/login", dynamicMiddleware.ThenFunc(app.loginUser))
+	mux.Post("/user/login", dynamicMiddleware.Append(loginLimit).ThenFunc(app.loginUser))
+	mux.Post("/user/login/link", dynamicMiddleware.Append(loginLinkLimit).ThenFunc(app.sendLoginLink))
+	mux.Get("/user/login/link/confirm", dynamicMiddleware.ThenFunc(app.loginLinkForm))
+	mux.Post("/user/login/link/confirm", dynamicMiddleware.Append(loginLimit).ThenFunc(app.loginWithLink))
+	mux.Get("/user/login/2fa", dynamicMiddleware.ThenFunc(app.loginTwoFactorForm))
+	mux.Post("/user/login/2fa", dynamicMiddleware.Append(twoFactorLimit).ThenFunc(app.loginTwoFactor))
+	mux.Post("/user/passkey/login/begin", dynamicMiddleware.Append(passkeyLimit).ThenFunc(app.beginPasskeyLogin))
+	mux.Post("/user/passkey/login/finish", dynamicMiddleware.Append(passkeyLimit).ThenFunc(app.finishPasskeyLogin))
+	mux.Get("/user/oidc/login", dynamicMiddleware.ThenFunc(app.oidcLogin))
+	mux.Get("/user/oidc/callback", dynamicMiddleware.Append(ssoLimit).ThenFunc(app.oidcCallback))
+	mux.Get("/user/password/forgot", dynamicMiddleware.ThenFunc(app.forgotPasswordForm))
+	mux.Post("/user/password/forgot", dynamicMiddleware.Append(forgotLimit).ThenFunc(app.forgotPassword))
+	mux.Get("/user/password/reset", dynamicMiddleware.ThenFunc(app.resetPasswordForm))
+	mux.Post("/user/password/reset", dynamicMiddleware.Append(resetLimit).ThenFunc(app.resetPassword))
+	mux.Get("/user/verify", dynamicMiddleware.ThenFunc(app.verifyEmail))
+	mux.Get("/user/verify/resend", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.resendVerificationForm))
+	mux.Post("/user/verify/resend", dynamicMiddleware.Append(app.requireAuthenticatedUser, verifyLimit).ThenFunc(app.resendVerification))
+	// Account settings routes
+	mux.Get("/account", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.account))
+	mux.Post("/account/name", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.changeName))
+	mux.Post("/account/email", dynamicMiddleware.Append(app.requireAuthenticatedUser, accountLimit).ThenFunc(app.changeEmail))
+	mux.Post("/account/password", dynamicMiddleware.Append(app.requireAuthenticatedUser, accountLimit).ThenFunc(app.changePassword))
+	mux.Get("/account/2fa", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.twoFactor))
+	mux.Get("/account/2fa/qr.png", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.twoFactorQR))
+	mux.Post("/account/2fa/enable", dynamicMiddleware.Append(app.requireAuthenticatedUser, accountLimit).ThenFunc(app.enableTwoFactor))
+	mux.Get("/account/passkeys", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.passkeys))
+	mux.Post("/account/passkeys/register/begin", dynamicMiddleware.Append(app.requireAuthenticatedUser, accountLimit).ThenFunc(app.beginPasskeyRegistration))
+	mux.Post("/account/passkeys/register/finish", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.finishPasskeyRegistration))
+	mux.Post("/account/passkeys/delete", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.deletePasskey))
+	mux.Get("/account/sessions", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.sessions))
+	mux.Post("/account/sessions/revoke", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.revokeSession))
+	mux.Post("/account/sessions/revoke-others", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.revokeOtherSessions))
+	mux.Post("/account/2fa/disable", dynamicMiddleware.Append(app.requireAuthenticatedUser, accountLimit).ThenFunc(app.disableTwoFactor))
+
 	mux.Post("/user/logout", dynamicMiddleware.Append(app.requireAuthenticatedUser).ThenFunc(app.logoutUser))
 
+	// Admin area routes. Moderators can look after the snippets, and only
+	// admins can manage the users.
+	moderatorMiddleware := dynamicMiddleware.Append(app.requireAuthenticatedUser, app.requireRole(models.RoleModerator))
+	adminMiddleware := dynamicMiddleware.Append(app.requireAuthenticatedUser, app.requireRole(models.RoleAdmin))
+	mux.Get("/admin", moderatorMiddleware.ThenFunc(app.adminDashboard))
+	mux.Get("/admin/snippets", moderatorMiddleware.ThenFunc(app.adminSnippets))
+	mux.Post("/admin/snippets/delete", moderatorMiddleware.ThenFunc(app.adminDeleteSnippet))
+	mux.Get("/admin/users", adminMiddleware.ThenFunc(app.adminUsers))
+	mux.Post("/admin/users/deactivate", adminMiddleware.ThenFunc(app.adminDeactivateUser))
+	mux.Post("/admin/users/activate", adminMiddleware.ThenFunc(app.adminActivateUser))
+	mux.Post("/admin/users/role", adminMiddleware.ThenFunc(app.adminSetRole))
+	mux.Post("/admin/users/unlock", adminMiddleware.ThenFunc(app.adminUnlockUser))
+
+	// Browsers POST Content-Security-Policy violation reports here. It
+	// doesn't use the dynamic middleware because the reports carry neither a
+	// session nor a CSRF token. The per-IP limit doesn't need a session, and
+	// the handler caps the size of the body.
+	mux.Post("/csp-report", alice.New(cspLimit).ThenFunc(app.cspReport))
+
 	// Register the ping handler function as the handler for the GET /ping route
 	mux.Get("/ping", http.HandlerFunc(ping))
 
+	// Liveness and readiness checks for the orchestrator and load balancer
+	mux.Get("/healthz", http.HandlerFunc(app.healthz))
+	mux.Get("/readyz", http.HandlerFunc(app.readyz))
+
 	// Static fikes route does not require session middleware
 	fileServer := http.FileServer(http.Dir("./ui/static/"))
 	mux.Get("/static/", http.StripPrefix("/static", fileServer))
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A server pairs an http.Server with the function which starts it, such as
+// srv.ListenAndServeTLS(), so that tests can pass in a server bound to a
+// random port instead.
+type server struct {
+	*http.Server
+	listen func() error
+}
+
+// The serve() method runs one or more servers until the given context is
+// cancelled (in production this happens when we receive a SIGINT or SIGTERM
+// signal), or until any of them fails.
+//
+// Once the context is cancelled we call Shutdown() on every server, which
+// stops them accepting new connections and waits for any in-flight requests to
+// complete, up to a maximum of the configured shutdown timeout. Then we stop
+// any background workers.
+func (app *application) serve(ctx context.Context, servers ...*server) error {
+	// Start each server in a separate goroutine, sending any error it returns
+	// on the listenErr channel. A buffered channel is used so the goroutines
+	// never block even if nobody is left to receive from it.
+	listenErr := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *server) {
+			listenErr <- srv.listen()
+		}(srv)
+	}
+
+	// Block until either a server fails (for example, because the port is
+	// already in use) or we are told to shut down. Either way we then shut
+	// down every server, so that a failure in one doesn't leave the others
+	// running.
+	var serveErr error
+	pending := len(servers)
+	select {
+	case serveErr = <-listenErr:
+		pending--
+	case <-ctx.Done():
+	}
+
+	app.logger.Info("shutting down server")
+
+	// Start failing the readiness check, and give the load balancer time to
+	// notice and stop sending us new requests before we stop accepting them.
+	app.shuttingDown.Store(true)
+	if app.config.timeouts.drain > 0 {
+		app.logger.Info("draining", "delay", app.config.timeouts.drain)
+		time.Sleep(app.config.timeouts.drain)
+	}
+
+	// Give in-flight requests up to the shutdown timeout to complete.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), app.config.timeouts.shutdown)
+	defer cancel()
+
+	var errs []error
+	if serveErr != nil {
+		errs = append(errs, serveErr)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *server) {
+			defer wg.Done()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("shutting down server %s: %w", srv.Addr, err))
+				mu.Unlock()
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	// Once Shutdown() has been called, ListenAndServe() returns straight away
+	// with http.ErrServerClosed. Anything else is a genuine error.
+	for ; pending > 0; pending-- {
+		if err := <-listenErr; err != nil && err != http.ErrServerClosed {
+			errs = append(errs, err)
+		}
+	}
+
+	// Stop the background workers, sharing the remainder of the same deadline.
+	if err := app.stopBackground(shutdownCtx); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// The background() helper runs fn in a new goroutine, tracking it in the
+// application's WaitGroup so that serve() can wait for it to finish during
+// shutdown. The quit channel passed to fn is closed when the application is
+// shutting down; long-running workers should return once that happens. If a
+// worker returns (or panics) before then, it is counted as failed, which the
+// readiness check reports.
+func (app *application) background(fn func(quit <-chan struct{})) {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		// Recover any panic so that a misbehaving worker can't take down
+		// the whole application.
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.Error(fmt.Sprintf("background worker panic: %s", err))
+			}
+
+			select {
+			case <-app.quit:
+			default:
+				app.workersFailed.Add(1)
+			}
+		}()
+
+		fn(app.quit)
+	}()
+}
+
+// The stopBackground() helper closes the quit channel to signal the
+// background workers to stop, and then waits for them to return or for the
+// context to expire, whichever happens first.
+func (app *application) stopBackground(ctx context.Context) error {
+	close(app.quit)
+
+	done := make(chan struct{})
+	go func() {
+		app.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for background workers: %w", ctx.Err())
+	}
+}
+
+// The cleanupSessions() method deletes expired sessions from the session
+// store every interval, until the quit channel is closed. It can be run
+// with app.background().
+func (app *application) cleanupSessions(quit <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			if err := app.session.Store.DeleteExpired(ctx); err != nil {
+				app.logger.Error(err.Error())
+			}
+			cancel()
+		}
+	}
+}
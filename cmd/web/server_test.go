@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServeGracefulShutdown(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.timeouts.shutdown = 5 * time.Second
+
+	// Create a handler which signals that the request has started, and then
+	// takes a little while to finish, so that we can begin shutting down
+	// while the request is still in flight.
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+
+	// Start a background worker which records when it has been stopped.
+	workerStopped := make(chan struct{})
+	app.background(func(quit <-chan struct{}) {
+		<-quit
+		close(workerStopped)
+	})
+
+	// Listen on a random free port.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &server{Server: &http.Server{Handler: handler}}
+	srv.listen = func() error {
+		return srv.Serve(ln)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- app.serve(ctx, srv)
+	}()
+
+	// Make the slow request in a separate goroutine.
+	type result struct {
+		code int
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		rs, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer rs.Body.Close()
+		body, err := ioutil.ReadAll(rs.Body)
+		results <- result{rs.StatusCode, string(body), err}
+	}()
+
+	// Once the request is in flight, trigger the shutdown.
+	<-started
+	cancel()
+
+	res := <-results
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+
+	if res.code != http.StatusOK {
+		t.Errorf("want %d; got %d", http.StatusOK, res.code)
+	}
+
+	if res.body != "done" {
+		t.Errorf("want body to equal %q; got %q", "done", res.body)
+	}
+
+	if err := <-serveErr; err != nil {
+		t.Errorf("want nil error; got %s", err)
+	}
+
+	if !app.shuttingDown.Load() {
+		t.Error("want readiness to be failing after shutdown")
+	}
+
+	select {
+	case <-workerStopped:
+	default:
+		t.Error("want background worker to be stopped")
+	}
+
+	// New connections should be refused now the server has shut down.
+	if _, err := http.Get("http://" + ln.Addr().String()); err == nil {
+		t.Error("want error connecting after shutdown; got nil")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/base64"
 	"html/template"
 	"path/filepath"
 	"time"
@@ -14,12 +15,33 @@ import (
 // FormData and FormErrors now added
 type templateData struct {
 	AuthenticatedUser *models.User
+	Credentials       []*models.Credential
 	CSRFToken         string
+	CSPNonce          string
 	CurrentYear       int
 	Flash             string
 	Form              *forms.Form
-	Snippet           *models.Snippet
-	Snippets          []*models.Snippet
+	// The user's logged in sessions, and the ID of the one making the
+	// request, for the sessions page.
+	Sessions         []*models.Session
+	CurrentSessionID string
+	Snippet          *models.Snippet
+	Snippets         []*models.Snippet
+	// The name of the OpenID Connect provider for the single sign-on
+	// button, or the empty string if it isn't configured.
+	SSOName string
+	// The secret and otpauth URI of the TOTP key the user is setting up, and
+	// the recovery codes they are shown when they turn on two-factor
+	// authentication.
+	TOTPSecret    string
+	TOTPURL       template.URL
+	RecoveryCodes []string
+	// The users, the roles they can be given and the counts and server
+	// details shown in the admin area.
+	Users  []*models.User
+	Roles  []string
+	Stats  *models.Stats
+	System *systemStats
 }
 
 // Create a humanDate function which returns a nicely formatted string
@@ -39,6 +61,7 @@ func humanDate(t time.Time) string {
 // custom template functions and the functions themselves
 var functions = template.FuncMap{
 	"humanDate": humanDate,
+	"base64url": base64.RawURLEncoding.EncodeToString,
 }
 
 func newTemplateCache(dir string) (map[string]*template.Template, error) {
@@ -53,17 +76,31 @@ func newTemplateCache(dir string) (map[string]*template.Template, error) {
 		return nil, err
 	}
 
+	// The admin area's pages are in their own directory, and are cached
+	// under names like 'admin/users.page.tmpl'.
+	adminPages, err := filepath.Glob(filepath.Join(dir, "admin", "*.page.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+	pages = append(pages, adminPages...)
+
 	// Loop through the pages one by one.
 	for _, page := range pages {
-		// Extract the file name, like 'home.page.tmpl'
-		// and assign to a var
-		name := filepath.Base(page)
+		// Extract the name relative to dir, like 'home.page.tmpl' or
+		// 'admin/users.page.tmpl', and assign to a var
+		name, err := filepath.Rel(dir, page)
+		if err != nil {
+			return nil, err
+		}
+		name = filepath.ToSlash(name)
 
 		// The template.FuncMap must be registered with the template set before we
 		// call the ParseFiles() method. This means we have to use template.New() to
 		// create an empty template set, use the Funcs() method to register the
 		// template.FuncMap, and parse the file as normal
-		ts, err := template.New(name).Funcs(functions).ParseFiles(page)
+		// The template set is named after the file's base name, because
+		// that's what ParseFiles() calls the template it parses.
+		ts, err := template.New(filepath.Base(page)).Funcs(functions).ParseFiles(page)
 		if err != nil {
 			return nil, err
 		}
@@ -82,6 +119,15 @@ func newTemplateCache(dir string) (map[string]*template.Template, error) {
 			return nil, err
 		}
 
+		// The admin pages also get the admin area's partials, like its
+		// navigation links.
+		if filepath.Dir(name) == "admin" {
+			ts, err = ts.ParseGlob(filepath.Join(dir, "admin", "*.partial.tmpl"))
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		// Add the template set to the cache using the name of the page
 		// (link 'home.page.tmpl) as the key
 		cache[name] = ts
@@ -46,3 +46,16 @@ func TestHumanDate(t *testing.T) {
 		})
 	}
 }
+
+func TestNewTemplateCache(t *testing.T) {
+	cache, err := newTemplateCache("./../../ui/html/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"home.page.tmpl", "admin/dashboard.page.tmpl", "admin/users.page.tmpl", "admin/snippets.page.tmpl"} {
+		if _, ok := cache[name]; !ok {
+			t.Errorf("want %q in the cache", name)
+		}
+	}
+}
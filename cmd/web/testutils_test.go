@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"html"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
@@ -12,9 +15,9 @@ import (
 	"testing"
 	"time"
 
+	"chilliweb.com/snippetbox/pkg/mailer"
 	"chilliweb.com/snippetbox/pkg/models/mock"
-
-	"github.com/golangcollege/sessions"
+	"chilliweb.com/snippetbox/pkg/session"
 )
 
 // Define a custom testServer type which anonymously embeds a httptest.Server instance.
@@ -48,21 +51,73 @@ func newTestApplication(t *testing.T) *application {
 		t.Fatal(err)
 	}
 
-	// Create a session manager instance, with the same settings as production.
-	session := sessions.New([]byte("j@883r_w0c|<%-@_pO3m4alL8|`|`rQD"))
-	session.Lifetime = 12 * time.Hour
-	session.Secure = true
+	// Load the default configuration, as it would be in development mode.
+	cfg, err := loadConfig([]string{"-env", "development", "-dsn", "test_web:pass@/test_snippetbox"}, fakeEnv{}.lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a session manager instance, with the same settings as production
+	// but keeping the sessions in memory.
+	sessionManager := session.New(session.NewMemoryStore())
+	sessionManager.Lifetime = cfg.session.lifetime
+	sessionManager.Cookie.Secure = cfg.secureCookies
+
+	webAuthn, err := newWebAuthn(cfg.baseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// Initialize the dependencies, using the mocks for the loggers and
 	// database models.
+	users := &mock.UserModel{}
+
 	return &application{
-		errorLog:      log.New(ioutil.Discard, "", 0),
-		infoLog:       log.New(ioutil.Discard, "", 0),
-		session:       session,
-		snippets:      &mock.SnippetModel{},
-		templateCache: templateCache,
-		users:         &mock.UserModel{},
+		config:          cfg,
+		logger:          newTestLogger(ioutil.Discard, "info"),
+		metrics:         newMetrics(),
+		rateLimits:      newMemoryRateLimitStore(time.Now),
+		session:         sessionManager,
+		snippets:        &mock.SnippetModel{},
+		templateCache:   templateCache,
+		users:           users,
+		authenticator:   users,
+		sessionRegistry: &mock.SessionModel{},
+		rememberTokens:  &mock.RememberTokenModel{},
+		stats:           &mock.StatsModel{},
+		credentials:     &mock.CredentialModel{},
+		webAuthn:        webAuthn,
+		mailer:          &mailer.Memory{},
+		db:              &fakeDB{},
+		quit:            make(chan struct{}),
+		started:         time.Now(),
+	}
+}
+
+// The fakeDB type stands in for the database connection pool in the health
+// checks. Its PingContext() method returns err, or blocks until the context
+// is done if block is true.
+type fakeDB struct {
+	err   error
+	block bool
+}
+
+func (db *fakeDB) PingContext(ctx context.Context) error {
+	if db.block {
+		<-ctx.Done()
+		return ctx.Err()
 	}
+	return db.err
+}
+
+// Create a newTestLogger helper which returns a logger writing text format
+// log entries at or above the given level to w.
+func newTestLogger(w io.Writer, level string) *slog.Logger {
+	logger, err := newLogger(w, "text", level)
+	if err != nil {
+		panic(err)
+	}
+	return logger
 }
 
 // Create a newTestServer helper which initializes and returns a new instance
@@ -128,3 +183,83 @@ func (ts *testServer) postForm(t *testing.T, urlPath string, form url.Values) (i
 	// Return the response status, headers and body.
 	return rs.StatusCode, rs.Header, body
 }
+
+// The postJSON method sends a POST request with a JSON body to the test
+// server, with the CSRF token in a header as our JavaScript does.
+func (ts *testServer) postJSON(t *testing.T, urlPath, csrfToken string, body []byte) (int, http.Header, []byte) {
+	req, err := http.NewRequest("POST", ts.URL+urlPath, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-CSRF-Token", csrfToken)
+
+	rs, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rs.Body.Close()
+	respBody, err := ioutil.ReadAll(rs.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rs.StatusCode, rs.Header, respBody
+}
+
+// The cookie method returns the value of the named cookie in the test
+// server's cookie jar, or the empty string if there isn't one.
+func (ts *testServer) cookie(t *testing.T, name string) string {
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range ts.Client().Jar.Cookies(u) {
+		if c.Name == name {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// The setCookie method replaces the named cookie in the test server's
+// cookie jar, as if someone had copied it from another browser.
+func (ts *testServer) setCookie(t *testing.T, name, value string) {
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts.Client().Jar.SetCookies(u, []*http.Cookie{{Name: name, Value: value, Path: "/"}})
+}
+
+// The sessionToken method returns the value of the session cookie in the
+// test server's cookie jar, or the empty string if there isn't one.
+func (ts *testServer) sessionToken(t *testing.T) string {
+	return ts.cookie(t, "session")
+}
+
+// The setSessionToken method replaces the session cookie in the test
+// server's cookie jar.
+func (ts *testServer) setSessionToken(t *testing.T, token string) {
+	ts.setCookie(t, "session", token)
+}
+
+// The login method logs in to the test server as the user with the given
+// email address (which the mock UserModel accepts with any password), so
+// that later requests are authenticated.
+func (ts *testServer) login(t *testing.T, email string) {
+	_, _, body := ts.get(t, "/user/login")
+
+	form := url.Values{}
+	form.Add("email", email)
+	form.Add("password", "validPa$$word")
+	form.Add("csrf_token", extractCSRFToken(t, body))
+
+	code, _, _ := ts.postForm(t, "/user/login", form)
+	if code != http.StatusSeeOther {
+		t.Fatalf("login as %s: want %d; got %d", email, http.StatusSeeOther, code)
+	}
+}
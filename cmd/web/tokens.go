@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// The errInvalidSignedToken error is returned by verifyToken() for any token
+// which is malformed, has been tampered with, was issued for a different
+// purpose or has expired. We don't say which, because the user can't do
+// anything different in each case.
+var errInvalidSignedToken = errors.New("invalid or expired token")
+
+// The signedTokenPayload type is the content of a signed token.
+type signedTokenPayload struct {
+	Purpose string   `json:"p"`
+	Expires int64    `json:"e"`
+	Fields  []string `json:"f"`
+}
+
+// The signToken() method returns a token for use in an emailed link, which
+// carries the given fields and an expiry time. Unlike the password reset
+// tokens, signed tokens aren't stored anywhere: the HMAC (keyed with the
+// session secret) proves that we issued them. The purpose is included in the
+// signature, so a token issued for one purpose can't be used for another.
+// Tokens are always signed with the current secret.
+func (app *application) signToken(purpose string, expires time.Time, fields ...string) string {
+	// Marshalling a struct of strings and an integer can't fail.
+	js, _ := json.Marshal(signedTokenPayload{Purpose: purpose, Expires: expires.Unix(), Fields: fields})
+
+	payload := base64.RawURLEncoding.EncodeToString(js)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(tokenMAC(app.config.secret, payload))
+}
+
+// The verifyToken() method checks that the token was issued by signToken()
+// for the given purpose and hasn't expired at now, and returns its fields.
+// Tokens signed with one of the previous secrets are still accepted, so that
+// the links in emails sent before the secret was changed keep working.
+func (app *application) verifyToken(purpose, token string, now time.Time) ([]string, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errInvalidSignedToken
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !app.validTokenMAC(payload, mac) {
+		return nil, errInvalidSignedToken
+	}
+
+	js, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errInvalidSignedToken
+	}
+
+	var p signedTokenPayload
+	if err := json.Unmarshal(js, &p); err != nil {
+		return nil, errInvalidSignedToken
+	}
+	if p.Purpose != purpose || now.Unix() >= p.Expires {
+		return nil, errInvalidSignedToken
+	}
+
+	return p.Fields, nil
+}
+
+// The validTokenMAC() method reports whether mac is the HMAC of a token
+// payload with the current secret or any of the previous ones.
+func (app *application) validTokenMAC(payload string, mac []byte) bool {
+	if hmac.Equal(mac, tokenMAC(app.config.secret, payload)) {
+		return true
+	}
+	for _, secret := range app.config.previousSecrets {
+		if hmac.Equal(mac, tokenMAC(secret, payload)) {
+			return true
+		}
+	}
+	return false
+}
+
+// The tokenMAC() function returns the HMAC-SHA256 of a token payload.
+func tokenMAC(secret, payload string) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte("snippetbox-token:" + payload))
+	return h.Sum(nil)
+}
+
+// The newSecret() function returns a new random secret key: 24 random bytes,
+// base64 encoded to the 32 characters the secret must have.
+func newSecret() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
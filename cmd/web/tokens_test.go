@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedTokens(t *testing.T) {
+	app := newTestApplication(t)
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	token := app.signToken("verify-email", now.Add(time.Hour), "2", "bob@example.com")
+
+	fields, err := app.verifyToken("verify-email", token, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(fields, ",") != "2,bob@example.com" {
+		t.Errorf("want fields %q; got %q", "2,bob@example.com", fields)
+	}
+
+	other := newTestApplication(t)
+	other.config.secret = strings.Repeat("x", 32)
+
+	payload, sig, _ := strings.Cut(token, ".")
+	forged := app.signToken("verify-email", now.Add(time.Hour), "1", "bob@example.com")
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+
+	tests := []struct {
+		name    string
+		app     *application
+		purpose string
+		token   string
+		now     time.Time
+	}{
+		{"Expired", app, "verify-email", token, now.Add(time.Hour)},
+		{"Wrong purpose", app, "magic-link", token, now},
+		{"Different secret", other, "verify-email", token, now},
+		{"Altered payload", app, "verify-email", forgedPayload + "." + sig, now},
+		{"Missing signature", app, "verify-email", payload, now},
+		{"Garbage", app, "verify-email", "not.a-token", now},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.app.verifyToken(tt.purpose, tt.token, tt.now)
+			if err != errInvalidSignedToken {
+				t.Errorf("want %v; got %v", errInvalidSignedToken, err)
+			}
+		})
+	}
+}
+
+func TestSignedTokensAfterRotation(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	oldSecret := strings.Repeat("o", 32)
+
+	before := newTestApplication(t)
+	before.config.secret = oldSecret
+	token := before.signToken("verify-email", now.Add(time.Hour), "2")
+
+	// After rotation the new secret signs tokens, and the old one is only
+	// used to check them.
+	after := newTestApplication(t)
+	after.config.secret = newSecret()
+	after.config.previousSecrets = stringList{oldSecret}
+
+	if _, err := after.verifyToken("verify-email", token, now); err != nil {
+		t.Errorf("token signed with previous secret: want nil; got %v", err)
+	}
+
+	newToken := after.signToken("verify-email", now.Add(time.Hour), "2")
+	if _, err := before.verifyToken("verify-email", newToken, now); err != errInvalidSignedToken {
+		t.Errorf("token signed with new secret: want %v; got %v", errInvalidSignedToken, err)
+	}
+
+	// Once the old secret is dropped its tokens stop working.
+	after.config.previousSecrets = nil
+	if _, err := after.verifyToken("verify-email", token, now); err != errInvalidSignedToken {
+		t.Errorf("want %v; got %v", errInvalidSignedToken, err)
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	a, b := newSecret(), newSecret()
+	if len(a) != 32 {
+		t.Errorf("want 32 bytes; got %d", len(a))
+	}
+	if a == b {
+		t.Errorf("want different secrets; got %q twice", a)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The tracer used for the spans we create in the web application. It comes
+// from the global tracer provider, which is configured by newTracerProvider().
+var tracer = otel.Tracer("chilliweb.com/snippetbox/cmd/web")
+
+// The newTracerProvider() function creates an OpenTelemetry tracer provider
+// and installs it as the global provider, along with the W3C trace context
+// propagator. If an OTLP endpoint is configured, spans are exported to it over
+// HTTP; otherwise spans are still created (so trace IDs appear in the logs and
+// are propagated), but they aren't exported anywhere.
+func newTracerProvider(ctx context.Context, cfg *config) (*sdktrace.TracerProvider, error) {
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "snippetbox"))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.tracing.sampleRatio))),
+	}
+
+	if cfg.tracing.endpoint != "" {
+		exporterOpts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.tracing.endpoint)}
+		if cfg.tracing.insecure {
+			exporterOpts = append(exporterOpts, otlptracehttp.WithInsecure())
+		}
+
+		exporter, err := otlptracehttp.New(ctx, exporterOpts...)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+
+	tp := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return tp, nil
+}
+
+// The trace middleware starts a server span for each request. If the request
+// has a W3C traceparent header (because the caller is tracing too) the span
+// is made a child of the caller's span, so the whole request can be followed
+// across services.
+func (app *application) trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		// We don't know which route will match yet, so we name the span after
+		// the method for now and rename it once the request has been handled.
+		ctx, span := tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("client.address", r.RemoteAddr),
+			),
+		)
+		defer span.End()
+
+		if id, ok := r.Context().Value(contextKeyRequestID).(string); ok {
+			span.SetAttributes(attribute.String("request_id", id))
+		}
+
+		r, entry := withLogEntry(r.WithContext(ctx))
+		rw := &responseRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rw, r)
+
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+
+		if entry.route != "" {
+			span.SetName(r.Method + " " + entry.route)
+			span.SetAttributes(attribute.String("http.route", entry.route))
+		}
+		if entry.userID != 0 {
+			span.SetAttributes(attribute.Int("user.id", entry.userID))
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", rw.status))
+		if rw.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rw.status))
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// The global tracer provider can only usefully be set once, because tracers
+// obtained before then (like our package-level tracer) are bound to the first
+// provider set. So every test shares a single in-process span recorder.
+var (
+	spanRecorder     *tracetest.SpanRecorder
+	spanRecorderOnce sync.Once
+)
+
+func recordSpans() *tracetest.SpanRecorder {
+	spanRecorderOnce.Do(func() {
+		spanRecorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	return spanRecorder
+}
+
+func TestTrace(t *testing.T) {
+	recorder := recordSpans()
+
+	app := newTestApplication(t)
+	logs := new(bytes.Buffer)
+	app.logger = newTestLogger(logs, "info")
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Make a request which carries the trace context of a caller.
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, err := http.NewRequest("GET", ts.URL+"/snippet/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+
+	rs, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Body.Close()
+
+	// Find the spans for our trace.
+	var server, render sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID().String() != traceID {
+			continue
+		}
+		switch span.Name() {
+		case "GET /snippet/:id":
+			server = span
+		case "render show.page.tmpl":
+			render = span
+		}
+	}
+
+	if server == nil {
+		t.Fatal("want server span continuing the caller's trace")
+	}
+	if server.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("want server span parent %q; got %q", "00f067aa0ba902b7", server.Parent().SpanID())
+	}
+
+	if render == nil {
+		t.Fatal("want render span")
+	}
+	if render.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Error("want render span to be a child of the server span")
+	}
+
+	// The access log line should include the trace ID.
+	if !strings.Contains(logs.String(), "trace_id="+traceID) {
+		t.Errorf("want logs to contain trace ID; got %q", logs.String())
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"chilliweb.com/snippetbox/pkg/models"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// The newWebAuthn() function returns the WebAuthn relying party for the site
+// at baseURL. Passkeys are tied to the host name, so they stop working if the
+// site moves to a different one.
+func newWebAuthn(baseURL string) (*webauthn.WebAuthn, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return webauthn.New(&webauthn.Config{
+		RPID:          u.Hostname(),
+		RPDisplayName: "Snippetbox",
+		RPOrigins:     []string{u.Scheme + "://" + u.Host},
+	})
+}
+
+// The webAuthnUser type adapts a user and their credentials to the
+// webauthn.User interface.
+type webAuthnUser struct {
+	user        *models.User
+	credentials []*models.Credential
+}
+
+// The user handle is the user's ID. It is stored by the authenticator, and
+// tells us who is logging in with a passkey.
+func (u *webAuthnUser) WebAuthnID() []byte {
+	return []byte(strconv.Itoa(u.user.ID))
+}
+
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.user.Email
+}
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	return u.user.Name
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, len(u.credentials))
+	for i, c := range u.credentials {
+		transports := make([]protocol.AuthenticatorTransport, len(c.Transports))
+		for j, t := range c.Transports {
+			transports[j] = protocol.AuthenticatorTransport(t)
+		}
+
+		credentials[i] = webauthn.Credential{
+			ID:              c.ID,
+			PublicKey:       c.PublicKey,
+			AttestationType: c.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: c.BackupEligible,
+				BackupState:    c.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    c.AAGUID,
+				SignCount: c.SignCount,
+			},
+		}
+	}
+	return credentials
+}
+
+// The loadWebAuthnUser() helper returns the user with the given ID along
+// with their credentials.
+func (app *application) loadWebAuthnUser(r *http.Request, id int) (*webAuthnUser, error) {
+	user, err := app.users.Get(r.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := app.credentials.ForUser(r.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &webAuthnUser{user: user, credentials: credentials}, nil
+}
+
+// The putWebAuthnSession() helper stores the challenge and other details of
+// a WebAuthn ceremony in the session, under the given key, until the browser
+// sends back the response. The session can only store basic types, so it is
+// encoded as JSON.
+func (app *application) putWebAuthnSession(r *http.Request, key string, sd *webauthn.SessionData) error {
+	js, err := json.Marshal(sd)
+	if err != nil {
+		return err
+	}
+	app.session.Put(r, key, string(js))
+	return nil
+}
+
+// The popWebAuthnSession() helper removes the details of a WebAuthn ceremony
+// from the session and returns them, so that each challenge can only be used
+// once. It returns false if there isn't a ceremony in progress.
+func (app *application) popWebAuthnSession(r *http.Request, key string) (webauthn.SessionData, bool) {
+	var sd webauthn.SessionData
+	js := app.session.PopString(r, key)
+	if js == "" {
+		return sd, false
+	}
+	if err := json.Unmarshal([]byte(js), &sd); err != nil {
+		return sd, false
+	}
+	return sd, true
+}
+
+// The beginPasskeyLogin handler starts logging in with a passkey. It returns
+// the options for navigator.credentials.get() as JSON. We don't know who the
+// user is yet, so any of the site's passkeys on their device can be used.
+func (app *application) beginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	options, sd, err := app.webAuthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if err := app.putWebAuthnSession(r, "webauthnLogin", sd); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, options)
+}
+
+// The finishPasskeyLogin handler checks the signed assertion from the user's
+// authenticator and logs them in. A passkey which requires user verification
+// (a PIN or biometric) is already two factors, so users with two-factor
+// authentication turned on aren't asked for a TOTP code as well. Users whose
+// account has been deactivated get a 403 Forbidden response.
+func (app *application) finishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	sd, ok := app.popWebAuthnSession(r, "webauthnLogin")
+	if !ok {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// The authenticator tells us the user handle, which is the user's ID.
+	var wu *webAuthnUser
+	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+		id, err := strconv.Atoi(string(userHandle))
+		if err != nil {
+			return nil, models.ErrNoRecord
+		}
+		wu, err = app.loadWebAuthnUser(r, id)
+		return wu, err
+	}
+
+	credential, err := app.webAuthn.FinishDiscoverableLogin(handler, sd, r)
+	if err != nil {
+		app.metrics.loginFailures.Inc()
+		app.logger.InfoContext(r.Context(), "passkey login failed", slog.String("error", err.Error()))
+		app.clientError(w, http.StatusUnauthorized)
+		return
+	}
+
+	// If the signature counter hasn't gone up since the credential was last
+	// used, there may be a copy of the private key which someone else is
+	// using, so refuse to log in with it.
+	if credential.Authenticator.CloneWarning {
+		app.metrics.loginFailures.Inc()
+		app.logger.WarnContext(r.Context(), "passkey signature counter went backwards",
+			slog.Int("user_id", wu.user.ID),
+			slog.String("credential", base64.RawURLEncoding.EncodeToString(credential.ID)),
+		)
+		app.clientError(w, http.StatusUnauthorized)
+		return
+	}
+
+	// A deactivated user can't log in, whichever way they try.
+	if !wu.user.Active {
+		app.metrics.loginFailures.Inc()
+		app.logger.InfoContext(r.Context(), "passkey login for deactivated user", slog.Int("user_id", wu.user.ID))
+		app.clientError(w, http.StatusForbidden)
+		return
+	}
+
+	err = app.credentials.RecordUse(r.Context(), credential.ID, credential.Authenticator.SignCount, credential.Flags.BackupState)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if err := app.logIn(r, wu.user); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.writeJSON(w, r, http.StatusOK, map[string]string{"redirect": "/snippet/create"})
+}
+
+// The passkeys handler lists the user's passkeys, with a form to add another
+// one.
+func (app *application) passkeys(w http.ResponseWriter, r *http.Request) {
+	credentials, err := app.credentials.ForUser(r.Context(), app.authenticatedUser(r).ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.render(w, r, "passkeys.page.tmpl", &templateData{Credentials: credentials})
+}
+
+// The beginPasskeyRegistration handler starts adding a passkey to the user's
+// account. It returns the options for navigator.credentials.create() as
+// JSON. The user's existing passkeys are excluded, so that the same
+// authenticator isn't registered twice.
+func (app *application) beginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	wu, err := app.loadWebAuthnUser(r, app.authenticatedUser(r).ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	options, sd, err := app.webAuthn.BeginRegistration(wu,
+		webauthn.WithExclusions(webauthn.Credentials(wu.WebAuthnCredentials()).CredentialDescriptors()),
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationRequired,
+		}),
+	)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if err := app.putWebAuthnSession(r, "webauthnRegistration", sd); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, options)
+}
+
+// The finishPasskeyRegistration handler checks the new credential from the
+// user's authenticator and stores it. The name the user gave the passkey is
+// in the query string, because the body is the credential.
+func (app *application) finishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	sd, ok := app.popWebAuthnSession(r, "webauthnRegistration")
+	if !ok {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if name == "" || len(name) > 255 {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	wu, err := app.loadWebAuthnUser(r, app.authenticatedUser(r).ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	credential, err := app.webAuthn.FinishRegistration(wu, sd, r)
+	if err != nil {
+		app.logger.InfoContext(r.Context(), "passkey registration failed", slog.String("error", err.Error()))
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	transports := make([]string, len(credential.Transport))
+	for i, t := range credential.Transport {
+		transports[i] = string(t)
+	}
+
+	err = app.credentials.Insert(r.Context(), &models.Credential{
+		ID:              credential.ID,
+		UserID:          wu.user.ID,
+		Name:            name,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		AAGUID:          credential.Authenticator.AAGUID,
+		Transports:      transports,
+		SignCount:       credential.Authenticator.SignCount,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.session.Put(r, "flash", "Your passkey has been added")
+	app.writeJSON(w, r, http.StatusOK, map[string]string{"redirect": "/account/passkeys"})
+}
+
+func (app *application) deletePasskey(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	id, err := base64.RawURLEncoding.DecodeString(r.PostForm.Get("id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	err = app.credentials.Delete(r.Context(), app.authenticatedUser(r).ID, id)
+	if err == models.ErrNoRecord {
+		app.notFound(w)
+		return
+	} else if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.session.Put(r, "flash", "Your passkey has been removed")
+	http.Redirect(w, r, "/account/passkeys", http.StatusSeeOther)
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"chilliweb.com/snippetbox/pkg/models"
+	"chilliweb.com/snippetbox/pkg/models/mock"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+// The softAuthenticator type is a WebAuthn authenticator for tests, which
+// does what a browser and a security key or phone would do with the options
+// from the server. It holds a single P-256 credential.
+type softAuthenticator struct {
+	rpID         string
+	origin       string
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T, baseURL string) *softAuthenticator {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return &softAuthenticator{
+		rpID:         u.Hostname(),
+		origin:       u.Scheme + "://" + u.Host,
+		key:          key,
+		credentialID: id,
+	}
+}
+
+// The authData() method returns the authenticator data, with the attested
+// credential data included when registering.
+func (a *softAuthenticator) authData(t *testing.T, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+
+	buf := new(bytes.Buffer)
+	buf.Write(rpIDHash[:])
+
+	// The user present and user verified flags, and attested credential
+	// data when registering.
+	flags := byte(0x01 | 0x04)
+	if attested {
+		flags |= 0x40
+	}
+	buf.WriteByte(flags)
+	binary.Write(buf, binary.BigEndian, a.signCount)
+
+	if attested {
+		point, err := a.key.PublicKey.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+			PublicKeyData: webauthncose.PublicKeyData{
+				KeyType:   int64(webauthncose.EllipticKey),
+				Algorithm: int64(webauthncose.AlgES256),
+			},
+			Curve:  int64(webauthncose.P256),
+			XCoord: point[1:33],
+			YCoord: point[33:],
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf.Write(make([]byte, 16)) // AAGUID
+		binary.Write(buf, binary.BigEndian, uint16(len(a.credentialID)))
+		buf.Write(a.credentialID)
+		buf.Write(publicKey)
+	}
+
+	return buf.Bytes()
+}
+
+func (a *softAuthenticator) clientData(t *testing.T, typ string, options []byte) []byte {
+	var opts struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(options, &opts); err != nil {
+		t.Fatal(err)
+	}
+
+	js, err := json.Marshal(map[string]any{
+		"type":      typ,
+		"challenge": opts.PublicKey.Challenge,
+		"origin":    a.origin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return js
+}
+
+// The create() method responds to the options for registering a credential,
+// like navigator.credentials.create(), using "none" attestation.
+func (a *softAuthenticator) create(t *testing.T, options []byte) []byte {
+	var opts struct {
+		PublicKey struct {
+			User struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(options, &opts); err != nil {
+		t.Fatal(err)
+	}
+	userHandle, err := base64.RawURLEncoding.DecodeString(opts.PublicKey.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.userHandle = userHandle
+
+	attestationObject, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authData(t, true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.credential(t, map[string]any{
+		"attestationObject": b64(attestationObject),
+		"clientDataJSON":    b64(a.clientData(t, "webauthn.create", options)),
+		"transports":        []string{"internal"},
+	})
+}
+
+// The get() method responds to the options for logging in, like
+// navigator.credentials.get(), signing the challenge with the credential.
+func (a *softAuthenticator) get(t *testing.T, options []byte) []byte {
+	a.signCount++
+
+	authData := a.authData(t, false)
+	clientData := a.clientData(t, "webauthn.get", options)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.credential(t, map[string]any{
+		"authenticatorData": b64(authData),
+		"clientDataJSON":    b64(clientData),
+		"signature":         b64(sig),
+		"userHandle":        b64(a.userHandle),
+	})
+}
+
+func (a *softAuthenticator) credential(t *testing.T, response map[string]any) []byte {
+	js, err := json.Marshal(map[string]any{
+		"id":       b64(a.credentialID),
+		"rawId":    b64(a.credentialID),
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return js
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// The registerPasskey() helper adds a passkey for the logged in user, from
+// the given authenticator.
+func registerPasskey(t *testing.T, ts *testServer, auth *softAuthenticator) {
+	_, _, body := ts.get(t, "/account/passkeys")
+	csrfToken := extractCSRFToken(t, body)
+
+	code, _, options := ts.postJSON(t, "/account/passkeys/register/begin", csrfToken, nil)
+	if code != http.StatusOK {
+		t.Fatalf("begin registration: want %d; got %d", http.StatusOK, code)
+	}
+
+	code, _, _ = ts.postJSON(t, "/account/passkeys/register/finish?name=Laptop", csrfToken, auth.create(t, options))
+	if code != http.StatusOK {
+		t.Fatalf("finish registration: want %d; got %d", http.StatusOK, code)
+	}
+}
+
+// The loginWithPasskey() helper logs in with the given authenticator and
+// returns the status code of the final step.
+func loginWithPasskey(t *testing.T, ts *testServer, auth *softAuthenticator) int {
+	_, _, body := ts.get(t, "/user/login")
+	csrfToken := extractCSRFToken(t, body)
+
+	code, _, options := ts.postJSON(t, "/user/passkey/login/begin", csrfToken, nil)
+	if code != http.StatusOK {
+		t.Fatalf("begin login: want %d; got %d", http.StatusOK, code)
+	}
+
+	code, _, _ = ts.postJSON(t, "/user/passkey/login/finish", csrfToken, auth.get(t, options))
+	return code
+}
+
+func TestPasskeyRegistration(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ts.login(t, "alice@example.com")
+	registerPasskey(t, ts, newSoftAuthenticator(t, app.config.baseURL))
+
+	_, _, body := ts.get(t, "/account/passkeys")
+	for _, want := range []string{"Your passkey has been added", "Laptop"} {
+		if !bytes.Contains(body, []byte(want)) {
+			t.Errorf("want body to contain %q", want)
+		}
+	}
+
+	// A response for a different origin is rejected.
+	_, _, body = ts.get(t, "/account/passkeys")
+	csrfToken := extractCSRFToken(t, body)
+	_, _, options := ts.postJSON(t, "/account/passkeys/register/begin", csrfToken, nil)
+
+	phished := newSoftAuthenticator(t, "https://snippetbox.example.net")
+	code, _, _ := ts.postJSON(t, "/account/passkeys/register/finish?name=Phone", csrfToken, phished.create(t, options))
+	if code != http.StatusBadRequest {
+		t.Errorf("want %d; got %d", http.StatusBadRequest, code)
+	}
+
+	// And the challenge can't be used twice.
+	auth := newSoftAuthenticator(t, app.config.baseURL)
+	code, _, _ = ts.postJSON(t, "/account/passkeys/register/finish?name=Phone", csrfToken, auth.create(t, options))
+	if code != http.StatusBadRequest {
+		t.Errorf("want %d; got %d", http.StatusBadRequest, code)
+	}
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	app := newTestApplication(t)
+	auth := newSoftAuthenticator(t, app.config.baseURL)
+
+	// Register the passkey in one session, and log in with it in another.
+	setup := newTestServer(t, app.routes())
+	setup.login(t, "alice@example.com")
+	registerPasskey(t, setup, auth)
+	setup.Close()
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	if code := loginWithPasskey(t, ts, auth); code != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, code)
+	}
+
+	if code, _, _ := ts.get(t, "/account"); code != http.StatusOK {
+		t.Errorf("want %d; got %d", http.StatusOK, code)
+	}
+}
+
+func TestPasskeyLoginFailures(t *testing.T) {
+	app := newTestApplication(t)
+	auth := newSoftAuthenticator(t, app.config.baseURL)
+
+	setup := newTestServer(t, app.routes())
+	setup.login(t, "alice@example.com")
+	registerPasskey(t, setup, auth)
+	setup.Close()
+
+	tests := []struct {
+		name   string
+		modify func(a *softAuthenticator)
+	}{
+		// The signature counter going backwards suggests the credential has
+		// been cloned.
+		{"Cloned authenticator", func(a *softAuthenticator) { a.signCount = 0 }},
+		{"Unregistered key", func(a *softAuthenticator) {
+			a.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		}},
+		{"Other origin", func(a *softAuthenticator) { a.origin = "https://snippetbox.example.net" }},
+		{"Unknown user", func(a *softAuthenticator) { a.userHandle = []byte("99") }},
+	}
+
+	// Use the passkey once, so that its stored signature counter is 1.
+	ts := newTestServer(t, app.routes())
+	if code := loginWithPasskey(t, ts, auth); code != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, code)
+	}
+	ts.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			a := *auth
+			tt.modify(&a)
+
+			if code := loginWithPasskey(t, ts, &a); code != http.StatusUnauthorized {
+				t.Errorf("want %d; got %d", http.StatusUnauthorized, code)
+			}
+
+			if code, _, _ := ts.get(t, "/account"); code != http.StatusFound {
+				t.Errorf("want %d; got %d", http.StatusFound, code)
+			}
+		})
+	}
+}
+
+// The inactiveUserModel type wraps the user mock, making every user it
+// returns look deactivated.
+type inactiveUserModel struct {
+	mock.UserModel
+}
+
+func (m *inactiveUserModel) Get(ctx context.Context, id int) (*models.User, error) {
+	user, err := m.UserModel.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	deactivated := *user
+	deactivated.Active = false
+	return &deactivated, nil
+}
+
+func TestPasskeyLoginDeactivatedUser(t *testing.T) {
+	app := newTestApplication(t)
+	auth := newSoftAuthenticator(t, app.config.baseURL)
+
+	setup := newTestServer(t, app.routes())
+	setup.login(t, "alice@example.com")
+	registerPasskey(t, setup, auth)
+	setup.Close()
+
+	// Deactivate the user after they've registered their passkey.
+	app.users = &inactiveUserModel{}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	if code := loginWithPasskey(t, ts, auth); code != http.StatusForbidden {
+		t.Errorf("want %d; got %d", http.StatusForbidden, code)
+	}
+
+	if code, _, _ := ts.get(t, "/account"); code != http.StatusFound {
+		t.Errorf("want %d; got %d", http.StatusFound, code)
+	}
+
+	// The passkey isn't recorded as used either.
+	credentials, err := app.credentials.ForUser(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(credentials) != 1 || !credentials[0].LastUsed.IsZero() {
+		t.Errorf("want the passkey unused; got %v", credentials)
+	}
+}
+
+func TestDeletePasskey(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	auth := newSoftAuthenticator(t, app.config.baseURL)
+	ts.login(t, "alice@example.com")
+	registerPasskey(t, ts, auth)
+
+	tests := []struct {
+		name     string
+		id       string
+		wantCode int
+	}{
+		{"Unknown passkey", b64([]byte("unknown")), http.StatusNotFound},
+		{"Invalid ID", "!", http.StatusNotFound},
+		{"Own passkey", b64(auth.credentialID), http.StatusSeeOther},
+		{"Already removed", b64(auth.credentialID), http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, body := ts.get(t, "/account/passkeys")
+			form := url.Values{}
+			form.Add("id", tt.id)
+			form.Add("csrf_token", extractCSRFToken(t, body))
+
+			code, _, _ := ts.postForm(t, "/account/passkeys/delete", form)
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+		})
+	}
+}
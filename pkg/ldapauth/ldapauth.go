@@ -0,0 +1,188 @@
+package ldapauth
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"chilliweb.com/snippetbox/pkg/models"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Users is the part of the user model the Authenticator needs, to find or
+// create the local user for a directory entry.
+type Users interface {
+	AuthenticateIdentity(ctx context.Context, identity *models.Identity, provision bool) (int, error)
+}
+
+// Authenticator checks email addresses and passwords against an LDAP
+// directory. It searches for the user's entry (binding as BindDN to do so,
+// or anonymously if BindDN is empty), and then binds as that entry with the
+// password they gave. The first time a user logs in, they are linked to the
+// local user with the same email address, or a new local user is created
+// for them, so that they have somewhere to keep their snippets.
+type Authenticator struct {
+	// The directory server, like ldaps://ldap.example.com. With an ldap://
+	// URL the connection is unencrypted unless StartTLS is set.
+	URL       string
+	StartTLS  bool
+	TLSConfig *tls.Config
+
+	BindDN       string
+	BindPassword string
+
+	// The users are searched for under BaseDN with UserFilter, which must
+	// contain a single %s for the (escaped) email address, like
+	// "(&(objectClass=person)(mail=%s))". The user's name is taken from
+	// NameAttribute, and their email address from the mail attribute.
+	BaseDN        string
+	UserFilter    string
+	NameAttribute string
+
+	// The longest the whole conversation with the server may take.
+	Timeout time.Duration
+
+	Users Users
+}
+
+// Authenticate returns the ID of the local user with the given email
+// address and directory password, or models.ErrInvalidCredentials if the
+// directory doesn't have exactly one entry matching the address, the entry
+// has no mail attribute or the password is wrong. The ip parameter is part
+// of the authenticator interface, but isn't used.
+func (a *Authenticator) Authenticate(ctx context.Context, email, password, ip string) (int, error) {
+	// An LDAP bind with an empty password is an unauthenticated bind, which
+	// most servers allow for any DN, so we must never try one.
+	if email == "" || password == "" {
+		return 0, models.ErrInvalidCredentials
+	}
+
+	if a.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.Timeout)
+		defer cancel()
+	}
+
+	conn, err := a.dial(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// The LDAP client doesn't take a context, so close the connection to
+	// interrupt whatever it is doing if the context is cancelled.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if a.BindDN != "" {
+		if err := conn.Bind(a.BindDN, a.BindPassword); err != nil {
+			return 0, fmt.Errorf("ldapauth: service bind: %w", err)
+		}
+	}
+
+	search := ldap.NewSearchRequest(
+		a.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, 0, false,
+		fmt.Sprintf(a.UserFilter, ldap.EscapeFilter(email)),
+		[]string{"mail", a.NameAttribute},
+		nil,
+	)
+	result, err := conn.Search(search)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return 0, models.ErrInvalidCredentials
+	} else if err != nil {
+		return 0, fmt.Errorf("ldapauth: search: %w", err)
+	}
+	if len(result.Entries) != 1 {
+		return 0, models.ErrInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return 0, models.ErrInvalidCredentials
+	} else if err != nil {
+		return 0, fmt.Errorf("ldapauth: bind: %w", err)
+	}
+
+	// The directory is managed by administrators, so we treat its email
+	// addresses as verified. That only goes for the address in the entry,
+	// not the one the user typed, which a filter on some other attribute
+	// could have matched, so entries without one can't log in.
+	mail := entry.GetAttributeValue("mail")
+	if mail == "" {
+		return 0, models.ErrInvalidCredentials
+	}
+
+	identity := &models.Identity{
+		Issuer:        a.URL,
+		Subject:       entry.DN,
+		Email:         mail,
+		EmailVerified: true,
+		Name:          entry.GetAttributeValue(a.NameAttribute),
+	}
+	if identity.Name == "" {
+		identity.Name = identity.Email
+	}
+
+	return a.Users.AuthenticateIdentity(ctx, identity, true)
+}
+
+// The dial() method connects to the directory server, upgrading the
+// connection with StartTLS if required.
+func (a *Authenticator) dial(ctx context.Context) (*ldap.Conn, error) {
+	u, err := url.Parse(a.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := a.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = u.Hostname()
+	}
+
+	dialer := &net.Dialer{}
+	if deadline, ok := ctx.Deadline(); ok {
+		dialer.Deadline = deadline
+	}
+
+	conn, err := ldap.DialURL(a.URL, ldap.DialWithDialer(dialer), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("ldapauth: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetTimeout(time.Until(deadline))
+	}
+
+	if a.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldapauth: starttls: %w", err)
+		}
+	}
+
+	return conn, nil
+}
+
+// ErrInvalidFilter is returned by ValidateFilter for a user filter which
+// doesn't contain exactly one %s.
+var ErrInvalidFilter = errors.New("ldapauth: user filter must contain exactly one %s")
+
+// ValidateFilter checks that a user filter has a single %s for the email
+// address and is otherwise a valid LDAP filter.
+func ValidateFilter(filter string) error {
+	if strings.Count(filter, "%s") != 1 || strings.Count(filter, "%") != 1 {
+		return ErrInvalidFilter
+	}
+	_, err := ldap.CompileFilter(fmt.Sprintf(filter, "x"))
+	return err
+}
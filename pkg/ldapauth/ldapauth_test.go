@@ -0,0 +1,356 @@
+package ldapauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"chilliweb.com/snippetbox/pkg/models"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// The fakeDirectory type is a stand-in LDAP server for tests. It only
+// understands simple binds, searches (matching the filter exactly against
+// each entry's mail attribute run through the expected user filter) and
+// StartTLS, which is all the Authenticator uses.
+type fakeDirectory struct {
+	ln      net.Listener
+	tls     *tls.Config
+	filter  string
+	entries []fakeEntry
+	// The service account the Authenticator binds as before searching.
+	serviceDN       string
+	servicePassword string
+}
+
+type fakeEntry struct {
+	dn       string
+	password string
+	mail     string
+	cn       string
+	// Whether the entry is found by its mail but doesn't return it, like an
+	// entry matched by a filter on some other attribute.
+	hideMail bool
+}
+
+// The newFakeDirectory() function starts a fake directory listening on a
+// local port, serving LDAP over TLS if useTLS is true.
+func newFakeDirectory(t *testing.T, useTLS bool) *fakeDirectory {
+	d := &fakeDirectory{
+		tls:             newTestTLSConfig(t),
+		filter:          "(&(objectClass=person)(mail=%s))",
+		serviceDN:       "cn=snippetbox,ou=services,dc=example,dc=com",
+		servicePassword: "service-secret",
+		entries: []fakeEntry{
+			{"uid=alice,ou=people,dc=example,dc=com", "alice-secret", "alice@example.com", "Alice Jones", false},
+			{"uid=bob,ou=people,dc=example,dc=com", "bob-secret", "bob@example.com", "", false},
+			{"uid=twin1,ou=people,dc=example,dc=com", "twin-secret", "twin@example.com", "Twin", false},
+			{"uid=twin2,ou=people,dc=example,dc=com", "twin-secret", "twin@example.com", "Twin", false},
+			{"uid=dave,ou=people,dc=example,dc=com", "dave-secret", "dave@example.com", "Dave", true},
+		},
+	}
+
+	var err error
+	if useTLS {
+		d.ln, err = tls.Listen("tcp", "127.0.0.1:0", d.tls)
+	} else {
+		d.ln, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.ln.Close() })
+
+	go func() {
+		for {
+			conn, err := d.ln.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+
+	return d
+}
+
+// The serve() method handles the requests on a single connection.
+func (d *fakeDirectory) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+
+	var bound string
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Data.String()
+			password := op.Children[2].Data.String()
+
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			if dn == d.serviceDN && password == d.servicePassword {
+				code = ldap.LDAPResultSuccess
+			}
+			for _, e := range d.entries {
+				if dn == e.dn && password == e.password {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+			if code == ldap.LDAPResultSuccess {
+				bound = dn
+			}
+			d.write(conn, id, ldapResult(ldap.ApplicationBindResponse, code))
+
+		case ldap.ApplicationSearchRequest:
+			if bound != d.serviceDN {
+				d.write(conn, id, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights))
+				continue
+			}
+
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				return
+			}
+			for _, e := range d.entries {
+				if filter == fmt.Sprintf(d.filter, ldap.EscapeFilter(e.mail)) {
+					d.write(conn, id, searchEntry(e))
+				}
+			}
+			d.write(conn, id, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+
+		case ldap.ApplicationExtendedRequest:
+			d.write(conn, id, ldapResult(ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess))
+			tlsConn := tls.Server(conn, d.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+
+		default:
+			return
+		}
+	}
+}
+
+func (d *fakeDirectory) write(conn net.Conn, id interface{}, op *ber.Packet) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+	packet.AppendChild(op)
+	conn.Write(packet.Bytes())
+}
+
+func (d *fakeDirectory) url(scheme string) string {
+	return scheme + "://" + d.ln.Addr().String()
+}
+
+// The ldapResult() function returns a response of the given type carrying
+// just a result code.
+func ldapResult(tag ber.Tag, code uint16) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return p
+}
+
+func searchEntry(e fakeEntry) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "Object Name"))
+
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for name, value := range map[string]string{"mail": e.mail, "cn": e.cn} {
+		if value == "" || (name == "mail" && e.hideMail) {
+			continue
+		}
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+		attr.AppendChild(values)
+		attrs.AppendChild(attr)
+	}
+	p.AppendChild(attrs)
+	return p
+}
+
+// The newTestTLSConfig() function returns a TLS config with a self-signed
+// certificate for 127.0.0.1.
+func newTestTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// The fakeUsers type records the identities it is asked to log in, and
+// gives each new one the next ID.
+type fakeUsers struct {
+	identities []*models.Identity
+	ids        map[string]int
+}
+
+func (u *fakeUsers) AuthenticateIdentity(ctx context.Context, identity *models.Identity, provision bool) (int, error) {
+	if !provision {
+		return 0, models.ErrNoRecord
+	}
+	if u.ids == nil {
+		u.ids = map[string]int{}
+	}
+	if _, ok := u.ids[identity.Subject]; !ok {
+		u.ids[identity.Subject] = len(u.ids) + 1
+	}
+	u.identities = append(u.identities, identity)
+	return u.ids[identity.Subject], nil
+}
+
+func TestAuthenticate(t *testing.T) {
+	for _, mode := range []string{"ldap", "ldaps", "starttls"} {
+		t.Run(mode, func(t *testing.T) {
+			d := newFakeDirectory(t, mode == "ldaps")
+
+			// Trust the directory's self-signed certificate.
+			roots := x509.NewCertPool()
+			cert, err := x509.ParseCertificate(d.tls.Certificates[0].Certificate[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			roots.AddCert(cert)
+
+			scheme := "ldap"
+			if mode == "ldaps" {
+				scheme = "ldaps"
+			}
+
+			users := &fakeUsers{}
+			a := &Authenticator{
+				URL:           d.url(scheme),
+				StartTLS:      mode == "starttls",
+				TLSConfig:     &tls.Config{RootCAs: roots},
+				BindDN:        d.serviceDN,
+				BindPassword:  d.servicePassword,
+				BaseDN:        "ou=people,dc=example,dc=com",
+				UserFilter:    d.filter,
+				NameAttribute: "cn",
+				Timeout:       5 * time.Second,
+				Users:         users,
+			}
+
+			tests := []struct {
+				name     string
+				email    string
+				password string
+				wantID   int
+				wantErr  error
+			}{
+				{"Valid", "alice@example.com", "alice-secret", 1, nil},
+				{"Valid again", "alice@example.com", "alice-secret", 1, nil},
+				{"Other user", "bob@example.com", "bob-secret", 2, nil},
+				{"Wrong password", "alice@example.com", "bob-secret", 0, models.ErrInvalidCredentials},
+				{"Empty password", "alice@example.com", "", 0, models.ErrInvalidCredentials},
+				{"Unknown user", "carol@example.com", "alice-secret", 0, models.ErrInvalidCredentials},
+				{"Ambiguous", "twin@example.com", "twin-secret", 0, models.ErrInvalidCredentials},
+				{"No mail attribute", "dave@example.com", "dave-secret", 0, models.ErrInvalidCredentials},
+				{"Filter injection", "*", "alice-secret", 0, models.ErrInvalidCredentials},
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					id, err := a.Authenticate(context.Background(), tt.email, tt.password, "127.0.0.1")
+					if id != tt.wantID || err != tt.wantErr {
+						t.Errorf("want %d, %v; got %d, %v", tt.wantID, tt.wantErr, id, err)
+					}
+				})
+			}
+
+			want := models.Identity{
+				Issuer:        a.URL,
+				Subject:       "uid=alice,ou=people,dc=example,dc=com",
+				Email:         "alice@example.com",
+				EmailVerified: true,
+				Name:          "Alice Jones",
+			}
+			if got := *users.identities[0]; got != want {
+				t.Errorf("want identity %+v; got %+v", want, got)
+			}
+			// Bob doesn't have a cn, so his email address is used instead.
+			if got := users.identities[2].Name; got != "bob@example.com" {
+				t.Errorf("want name %q; got %q", "bob@example.com", got)
+			}
+		})
+	}
+}
+
+func TestAuthenticateServiceBindFails(t *testing.T) {
+	d := newFakeDirectory(t, false)
+
+	a := &Authenticator{
+		URL:           d.url("ldap"),
+		BindDN:        d.serviceDN,
+		BindPassword:  "wrong",
+		BaseDN:        "ou=people,dc=example,dc=com",
+		UserFilter:    d.filter,
+		NameAttribute: "cn",
+		Timeout:       5 * time.Second,
+		Users:         &fakeUsers{},
+	}
+
+	// A misconfigured service account is our problem, not the user's, so it
+	// mustn't look like a wrong password.
+	_, err := a.Authenticate(context.Background(), "alice@example.com", "alice-secret", "127.0.0.1")
+	if err == nil || err == models.ErrInvalidCredentials {
+		t.Errorf("want service bind error; got %v", err)
+	}
+}
+
+func TestValidateFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		valid  bool
+	}{
+		{"(mail=%s)", true},
+		{"(&(objectClass=person)(mail=%s))", true},
+		{"(mail=alice)", false},
+		{"(|(mail=%s)(uid=%s))", false},
+		{"(mail=%d)", false},
+		{"(mail=%s", false},
+	}
+
+	for _, tt := range tests {
+		err := ValidateFilter(tt.filter)
+		if (err == nil) != tt.valid {
+			t.Errorf("%q: want valid %v; got %v", tt.filter, tt.valid, err)
+		}
+	}
+}
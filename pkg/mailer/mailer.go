@@ -0,0 +1,198 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain text email to a single recipient.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer is implemented by anything which can send an email. The application
+// only depends on this interface, so the SMTP mailer can be swapped for the
+// File mailer in development and the Memory mailer in tests.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// ErrInvalidHeader is returned if the recipient or subject contains a line
+// break, which could be used to inject extra headers into the message.
+var ErrInvalidHeader = errors.New("mailer: invalid header value")
+
+// SMTP is a Mailer which sends email through an SMTP server. If the server
+// supports STARTTLS the connection is upgraded before authenticating.
+type SMTP struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+// Send delivers the message to the SMTP server. The context's deadline, if
+// it has one, applies to the whole conversation with the server.
+func (m *SMTP) Send(ctx context.Context, msg Message) error {
+	data, err := format(m.From, msg, time.Now())
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(m.Addr)
+	if err != nil {
+		return err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", m.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+
+	if m.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.Username, m.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(address(m.From)); err != nil {
+		return err
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// File is a Mailer for development which writes each message to a .eml file
+// in Dir instead of sending it, so you can open it in a mail client (or just
+// read it) to follow the links.
+type File struct {
+	Dir  string
+	From string
+}
+
+// Send writes the message to a new file in m.Dir, creating the directory if
+// necessary.
+func (m *File) Send(ctx context.Context, msg Message) error {
+	now := time.Now()
+	data, err := format(m.From, msg, now)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(m.Dir, 0700); err != nil {
+		return err
+	}
+
+	b := make([]byte, 4)
+	rand.Read(b)
+	name := fmt.Sprintf("%s-%s.eml", now.UTC().Format("20060102T150405"), hex.EncodeToString(b))
+
+	return os.WriteFile(filepath.Join(m.Dir, name), data, 0600)
+}
+
+// Memory is a Mailer for tests which keeps the messages it is sent, so that
+// they can be inspected.
+type Memory struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+// Send records the message.
+func (m *Memory) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, err := format("", msg, time.Now()); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Messages returns a copy of the messages sent so far.
+func (m *Memory) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// The format() function renders the message in RFC 5322 format, with the
+// headers every mail server expects.
+func format(from string, msg Message, now time.Time) ([]byte, error) {
+	for _, v := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(v, "\r\n") {
+			return nil, ErrInvalidHeader
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "From: %s\r\n", from)
+	fmt.Fprintf(buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+
+	return buf.Bytes(), nil
+}
+
+// The address() function returns the bare email address from a From header
+// value like "Snippetbox <noreply@example.com>", for the SMTP envelope.
+func address(from string) string {
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return from
+	}
+	return addr.Address
+}
@@ -0,0 +1,66 @@
+package mailer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormat(t *testing.T) {
+	msg := Message{To: "alice@example.com", Subject: "Hello", Body: "Line one\nLine two\n"}
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	data, err := format("Snippetbox <no-reply@example.com>", msg, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"From: Snippetbox <no-reply@example.com>\r\n",
+		"To: alice@example.com\r\n",
+		"Subject: Hello\r\n",
+		"Date: Thu, 02 Jan 2020 03:04:05 +0000\r\n",
+		"\r\n\r\nLine one\r\nLine two\r\n",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("want message to contain %q; got %q", want, data)
+		}
+	}
+}
+
+func TestFormatHeaderInjection(t *testing.T) {
+	msg := Message{To: "alice@example.com\r\nBcc: eve@example.com", Subject: "Hello"}
+
+	if _, err := format("no-reply@example.com", msg, time.Now()); err != ErrInvalidHeader {
+		t.Errorf("want %v; got %v", ErrInvalidHeader, err)
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	m := &File{Dir: dir, From: "no-reply@example.com"}
+
+	err := m.Send(context.Background(), Message{To: "alice@example.com", Subject: "Hello", Body: "Hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("want 1 file; got %d", len(files))
+	}
+
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "To: alice@example.com\r\n") {
+		t.Errorf("want file to contain the message; got %q", data)
+	}
+}
@@ -0,0 +1,85 @@
+package mock
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"chilliweb.com/snippetbox/pkg/models"
+)
+
+// Unlike the other mocks, the CredentialModel keeps the credentials it is
+// given in memory, so that tests can register a passkey and then log in
+// with it.
+type CredentialModel struct {
+	mu          sync.Mutex
+	credentials []*models.Credential
+}
+
+func (m *CredentialModel) Insert(ctx context.Context, c *models.Credential) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored := *c
+	stored.Created = time.Now()
+	m.credentials = append(m.credentials, &stored)
+	return nil
+}
+
+func (m *CredentialModel) ForUser(ctx context.Context, userID int) ([]*models.Credential, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	credentials := []*models.Credential{}
+	for _, c := range m.credentials {
+		if c.UserID == userID {
+			copied := *c
+			credentials = append(credentials, &copied)
+		}
+	}
+	return credentials, nil
+}
+
+func (m *CredentialModel) RecordUse(ctx context.Context, id []byte, signCount uint32, backupState bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, c := range m.credentials {
+		if bytes.Equal(c.ID, id) {
+			c.SignCount = signCount
+			c.BackupState = backupState
+			c.LastUsed = time.Now()
+		}
+	}
+	return nil
+}
+
+func (m *CredentialModel) Delete(ctx context.Context, userID int, id []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, c := range m.credentials {
+		if c.UserID == userID && bytes.Equal(c.ID, id) {
+			m.credentials = append(m.credentials[:i], m.credentials[i+1:]...)
+			return nil
+		}
+	}
+	return models.ErrNoRecord
+}
@@ -0,0 +1,142 @@
+package mock
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"chilliweb.com/snippetbox/pkg/models"
+)
+
+// Like the SessionModel, the RememberTokenModel keeps its tokens in memory,
+// so that tests can log in with "remember me" and then come back with the
+// token. The validators are numbered rather than random.
+type RememberTokenModel struct {
+	mu       sync.Mutex
+	next     int
+	families map[string]*rememberFamily
+}
+
+type rememberFamily struct {
+	userID    int
+	sessionID string
+	validator string
+	previous  string
+	rotated   time.Time
+	expires   time.Time
+}
+
+func (m *RememberTokenModel) newValidator() string {
+	m.next++
+	return "validator-" + strconv.Itoa(m.next)
+}
+
+func (m *RememberTokenModel) Create(ctx context.Context, userID int, sessionID string, ttl time.Duration) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.families == nil {
+		m.families = map[string]*rememberFamily{}
+	}
+
+	selector := "selector-" + strconv.Itoa(len(m.families)+1)
+	f := &rememberFamily{userID: userID, sessionID: sessionID, validator: m.newValidator(), expires: time.Now().Add(ttl)}
+	m.families[selector] = f
+	return selector + "." + f.validator, nil
+}
+
+func (m *RememberTokenModel) Use(ctx context.Context, token string, ttl time.Duration) (*models.RememberedLogin, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	selector, validator, _ := strings.Cut(token, ".")
+	f, ok := m.families[selector]
+	if !ok || !f.expires.After(time.Now()) {
+		return nil, models.ErrInvalidToken
+	}
+
+	login := &models.RememberedLogin{UserID: f.userID, SessionID: f.sessionID}
+	switch {
+	case validator == f.validator:
+		f.previous, f.validator = f.validator, m.newValidator()
+		f.rotated = time.Now()
+		f.expires = time.Now().Add(ttl)
+		login.Token = selector + "." + f.validator
+		return login, nil
+	case validator == f.previous && time.Since(f.rotated) < time.Minute:
+		return login, nil
+	}
+
+	delete(m.families, selector)
+	return login, models.ErrTokenReused
+}
+
+func (m *RememberTokenModel) SetSession(ctx context.Context, token, sessionID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	selector, _, _ := strings.Cut(token, ".")
+	if f, ok := m.families[selector]; ok {
+		f.sessionID = sessionID
+	}
+	return nil
+}
+
+func (m *RememberTokenModel) Delete(ctx context.Context, token string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	selector, _, _ := strings.Cut(token, ".")
+	delete(m.families, selector)
+	return nil
+}
+
+func (m *RememberTokenModel) DeleteForSession(ctx context.Context, userID int, sessionID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for selector, f := range m.families {
+		if f.userID == userID && f.sessionID == sessionID {
+			delete(m.families, selector)
+		}
+	}
+	return nil
+}
+
+func (m *RememberTokenModel) DeleteForUser(ctx context.Context, userID int, keep string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for selector, f := range m.families {
+		if f.userID == userID && f.sessionID != keep {
+			delete(m.families, selector)
+		}
+	}
+	return nil
+}
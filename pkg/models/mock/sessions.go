@@ -0,0 +1,112 @@
+package mock
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"chilliweb.com/snippetbox/pkg/models"
+)
+
+// Like the CredentialModel, the SessionModel keeps its sessions in memory,
+// so that tests can log in and then list or revoke the session.
+type SessionModel struct {
+	mu       sync.Mutex
+	next     int
+	sessions []*models.Session
+}
+
+func (m *SessionModel) Create(ctx context.Context, userID int, ip, userAgent string, lifetime time.Duration) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.next++
+	now := time.Now()
+	s := &models.Session{
+		ID:        "session-" + strconv.Itoa(m.next),
+		UserID:    userID,
+		Created:   now,
+		LastSeen:  now,
+		Expires:   now.Add(lifetime),
+		IP:        ip,
+		UserAgent: userAgent,
+	}
+	m.sessions = append(m.sessions, s)
+	return s.ID, nil
+}
+
+func (m *SessionModel) Touch(ctx context.Context, userID int, id, ip string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range m.sessions {
+		if s.ID == id && s.UserID == userID && s.Expires.After(time.Now()) {
+			s.LastSeen = time.Now()
+			s.IP = ip
+			return nil
+		}
+	}
+	return models.ErrNoRecord
+}
+
+func (m *SessionModel) ForUser(ctx context.Context, userID int) ([]*models.Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sessions := []*models.Session{}
+	for _, s := range m.sessions {
+		if s.UserID == userID && s.Expires.After(time.Now()) {
+			copied := *s
+			sessions = append(sessions, &copied)
+		}
+	}
+	return sessions, nil
+}
+
+func (m *SessionModel) Revoke(ctx context.Context, userID int, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, s := range m.sessions {
+		if s.ID == id && s.UserID == userID {
+			m.sessions = append(m.sessions[:i], m.sessions[i+1:]...)
+			return nil
+		}
+	}
+	return models.ErrNoRecord
+}
+
+func (m *SessionModel) RevokeOthers(ctx context.Context, userID int, keep string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sessions := m.sessions[:0]
+	for _, s := range m.sessions {
+		if s.UserID != userID || s.ID == keep {
+			sessions = append(sessions, s)
+		}
+	}
+	m.sessions = sessions
+	return nil
+}
@@ -1,6 +1,8 @@
 package mock
 
 import (
+	"context"
+	"strings"
 	"time"
 
 	"chilliweb.com/snippetbox/pkg/models"
@@ -16,19 +18,58 @@ var mockSnippet = &models.Snippet{
 
 type SnippetModel struct{}
 
-func (m *SnippetModel) Insert(title, content, expires string) (int, error) {
+// The mocks behave like the real models when the context has already ended,
+// returning the context's error. Snippet 3 simulates a query which hits its
+// deadline.
+func (m *SnippetModel) Insert(ctx context.Context, title, content, expires string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
 	return 2, nil
 }
 
-func (m *SnippetModel) Get(id int) (*models.Snippet, error) {
+func (m *SnippetModel) Get(ctx context.Context, id int) (*models.Snippet, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	switch id {
 	case 1:
 		return mockSnippet, nil
+	case 3:
+		return nil, context.DeadlineExceeded
 	default:
 		return nil, models.ErrNoRecord
 	}
 }
 
-func (m *SnippetModel) Latest() ([]*models.Snippet, error) {
+func (m *SnippetModel) Latest(ctx context.Context) ([]*models.Snippet, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	return []*models.Snippet{mockSnippet}, nil
 }
+
+func (m *SnippetModel) Search(ctx context.Context, query string, limit int) ([]*models.Snippet, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if limit > 0 && (strings.Contains(mockSnippet.Title, query) || strings.Contains(mockSnippet.Content, query)) {
+		return []*models.Snippet{mockSnippet}, nil
+	}
+	return []*models.Snippet{}, nil
+}
+
+func (m *SnippetModel) Delete(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	switch id {
+	case 1:
+		return nil
+	default:
+		return models.ErrNoRecord
+	}
+}
@@ -0,0 +1,26 @@
+package mock
+
+import (
+	"context"
+
+	"chilliweb.com/snippetbox/pkg/models"
+)
+
+type StatsModel struct{}
+
+func (m *StatsModel) Get(ctx context.Context) (*models.Stats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return &models.Stats{
+		Users:         6,
+		ActiveUsers:   5,
+		VerifiedUsers: 5,
+		Moderators:    1,
+		Admins:        1,
+		Snippets:      1,
+		LiveSnippets:  1,
+		Sessions:      2,
+	}, nil
+}
@@ -1,43 +1,356 @@
 package mock
 
 import (
+	"context"
+	"strings"
 	"time"
 
 	"chilliweb.com/snippetbox/pkg/models"
 )
 
 var mockUser = &models.User{
-	ID:      1,
-	Name:    "Alice",
-	Email:   "alice@example.com",
+	ID:            1,
+	Name:          "Alice",
+	Email:         "alice@example.com",
+	Created:       time.Now(),
+	EmailVerified: true,
+	Role:          models.RoleUser,
+	Active:        true,
+}
+
+var mockUnverifiedUser = &models.User{
+	ID:      2,
+	Name:    "Bob",
+	Email:   "unverified@example.com",
 	Created: time.Now(),
+	Role:    models.RoleUser,
+	Active:  true,
+}
+
+var mockTOTPUser = &models.User{
+	ID:            3,
+	Name:          "Carol",
+	Email:         "totp@example.com",
+	Created:       time.Now(),
+	EmailVerified: true,
+	TOTPEnabled:   true,
+	Role:          models.RoleUser,
+	Active:        true,
+}
+
+var mockAdminUser = &models.User{
+	ID:            4,
+	Name:          "Dave",
+	Email:         "admin@example.com",
+	Created:       time.Now(),
+	EmailVerified: true,
+	Role:          models.RoleAdmin,
+	Active:        true,
+}
+
+var mockModeratorUser = &models.User{
+	ID:            5,
+	Name:          "Erin",
+	Email:         "moderator@example.com",
+	Created:       time.Now(),
+	EmailVerified: true,
+	Role:          models.RoleModerator,
+	Active:        true,
 }
 
+var mockDeactivatedUser = &models.User{
+	ID:            6,
+	Name:          "Frank",
+	Email:         "deactivated@example.com",
+	Created:       time.Now(),
+	EmailVerified: true,
+	Role:          models.RoleUser,
+}
+
+var mockLockedUser = &models.User{
+	ID:            7,
+	Name:          "Grace",
+	Email:         "locked@example.com",
+	Created:       time.Now(),
+	EmailVerified: true,
+	Role:          models.RoleUser,
+	Active:        true,
+	LockedUntil:   time.Now().Add(time.Hour),
+}
+
+var mockUsers = []*models.User{mockUser, mockUnverifiedUser, mockTOTPUser, mockAdminUser, mockModeratorUser, mockDeactivatedUser, mockLockedUser}
+
 type UserModel struct{}
 
-func (m *UserModel) Insert(name, email, password string) error {
+func (m *UserModel) Insert(ctx context.Context, name, email, password string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
 	switch email {
 	case "dupe@example.com":
-		return models.ErrDuplicateEmail
+		return 0, models.ErrDuplicateEmail
 	default:
-		return nil
+		return 2, nil
 	}
 }
 
-func (m *UserModel) Authenticate(email, password string) (int, error) {
+func (m *UserModel) Authenticate(ctx context.Context, email, password, ip string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
 	switch email {
 	case "alice@example.com":
 		return 1, nil
+	case "unverified@example.com":
+		return 2, nil
+	case "totp@example.com":
+		return 3, nil
+	case "admin@example.com":
+		return 4, nil
+	case "moderator@example.com":
+		return 5, nil
+	case "deactivated@example.com":
+		return 6, nil
+	case "locked@example.com":
+		return 0, models.ErrAccountLocked
 	default:
 		return 0, models.ErrInvalidCredentials
 	}
 }
 
-func (m *UserModel) Get(id int) (*models.User, error) {
+func (m *UserModel) Get(ctx context.Context, id int) (*models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	switch id {
 	case 1:
 		return mockUser, nil
+	case 2:
+		return mockUnverifiedUser, nil
+	case 3:
+		return mockTOTPUser, nil
+	case 4:
+		return mockAdminUser, nil
+	case 5:
+		return mockModeratorUser, nil
+	case 6:
+		return mockDeactivatedUser, nil
+	case 7:
+		return mockLockedUser, nil
 	default:
 		return nil, models.ErrNoRecord
 	}
 }
+
+func (m *UserModel) CreatePasswordReset(ctx context.Context, email string, ttl time.Duration) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	switch email {
+	case "alice@example.com":
+		return "valid-token", nil
+	default:
+		return "", models.ErrNoRecord
+	}
+}
+
+func (m *UserModel) ResetPassword(ctx context.Context, token, password string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	switch token {
+	case "valid-token":
+		return 1, nil
+	default:
+		return 0, models.ErrInvalidToken
+	}
+}
+
+func (m *UserModel) VerifyEmail(ctx context.Context, id int, email string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	switch {
+	case id == 1 && email == mockUser.Email, id == 2 && email == mockUnverifiedUser.Email:
+		return nil
+	default:
+		return models.ErrNoRecord
+	}
+}
+
+func (m *UserModel) UpdateName(ctx context.Context, id int, name string) error {
+	return ctx.Err()
+}
+
+func (m *UserModel) UpdateEmail(ctx context.Context, id int, password, email string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	switch {
+	case password != "validPa$$word":
+		return models.ErrInvalidCredentials
+	case email == "dupe@example.com":
+		return models.ErrDuplicateEmail
+	default:
+		return nil
+	}
+}
+
+func (m *UserModel) ChangePassword(ctx context.Context, id int, currentPassword, newPassword string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	switch currentPassword {
+	case "validPa$$word":
+		return nil
+	default:
+		return models.ErrInvalidCredentials
+	}
+}
+
+func (m *UserModel) EnableTOTP(ctx context.Context, id int, secret, code string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	switch code {
+	case "123456":
+		return []string{"abcde-fghij", "klmno-pqrst"}, nil
+	default:
+		return nil, models.ErrInvalidCredentials
+	}
+}
+
+func (m *UserModel) DisableTOTP(ctx context.Context, id int, password string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	switch password {
+	case "validPa$$word":
+		return nil
+	default:
+		return models.ErrInvalidCredentials
+	}
+}
+
+func (m *UserModel) AuthenticateTOTP(ctx context.Context, id int, code string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	switch {
+	case id == 3 && (code == "123456" || code == "abcde-fghij"):
+		return nil
+	default:
+		return models.ErrInvalidCredentials
+	}
+}
+
+func (m *UserModel) AuthenticateIdentity(ctx context.Context, identity *models.Identity, provision bool) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, u := range mockUsers {
+		if identity.Email == u.Email && identity.EmailVerified {
+			return u.ID, nil
+		} else if identity.Email == u.Email {
+			return 0, models.ErrDuplicateEmail
+		}
+	}
+
+	switch {
+	case provision && identity.EmailVerified:
+		return 2, nil
+	case provision:
+		return 0, models.ErrUnverifiedEmail
+	default:
+		return 0, models.ErrNoRecord
+	}
+}
+
+func (m *UserModel) CreateLoginToken(ctx context.Context, email string, ttl time.Duration) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	switch email {
+	case "alice@example.com":
+		return "valid-login-token", nil
+	case "totp@example.com":
+		return "totp-login-token", nil
+	default:
+		return "", models.ErrNoRecord
+	}
+}
+
+func (m *UserModel) ConsumeLoginToken(ctx context.Context, token string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	switch token {
+	case "valid-login-token":
+		return 1, nil
+	case "totp-login-token":
+		return 3, nil
+	default:
+		return 0, models.ErrInvalidToken
+	}
+}
+
+func (m *UserModel) Search(ctx context.Context, query string, limit int) ([]*models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	users := []*models.User{}
+	for _, u := range mockUsers {
+		if len(users) < limit && (strings.Contains(u.Name, query) || strings.Contains(u.Email, query)) {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+func (m *UserModel) SetRole(ctx context.Context, id int, role string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if id < 1 || id > len(mockUsers) {
+		return models.ErrNoRecord
+	}
+	return nil
+}
+
+func (m *UserModel) SetActive(ctx context.Context, id int, active bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if id < 1 || id > len(mockUsers) {
+		return models.ErrNoRecord
+	}
+	return nil
+}
+
+func (m *UserModel) UnlockID(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if id < 1 || id > len(mockUsers) {
+		return models.ErrNoRecord
+	}
+	return nil
+}
@@ -13,8 +13,51 @@ var (
 	// Add a new ErrDuplicateEmail error. We'll use this if a user
 	//. tries to signup with an em,ail address that's already in use.
 	ErrDuplicateEmail = errors.New("")
+	// Add a new ErrAccountLocked error. We'll use this if a user tries to
+	// login to an account which is locked after too many failed attempts.
+	ErrAccountLocked = errors.New("models: account is temporarily locked")
+	// Add a new ErrInvalidToken error. We'll use this if a user tries to use
+	// a password reset token which doesn't exist, has expired or has already
+	// been used.
+	ErrInvalidToken = errors.New("models: invalid or expired token")
+	// Add a new ErrTokenReused error. We'll use this if a "remember me"
+	// token is used with a validator which has already been replaced, which
+	// means someone has copied it.
+	ErrTokenReused = errors.New("models: remember me token reused")
+	// Add a new ErrUnverifiedEmail error. We'll use this if an identity
+	// provider asserts an email address it hasn't verified for a user who
+	// doesn't have an account yet, so we won't create one for it.
+	ErrUnverifiedEmail = errors.New("models: email address not verified")
 )
 
+// The roles a user can have. Moderators can look after the snippets, and
+// admins can also manage the users. Everyone starts as a plain user.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// The Roles are listed from least to most privileged, so that a role can do
+// everything the roles before it can.
+var Roles = []string{RoleUser, RoleModerator, RoleAdmin}
+
+// The roleRank() function returns the role's position in Roles, or -1 if it
+// isn't a role.
+func roleRank(role string) int {
+	for i, r := range Roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// ValidRole reports whether role is one of the Roles.
+func ValidRole(role string) bool {
+	return roleRank(role) >= 0
+}
+
 type Snippet struct {
 	ID      int
 	Title   string
@@ -29,4 +72,105 @@ type User struct {
 	Email          string
 	HashedPassword []byte
 	Created        time.Time
+	// Whether the user has followed the link in the verification email
+	// sent to their email address.
+	EmailVerified bool
+	// The time and IP address of the last successful login, if any.
+	LastLogin   time.Time
+	LastLoginIP string
+	// The session version is stored in the user's session when they log in,
+	// and incremented whenever their password changes. Sessions with an
+	// older version are no longer authenticated.
+	SessionVersion int
+	// Whether the user has turned on two-factor authentication, so that
+	// logging in also needs a code from their authenticator app.
+	TOTPEnabled bool
+	// The user's role, one of the Roles, and whether their account is
+	// active. Deactivated users can't log in.
+	Role   string
+	Active bool
+	// When the account's lockout after too many failed logins ends, or the
+	// zero time if it has never been locked.
+	LockedUntil time.Time
+}
+
+// Locked reports whether the account is currently locked after too many
+// failed logins.
+func (u *User) Locked() bool {
+	return time.Now().Before(u.LockedUntil)
+}
+
+// HasRole reports whether the user has the given role, or a more
+// privileged one.
+func (u *User) HasRole(role string) bool {
+	return roleRank(role) >= 0 && roleRank(u.Role) >= roleRank(role)
+}
+
+// A Credential is a WebAuthn public key credential (a passkey) which a user
+// has registered, and can log in with instead of their password.
+type Credential struct {
+	ID              []byte
+	UserID          int
+	Name            string
+	PublicKey       []byte
+	AttestationType string
+	AAGUID          []byte
+	Transports      []string
+	// The signature counter from the last time the credential was used. An
+	// authenticator which returns a counter which hasn't gone up may have
+	// been cloned.
+	SignCount uint32
+	// Whether the credential can be backed up (synced between devices), and
+	// whether it currently is.
+	BackupEligible bool
+	BackupState    bool
+	Created        time.Time
+	LastUsed       time.Time
+}
+
+// An Identity is a user's account at an external identity provider, as
+// asserted by the ID token from an OpenID Connect login. The issuer and
+// subject together identify the account; the email address and name are
+// only used to link or create the matching user.
+type Identity struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// A Session is one of a user's logged in sessions, as recorded in the
+// session registry. The ID is stored in the session cookie, and the IP
+// address and user agent are those of the session's most recent request.
+type Session struct {
+	ID        string
+	UserID    int
+	Created   time.Time
+	LastSeen  time.Time
+	Expires   time.Time
+	IP        string
+	UserAgent string
+}
+
+// A RememberedLogin is the result of using a "remember me" token: the user
+// it belongs to, the token which replaces it, and the ID of the session in
+// the registry which the token's family was last used to start. The token is
+// empty if the browser should keep the one it already has.
+type RememberedLogin struct {
+	UserID    int
+	Token     string
+	SessionID string
+}
+
+// Stats holds the counts shown on the admin dashboard.
+type Stats struct {
+	Users         int
+	ActiveUsers   int
+	VerifiedUsers int
+	Moderators    int
+	Admins        int
+	Snippets      int
+	LiveSnippets  int
+	Sessions      int
 }
@@ -0,0 +1,124 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"chilliweb.com/snippetbox/pkg/models"
+)
+
+// Define a CredentialModel type which wraps a sql.DB connection pool, and the
+// maximum time each query may take (DefaultTimeout if zero).
+type CredentialModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// The Insert method stores a newly registered credential.
+func (m *CredentialModel) Insert(ctx context.Context, c *models.Credential) error {
+	stmt := `INSERT INTO webauthn_credentials (id, user_id, name, public_key, attestation_type,
+	aaguid, transports, sign_count, backup_eligible, backup_state, created)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, UTC_TIMESTAMP())`
+
+	ctx, span := startSpan(ctx, "CredentialModel.Insert", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, stmt, c.ID, c.UserID, c.Name, c.PublicKey, c.AttestationType,
+		c.AAGUID, strings.Join(c.Transports, ","), c.SignCount, c.BackupEligible, c.BackupState)
+	if err != nil {
+		return spanError(span, err)
+	}
+	return nil
+}
+
+// The ForUser method returns all of the user's credentials, oldest first.
+func (m *CredentialModel) ForUser(ctx context.Context, userID int) ([]*models.Credential, error) {
+	stmt := `SELECT id, user_id, name, public_key, attestation_type, aaguid, transports,
+	sign_count, backup_eligible, backup_state, created, last_used
+	FROM webauthn_credentials WHERE user_id = ? ORDER BY created`
+
+	ctx, span := startSpan(ctx, "CredentialModel.ForUser", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, userID)
+	if err != nil {
+		return nil, spanError(span, err)
+	}
+	defer rows.Close()
+
+	credentials := []*models.Credential{}
+	for rows.Next() {
+		c := &models.Credential{}
+		var transports string
+		// The last used column is NULL until the credential is first used
+		// to log in.
+		var lastUsed sql.NullTime
+		err := rows.Scan(&c.ID, &c.UserID, &c.Name, &c.PublicKey, &c.AttestationType, &c.AAGUID,
+			&transports, &c.SignCount, &c.BackupEligible, &c.BackupState, &c.Created, &lastUsed)
+		if err != nil {
+			return nil, spanError(span, err)
+		}
+		if transports != "" {
+			c.Transports = strings.Split(transports, ",")
+		}
+		c.LastUsed = lastUsed.Time
+		credentials = append(credentials, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, spanError(span, err)
+	}
+
+	return credentials, nil
+}
+
+// The RecordUse method stores the signature counter and backup state from a
+// successful login with the credential, along with the time it was used.
+func (m *CredentialModel) RecordUse(ctx context.Context, id []byte, signCount uint32, backupState bool) error {
+	stmt := `UPDATE webauthn_credentials SET sign_count = ?, backup_state = ?,
+	last_used = UTC_TIMESTAMP() WHERE id = ?`
+
+	ctx, span := startSpan(ctx, "CredentialModel.RecordUse", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	if _, err := m.DB.ExecContext(ctx, stmt, signCount, backupState, id); err != nil {
+		return spanError(span, err)
+	}
+	return nil
+}
+
+// The Delete method removes one of the user's credentials. It returns
+// ErrNoRecord if the user doesn't have a credential with the given ID.
+func (m *CredentialModel) Delete(ctx context.Context, userID int, id []byte) error {
+	stmt := "DELETE FROM webauthn_credentials WHERE user_id = ? AND id = ?"
+
+	ctx, span := startSpan(ctx, "CredentialModel.Delete", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, stmt, userID, id)
+	if err != nil {
+		return spanError(span, err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return spanError(span, err)
+	}
+	if n == 0 {
+		return models.ErrNoRecord
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package mysql
+
+import "time"
+
+// Lockout is the policy for locking accounts after repeated failed logins.
+// Once an account has had Threshold failed logins in a row it is locked for
+// Duration, and each further failure after the lock expires doubles the lock
+// period, up to MaxDuration. A successful login resets the count. If
+// Threshold is zero, accounts are never locked.
+type Lockout struct {
+	Threshold   int
+	Duration    time.Duration
+	MaxDuration time.Duration
+}
+
+// The duration() method returns how long to lock an account for after the
+// given number of consecutive failed logins, or zero if it shouldn't be
+// locked.
+func (l Lockout) duration(failures int) time.Duration {
+	if l.Threshold <= 0 || failures < l.Threshold {
+		return 0
+	}
+
+	d := l.Duration
+	for i := l.Threshold; i < failures && d < l.MaxDuration; i++ {
+		d *= 2
+	}
+	if l.MaxDuration > 0 && d > l.MaxDuration {
+		d = l.MaxDuration
+	}
+	return d
+}
@@ -0,0 +1,35 @@
+package mysql
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	l := Lockout{Threshold: 3, Duration: time.Minute, MaxDuration: 10 * time.Minute}
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Minute},
+		{4, 2 * time.Minute},
+		{5, 4 * time.Minute},
+		{6, 8 * time.Minute},
+		{7, 10 * time.Minute},
+		{100, 10 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := l.duration(tt.failures); got != tt.want {
+			t.Errorf("%d failures: want %s; got %s", tt.failures, tt.want, got)
+		}
+	}
+
+	// A zero threshold disables lockout.
+	if got := (Lockout{}).duration(100); got != 0 {
+		t.Errorf("want 0; got %s", got)
+	}
+}
@@ -0,0 +1,227 @@
+package mysql
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"chilliweb.com/snippetbox/pkg/models"
+)
+
+// Define a RememberTokenModel type which wraps a sql.DB connection pool, and
+// the maximum time each query may take (DefaultTimeout if zero). It keeps
+// the "remember me" tokens which log users back in when their session has
+// expired.
+//
+// A token is a selector and a validator, separated by a dot. The selector
+// identifies the token family, which starts when the user logs in with
+// "remember me" ticked, and stays the same. The validator is replaced each
+// time the token is used, and only its hash is stored. If a validator which
+// has been replaced is used again, someone has copied the token, so the
+// whole family is deleted.
+type RememberTokenModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// The validator which has just been replaced is still accepted for this
+// long, so that requests the browser sent at the same time as the one which
+// used the token don't look like theft.
+const rememberGracePeriod = time.Minute
+
+// The newSelector() function generates a random 96-bit token selector.
+func newSelector() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// The splitRememberToken() function returns the selector and validator in a
+// token, or false if it isn't well formed.
+func splitRememberToken(token string) (string, string, bool) {
+	selector, validator, ok := strings.Cut(token, ".")
+	if !ok || selector == "" || validator == "" {
+		return "", "", false
+	}
+	return selector, validator, true
+}
+
+// The Create method starts a new token family for the user's logged in
+// session with the given ID, which expires after ttl unless it is used, and
+// returns the token.
+func (m *RememberTokenModel) Create(ctx context.Context, userID int, sessionID string, ttl time.Duration) (string, error) {
+	stmt := `INSERT INTO remember_tokens (selector, validator_hash, user_id, session_id, created, expires)
+	VALUES (?, ?, ?, ?, UTC_TIMESTAMP(), ?)`
+
+	ctx, span := startSpan(ctx, "RememberTokenModel.Create", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	selector, validator := newSelector(), newToken()
+	expires := time.Now().UTC().Add(ttl)
+
+	_, err := m.DB.ExecContext(ctx, stmt, selector, hashToken(validator), userID, sessionID, expires)
+	if err != nil {
+		return "", spanError(span, err)
+	}
+
+	return selector + "." + validator, nil
+}
+
+// The Use method checks a token and returns the login it is for, with the
+// replacement token, which is valid for another ttl. If the token's
+// validator was replaced within the grace period the replacement is the
+// empty string, and the browser should keep the token it already has. An
+// unknown, expired or malformed token returns models.ErrInvalidToken, and one
+// which has been used before returns models.ErrTokenReused, after deleting
+// its family. The login is still returned in that case, without a token,
+// because whoever used the token last may have stolen it, and the session
+// they started should be revoked too.
+func (m *RememberTokenModel) Use(ctx context.Context, token string, ttl time.Duration) (*models.RememberedLogin, error) {
+	stmt := `SELECT user_id, session_id, validator_hash, COALESCE(previous_validator_hash, ''),
+	COALESCE(rotated > UTC_TIMESTAMP() - INTERVAL ? SECOND, FALSE)
+	FROM remember_tokens WHERE selector = ? AND expires > UTC_TIMESTAMP() FOR UPDATE`
+
+	ctx, span := startSpan(ctx, "RememberTokenModel.Use", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	selector, validator, ok := splitRememberToken(token)
+	if !ok {
+		return nil, models.ErrInvalidToken
+	}
+
+	// Use a transaction, with the family's row locked, so that two requests
+	// with the same token can't both replace it.
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, spanError(span, err)
+	}
+	defer tx.Rollback()
+
+	login := &models.RememberedLogin{}
+	var current, previous string
+	var inGracePeriod bool
+	err = tx.QueryRowContext(ctx, stmt, int(rememberGracePeriod.Seconds()), selector).Scan(&login.UserID, &login.SessionID, &current, &previous, &inGracePeriod)
+	if err == sql.ErrNoRows {
+		return nil, models.ErrInvalidToken
+	} else if err != nil {
+		return nil, spanError(span, err)
+	}
+
+	hash := hashToken(validator)
+	switch {
+	case subtle.ConstantTimeCompare([]byte(hash), []byte(current)) == 1:
+		next := newToken()
+		_, err = tx.ExecContext(ctx, `UPDATE remember_tokens SET validator_hash = ?,
+		previous_validator_hash = ?, rotated = UTC_TIMESTAMP(), expires = ? WHERE selector = ?`,
+			hashToken(next), current, time.Now().UTC().Add(ttl), selector)
+		if err != nil {
+			return nil, spanError(span, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, spanError(span, err)
+		}
+		login.Token = selector + "." + next
+		return login, nil
+	case inGracePeriod && subtle.ConstantTimeCompare([]byte(hash), []byte(previous)) == 1:
+		return login, nil
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM remember_tokens WHERE selector = ?", selector)
+	if err != nil {
+		return nil, spanError(span, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, spanError(span, err)
+	}
+	return login, models.ErrTokenReused
+}
+
+// The SetSession method records the ID of the logged in session which the
+// token's family was last used to start, so that revoking the session also
+// deletes the family.
+func (m *RememberTokenModel) SetSession(ctx context.Context, token, sessionID string) error {
+	stmt := "UPDATE remember_tokens SET session_id = ? WHERE selector = ?"
+
+	ctx, span := startSpan(ctx, "RememberTokenModel.SetSession", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	selector, _, ok := splitRememberToken(token)
+	if !ok {
+		return models.ErrInvalidToken
+	}
+
+	if _, err := m.DB.ExecContext(ctx, stmt, sessionID, selector); err != nil {
+		return spanError(span, err)
+	}
+	return nil
+}
+
+// The Delete method deletes the family of the given token, when the user
+// logs out.
+func (m *RememberTokenModel) Delete(ctx context.Context, token string) error {
+	stmt := "DELETE FROM remember_tokens WHERE selector = ?"
+
+	ctx, span := startSpan(ctx, "RememberTokenModel.Delete", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	selector, _, ok := splitRememberToken(token)
+	if !ok {
+		return nil
+	}
+
+	if _, err := m.DB.ExecContext(ctx, stmt, selector); err != nil {
+		return spanError(span, err)
+	}
+	return nil
+}
+
+// The DeleteForSession method deletes the user's token families which
+// belong to the logged in session with the given ID.
+func (m *RememberTokenModel) DeleteForSession(ctx context.Context, userID int, sessionID string) error {
+	stmt := "DELETE FROM remember_tokens WHERE user_id = ? AND session_id = ?"
+
+	ctx, span := startSpan(ctx, "RememberTokenModel.DeleteForSession", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	if _, err := m.DB.ExecContext(ctx, stmt, userID, sessionID); err != nil {
+		return spanError(span, err)
+	}
+	return nil
+}
+
+// The DeleteForUser method deletes all of the user's token families except
+// the one belonging to the logged in session with the ID keep. If keep is
+// empty, all of them are deleted.
+func (m *RememberTokenModel) DeleteForUser(ctx context.Context, userID int, keep string) error {
+	stmt := "DELETE FROM remember_tokens WHERE user_id = ? AND session_id <> ?"
+
+	ctx, span := startSpan(ctx, "RememberTokenModel.DeleteForUser", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	if _, err := m.DB.ExecContext(ctx, stmt, userID, keep); err != nil {
+		return spanError(span, err)
+	}
+	return nil
+}
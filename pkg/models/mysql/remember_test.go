@@ -0,0 +1,97 @@
+package mysql
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"chilliweb.com/snippetbox/pkg/models"
+)
+
+func TestRememberTokenModel(t *testing.T) {
+	if testing.Short() {
+		t.Skip("mysql: skipping integration test")
+	}
+
+	db, teardown := newTestDB(t)
+	defer teardown()
+
+	ctx := context.Background()
+	m := RememberTokenModel{DB: db}
+
+	for _, token := range []string{"", "nodot", "unknown.validator"} {
+		if _, err := m.Use(ctx, token, time.Hour); err != models.ErrInvalidToken {
+			t.Errorf("%q: want %v; got %v", token, models.ErrInvalidToken, err)
+		}
+	}
+
+	first, err := m.Create(ctx, 1, "session-1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login, err := m.Use(ctx, first, time.Hour)
+	if err != nil || login.UserID != 1 || login.SessionID != "session-1" || login.Token == "" || login.Token == first {
+		t.Fatalf("want 1, session-1, a new token, nil; got %+v, %v", login, err)
+	}
+	second := login.Token
+
+	// The replaced token still works for a moment, without being replaced
+	// again.
+	login, err = m.Use(ctx, first, time.Hour)
+	if err != nil || login.UserID != 1 || login.Token != "" {
+		t.Errorf("grace period: want 1, \"\", nil; got %+v, %v", login, err)
+	}
+
+	// After the grace period, using it again revokes the family.
+	_, err = db.Exec("UPDATE remember_tokens SET rotated = UTC_TIMESTAMP() - INTERVAL 1 HOUR")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// It returns the session the family was last used to start, so that
+	// it can be revoked.
+	if err := m.SetSession(ctx, second, "session-2"); err != nil {
+		t.Fatal(err)
+	}
+	login, err = m.Use(ctx, first, time.Hour)
+	if err != models.ErrTokenReused || login.UserID != 1 || login.SessionID != "session-2" {
+		t.Errorf("reused token: want 1, session-2, %v; got %+v, %v", models.ErrTokenReused, login, err)
+	}
+	if _, err := m.Use(ctx, second, time.Hour); err != models.ErrInvalidToken {
+		t.Errorf("revoked family: want %v; got %v", models.ErrInvalidToken, err)
+	}
+
+	expired, err := m.Create(ctx, 1, "session-2", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Use(ctx, expired, time.Hour); err != models.ErrInvalidToken {
+		t.Errorf("expired token: want %v; got %v", models.ErrInvalidToken, err)
+	}
+
+	kept, err := m.Create(ctx, 1, "session-3", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := m.Create(ctx, 1, "session-4", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetSession(ctx, other, "session-5"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DeleteForSession(ctx, 1, "session-5"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Use(ctx, other, time.Hour); err != models.ErrInvalidToken {
+		t.Errorf("deleted session's token: want %v; got %v", models.ErrInvalidToken, err)
+	}
+
+	if err := m.DeleteForUser(ctx, 1, "session-3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Use(ctx, kept, time.Hour); err != nil {
+		t.Errorf("kept token: want nil; got %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"chilliweb.com/snippetbox/pkg/models"
+)
+
+// Define a SessionModel type which wraps a sql.DB connection pool, and the
+// maximum time each query may take (DefaultTimeout if zero). It keeps the
+// registry of logged in sessions, so that users can see where they are
+// logged in and log other devices out.
+type SessionModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// The user agent column is limited to 255 characters, so longer ones are
+// cut short.
+const maxUserAgentLength = 255
+
+// The Create method registers a new session for the user, which expires
+// after lifetime, and returns its ID. The user's expired sessions are
+// deleted at the same time, so that the registry doesn't grow forever.
+func (m *SessionModel) Create(ctx context.Context, userID int, ip, userAgent string, lifetime time.Duration) (string, error) {
+	stmt := `INSERT INTO user_sessions (id, user_id, created, last_seen, expires, ip, user_agent)
+	VALUES (?, ?, UTC_TIMESTAMP(), UTC_TIMESTAMP(), ?, ?, ?)`
+
+	ctx, span := startSpan(ctx, "SessionModel.Create", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, "DELETE FROM user_sessions WHERE user_id = ? AND expires <= UTC_TIMESTAMP()", userID)
+	if err != nil {
+		return "", spanError(span, err)
+	}
+
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	id := newToken()
+	expires := time.Now().UTC().Add(lifetime)
+
+	_, err = m.DB.ExecContext(ctx, stmt, id, userID, expires, ip, userAgent)
+	if err != nil {
+		return "", spanError(span, err)
+	}
+
+	return id, nil
+}
+
+// The Touch method checks that the user's session with the given ID still
+// exists and hasn't expired, returning models.ErrNoRecord if it doesn't,
+// and records that it has been seen from ip. To save a write on every
+// request, the last seen time is only updated once a minute.
+func (m *SessionModel) Touch(ctx context.Context, userID int, id, ip string) error {
+	stmt := `SELECT last_seen, ip FROM user_sessions
+	WHERE id = ? AND user_id = ? AND expires > UTC_TIMESTAMP()`
+
+	ctx, span := startSpan(ctx, "SessionModel.Touch", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var lastSeen time.Time
+	var lastIP string
+	err := m.DB.QueryRowContext(ctx, stmt, id, userID).Scan(&lastSeen, &lastIP)
+	if err == sql.ErrNoRows {
+		return models.ErrNoRecord
+	} else if err != nil {
+		return spanError(span, err)
+	}
+
+	if time.Since(lastSeen) < time.Minute && lastIP == ip {
+		return nil
+	}
+
+	_, err = m.DB.ExecContext(ctx, "UPDATE user_sessions SET last_seen = UTC_TIMESTAMP(), ip = ? WHERE id = ?", ip, id)
+	if err != nil {
+		return spanError(span, err)
+	}
+	return nil
+}
+
+// The ForUser method returns the user's sessions which haven't expired,
+// most recently seen first.
+func (m *SessionModel) ForUser(ctx context.Context, userID int) ([]*models.Session, error) {
+	stmt := `SELECT id, user_id, created, last_seen, expires, ip, user_agent
+	FROM user_sessions WHERE user_id = ? AND expires > UTC_TIMESTAMP()
+	ORDER BY last_seen DESC`
+
+	ctx, span := startSpan(ctx, "SessionModel.ForUser", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, userID)
+	if err != nil {
+		return nil, spanError(span, err)
+	}
+	defer rows.Close()
+
+	sessions := []*models.Session{}
+	for rows.Next() {
+		s := &models.Session{}
+		err := rows.Scan(&s.ID, &s.UserID, &s.Created, &s.LastSeen, &s.Expires, &s.IP, &s.UserAgent)
+		if err != nil {
+			return nil, spanError(span, err)
+		}
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, spanError(span, err)
+	}
+
+	return sessions, nil
+}
+
+// The Revoke method deletes one of the user's sessions, so that the cookie
+// for it is no longer authenticated. It returns models.ErrNoRecord if the
+// user doesn't have a session with that ID.
+func (m *SessionModel) Revoke(ctx context.Context, userID int, id string) error {
+	stmt := "DELETE FROM user_sessions WHERE id = ? AND user_id = ?"
+
+	ctx, span := startSpan(ctx, "SessionModel.Revoke", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, stmt, id, userID)
+	if err != nil {
+		return spanError(span, err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return spanError(span, err)
+	}
+	if n == 0 {
+		return models.ErrNoRecord
+	}
+	return nil
+}
+
+// The RevokeOthers method deletes all of the user's sessions except the one
+// with the ID keep. If keep is empty, all of their sessions are deleted.
+func (m *SessionModel) RevokeOthers(ctx context.Context, userID int, keep string) error {
+	stmt := "DELETE FROM user_sessions WHERE user_id = ? AND id <> ?"
+
+	ctx, span := startSpan(ctx, "SessionModel.RevokeOthers", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	if _, err := m.DB.ExecContext(ctx, stmt, userID, keep); err != nil {
+		return spanError(span, err)
+	}
+	return nil
+}
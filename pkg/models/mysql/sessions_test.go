@@ -0,0 +1,135 @@
+package mysql
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"chilliweb.com/snippetbox/pkg/models"
+)
+
+func TestSessionModel(t *testing.T) {
+	if testing.Short() {
+		t.Skip("mysql: skipping integration test")
+	}
+
+	db, teardown := newTestDB(t)
+	defer teardown()
+
+	ctx := context.Background()
+	m := SessionModel{DB: db}
+
+	expired, err := m.Create(ctx, 1, "192.0.2.1", "Expired", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Touch(ctx, 1, expired, "192.0.2.1"); err != models.ErrNoRecord {
+		t.Errorf("expired session: want %v; got %v", models.ErrNoRecord, err)
+	}
+
+	first, err := m.Create(ctx, 1, "192.0.2.1", "Firefox", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := m.Create(ctx, 1, "192.0.2.2", "Chrome", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Touch(ctx, 1, first, "192.0.2.3"); err != nil {
+		t.Errorf("want nil; got %v", err)
+	}
+	// Another user can't use the session.
+	if err := m.Touch(ctx, 2, first, "192.0.2.3"); err != models.ErrNoRecord {
+		t.Errorf("other user: want %v; got %v", models.ErrNoRecord, err)
+	}
+
+	sessions, err := m.ForUser(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("want 2 sessions; got %d", len(sessions))
+	}
+	for _, s := range sessions {
+		if s.ID == first && s.IP != "192.0.2.3" {
+			t.Errorf("want IP %q; got %q", "192.0.2.3", s.IP)
+		}
+	}
+
+	if err := m.Revoke(ctx, 2, first); err != models.ErrNoRecord {
+		t.Errorf("other user: want %v; got %v", models.ErrNoRecord, err)
+	}
+	if err := m.Revoke(ctx, 1, first); err != nil {
+		t.Errorf("want nil; got %v", err)
+	}
+	if err := m.Touch(ctx, 1, first, "192.0.2.1"); err != models.ErrNoRecord {
+		t.Errorf("revoked session: want %v; got %v", models.ErrNoRecord, err)
+	}
+
+	third, err := m.Create(ctx, 1, "192.0.2.1", "Safari", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RevokeOthers(ctx, 1, third); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Touch(ctx, 1, second, "192.0.2.2"); err != models.ErrNoRecord {
+		t.Errorf("other session: want %v; got %v", models.ErrNoRecord, err)
+	}
+	if err := m.Touch(ctx, 1, third, "192.0.2.1"); err != nil {
+		t.Errorf("kept session: want nil; got %v", err)
+	}
+}
+
+func TestSessionStore(t *testing.T) {
+	if testing.Short() {
+		t.Skip("mysql: skipping integration test")
+	}
+
+	db, teardown := newTestDB(t)
+	defer teardown()
+
+	ctx := context.Background()
+	s := SessionStore{DB: db}
+
+	if _, found, err := s.Find(ctx, "unknown"); found || err != nil {
+		t.Errorf("unknown token: want false, nil; got %t, %v", found, err)
+	}
+
+	if err := s.Commit(ctx, "live", []byte("first"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Commit(ctx, "live", []byte("second"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	data, found, err := s.Find(ctx, "live")
+	if !found || err != nil || string(data) != "second" {
+		t.Errorf("want %q, true, nil; got %q, %t, %v", "second", data, found, err)
+	}
+
+	if err := s.Commit(ctx, "expired", []byte("old"), time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := s.Find(ctx, "expired"); found {
+		t.Error("expired token: want not found")
+	}
+
+	if err := s.DeleteExpired(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("want 1 session after cleanup; got %d", n)
+	}
+
+	if err := s.Delete(ctx, "live"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := s.Find(ctx, "live"); found {
+		t.Error("deleted token: want not found")
+	}
+}
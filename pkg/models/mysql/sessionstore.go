@@ -0,0 +1,88 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Define a SessionStore type which wraps a sql.DB connection pool, and the
+// maximum time each query may take (DefaultTimeout if zero). It keeps the
+// data for the session manager (see the session package), so that sessions
+// are shared between instances and survive restarts. Only the hashes of the
+// tokens are stored, so the sessions can't be taken over by someone who can
+// read the table.
+type SessionStore struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// The Find method returns the data for the session with the given token,
+// or false if there isn't one or it has expired.
+func (s *SessionStore) Find(ctx context.Context, token string) ([]byte, bool, error) {
+	stmt := "SELECT data FROM sessions WHERE token_hash = ? AND expiry > UTC_TIMESTAMP(6)"
+
+	ctx, span := startSpan(ctx, "SessionStore.Find", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	var data []byte
+	err := s.DB.QueryRowContext(ctx, stmt, hashToken(token)).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, spanError(span, err)
+	}
+	return data, true, nil
+}
+
+// The Commit method adds or replaces the session with the given token.
+func (s *SessionStore) Commit(ctx context.Context, token string, data []byte, expiry time.Time) error {
+	stmt := `INSERT INTO sessions (token_hash, data, expiry) VALUES (?, ?, ?)
+	ON DUPLICATE KEY UPDATE data = VALUES(data), expiry = VALUES(expiry)`
+
+	ctx, span := startSpan(ctx, "SessionStore.Commit", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	if _, err := s.DB.ExecContext(ctx, stmt, hashToken(token), data, expiry.UTC()); err != nil {
+		return spanError(span, err)
+	}
+	return nil
+}
+
+// The Delete method deletes the session with the given token, if it exists.
+func (s *SessionStore) Delete(ctx context.Context, token string) error {
+	stmt := "DELETE FROM sessions WHERE token_hash = ?"
+
+	ctx, span := startSpan(ctx, "SessionStore.Delete", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	if _, err := s.DB.ExecContext(ctx, stmt, hashToken(token)); err != nil {
+		return spanError(span, err)
+	}
+	return nil
+}
+
+// The DeleteExpired method deletes all of the sessions which have expired.
+func (s *SessionStore) DeleteExpired(ctx context.Context) error {
+	stmt := "DELETE FROM sessions WHERE expiry <= UTC_TIMESTAMP(6)"
+
+	ctx, span := startSpan(ctx, "SessionStore.DeleteExpired", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	if _, err := s.DB.ExecContext(ctx, stmt); err != nil {
+		return spanError(span, err)
+	}
+	return nil
+}
@@ -1,37 +1,48 @@
 package mysql
 
 import (
+	"context"
 	"database/sql"
+	"strings"
+	"time"
 
 	"chilliweb.com/snippetbox/pkg/models"
 )
 
-// Define a SnippetModel type which wraps a sql.DB connection pool.
+// Define a SnippetModel type which wraps a sql.DB connection pool, and the
+// maximum time each query may take (DefaultTimeout if zero).
 type SnippetModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Timeout time.Duration
 }
 
 // This will insert a new snippet into the database
-func (m *SnippetModel) Insert(title, content, expires string) (int, error) {
+func (m *SnippetModel) Insert(ctx context.Context, title, content, expires string) (int, error) {
 	// Create the SQL statement we want to execute. It's split over several lines
 	// for readability - so it's surrounded by backquotes instead of normal double quotes
 	stmt := `INSERT INTO snippets (title, content, created, expires)
 	values (?, ?, UTC_TIMESTAMP(), DATE_ADD(UTC_TIMESTAMP, INTERVAL ? DAY))`
 
-	// Use the Exec() method on the embedded connection pool to execute the statement.
-	// The first parameter is the SQL statement followed by the table fields.
-	// The method returns a sql.Result object which contains some basic information
-	// about what happened when the statement was executed
-	result, err := m.DB.Exec(stmt, title, content, expires)
+	ctx, span := startSpan(ctx, "SnippetModel.Insert", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	// Use the ExecContext() method on the embedded connection pool to execute the statement.
+	// The first parameter is the request context, then the SQL statement followed by the
+	// table fields. The method returns a sql.Result object which contains some basic
+	// information about what happened when the statement was executed
+	result, err := m.DB.ExecContext(ctx, stmt, title, content, expires)
 	if err != nil {
-		return 0, err
+		return 0, spanError(span, err)
 	}
 
 	// Use the LastInsertId() method on the result object to get the ID of our
 	// newly inserted record in the snippets table.
 	id, err := result.LastInsertId()
 	if err != nil {
-		return 0, err
+		return 0, spanError(span, err)
 	}
 
 	// The ID returned has the type int64 so we convert it to an int type before returning
@@ -39,17 +50,23 @@ func (m *SnippetModel) Insert(title, content, expires string) (int, error) {
 }
 
 // This will return a specific snippet based on its id.
-func (m *SnippetModel) Get(id int) (*models.Snippet, error) {
+func (m *SnippetModel) Get(ctx context.Context, id int) (*models.Snippet, error) {
 	// Create the SQL statement to execute
 	// Split over 2 lines for readibility
 	stmt := `SELECT id, title, content, created, expires FROM snippets 
 	WHERE expires > UTC_TIMESTAMP() AND id =?`
 
-	// Use the QueryRow() method on the comnnection pool to execute our
+	ctx, span := startSpan(ctx, "SnippetModel.Get", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	// Use the QueryRowContext() method on the comnnection pool to execute our
 	// SQL statement, passing in the untrusted id variable as the value for the
 	// placeholder parameter. This returns a pointer to a sql.Row object which
 	// holds the result set from the database.
-	row := m.DB.QueryRow(stmt, id)
+	row := m.DB.QueryRowContext(ctx, stmt, id)
 
 	// Initialize a pointer to a new zeroed Snippet struct.
 	s := &models.Snippet{}
@@ -65,7 +82,7 @@ func (m *SnippetModel) Get(id int) (*models.Snippet, error) {
 	if err == sql.ErrNoRows {
 		return nil, models.ErrNoRecord
 	} else if err != nil {
-		return nil, err
+		return nil, spanError(span, err)
 	}
 
 	// If everything went OK then return the Snippet object.
@@ -84,16 +101,22 @@ func (m *SnippetModel) Get(id int) (*models.Snippet, error) {
 }
 
 // This will return the 10 latest snippets
-func (m *SnippetModel) Latest() ([]*models.Snippet, error) {
+func (m *SnippetModel) Latest(ctx context.Context) ([]*models.Snippet, error) {
 	// The SQL query that we want to execute.
 	stmt := `SELECT id, title, content, created, expires FROM snippets 
 	WHERE expires > UTC_TIMESTAMP() ORDER BY created DESC LIMIT 10`
 
-	// Use the Query() method on the connection pool to execute our SQL statement.
+	ctx, span := startSpan(ctx, "SnippetModel.Latest", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	// Use the QueryContext() method on the connection pool to execute our SQL statement.
 	// This returns a sql.Rows resultset containing the result of the query
-	rows, err := m.DB.Query(stmt)
+	rows, err := m.DB.QueryContext(ctx, stmt)
 	if err != nil {
-		return nil, err
+		return nil, spanError(span, err)
 	}
 
 	// We defer rows.CLose() to ensure the sql.Rows resultset is always properly
@@ -121,7 +144,7 @@ func (m *SnippetModel) Latest() ([]*models.Snippet, error) {
 		// columns returned by the statement.
 		err = rows.Scan(&s.ID, &s.Title, &s.Content, &s.Created, &s.Expires)
 		if err != nil {
-			return nil, err
+			return nil, spanError(span, err)
 		}
 		// Append it to the slice of snippets.
 		snippets = append(snippets, s)
@@ -132,9 +155,77 @@ func (m *SnippetModel) Latest() ([]*models.Snippet, error) {
 	// call this - don't assume that a successful iteration was completed
 	// over the whole resultset.
 	if err = rows.Err(); err != nil {
-		return nil, err
+		return nil, spanError(span, err)
 	}
 
 	// If everything went OK, return the snippers slice
 	return snippets, nil
 }
+
+// The containsPattern() function returns a LIKE pattern which matches values
+// containing s, with any wildcards in s escaped so that they match
+// themselves.
+func containsPattern(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+	return "%" + s + "%"
+}
+
+// The Search method returns up to limit snippets whose title or content
+// contains query, or the most recent snippets if query is empty, newest
+// first. Unlike Latest, it includes snippets which have expired.
+func (m *SnippetModel) Search(ctx context.Context, query string, limit int) ([]*models.Snippet, error) {
+	stmt := `SELECT id, title, content, created, expires FROM snippets
+	WHERE title LIKE ? OR content LIKE ? ORDER BY id DESC LIMIT ?`
+
+	ctx, span := startSpan(ctx, "SnippetModel.Search", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	pattern := containsPattern(query)
+	rows, err := m.DB.QueryContext(ctx, stmt, pattern, pattern, limit)
+	if err != nil {
+		return nil, spanError(span, err)
+	}
+	defer rows.Close()
+
+	snippets := []*models.Snippet{}
+	for rows.Next() {
+		s := &models.Snippet{}
+		if err := rows.Scan(&s.ID, &s.Title, &s.Content, &s.Created, &s.Expires); err != nil {
+			return nil, spanError(span, err)
+		}
+		snippets = append(snippets, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, spanError(span, err)
+	}
+
+	return snippets, nil
+}
+
+// The Delete method deletes the snippet with the given ID, whether or not
+// it has expired. It returns ErrNoRecord if there's no such snippet.
+func (m *SnippetModel) Delete(ctx context.Context, id int) error {
+	stmt := "DELETE FROM snippets WHERE id = ?"
+
+	ctx, span := startSpan(ctx, "SnippetModel.Delete", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, stmt, id)
+	if err != nil {
+		return spanError(span, err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return spanError(span, err)
+	} else if n == 0 {
+		return models.ErrNoRecord
+	}
+	return nil
+}
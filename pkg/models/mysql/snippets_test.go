@@ -0,0 +1,69 @@
+package mysql
+
+import (
+	"context"
+	"testing"
+
+	"chilliweb.com/snippetbox/pkg/models"
+)
+
+func TestContainsPattern(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "%%"},
+		{"pond", "%pond%"},
+		{"100%", `%100\%%`},
+		{"snake_case", `%snake\_case%`},
+		{`C:\`, `%C:\\%`},
+	}
+
+	for _, tt := range tests {
+		if got := containsPattern(tt.query); got != tt.want {
+			t.Errorf("%s: want %q; got %q", tt.query, tt.want, got)
+		}
+	}
+}
+
+func TestSnippetModelSearch(t *testing.T) {
+	if testing.Short() {
+		t.Skip("mysql: skipping integration test")
+	}
+
+	db, teardown := newTestDB(t)
+	defer teardown()
+
+	ctx := context.Background()
+	m := SnippetModel{DB: db}
+
+	pond, err := m.Insert(ctx, "An old silent pond", "A frog jumps into the pond", "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Insert(ctx, "Over the wintry forest", "Winds howl in rage", "7"); err != nil {
+		t.Fatal(err)
+	}
+
+	snippets, err := m.Search(ctx, "frog", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snippets) != 1 || snippets[0].ID != pond {
+		t.Errorf("want snippet %d; got %v", pond, snippets)
+	}
+
+	if snippets, _ := m.Search(ctx, "", 1); len(snippets) != 1 || snippets[0].ID == pond {
+		t.Errorf("want only the newest snippet; got %v", snippets)
+	}
+
+	if err := m.Delete(ctx, pond); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete(ctx, pond); err != models.ErrNoRecord {
+		t.Errorf("deleted snippet: want %v; got %v", models.ErrNoRecord, err)
+	}
+	if _, err := m.Get(ctx, pond); err != models.ErrNoRecord {
+		t.Errorf("deleted snippet: want %v; got %v", models.ErrNoRecord, err)
+	}
+}
@@ -0,0 +1,47 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"chilliweb.com/snippetbox/pkg/models"
+)
+
+// Define a StatsModel type which wraps a sql.DB connection pool, and the
+// maximum time each query may take (DefaultTimeout if zero). It counts the
+// rows in the other models' tables for the admin dashboard.
+type StatsModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// The Get method returns the current counts. They are all read with a
+// single statement, so they are consistent with each other.
+func (m *StatsModel) Get(ctx context.Context) (*models.Stats, error) {
+	stmt := `SELECT
+	(SELECT COUNT(*) FROM users),
+	(SELECT COUNT(*) FROM users WHERE active),
+	(SELECT COUNT(*) FROM users WHERE email_verified),
+	(SELECT COUNT(*) FROM users WHERE role = ?),
+	(SELECT COUNT(*) FROM users WHERE role = ?),
+	(SELECT COUNT(*) FROM snippets),
+	(SELECT COUNT(*) FROM snippets WHERE expires > UTC_TIMESTAMP()),
+	(SELECT COUNT(*) FROM user_sessions WHERE expires > UTC_TIMESTAMP())`
+
+	ctx, span := startSpan(ctx, "StatsModel.Get", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	s := &models.Stats{}
+	err := m.DB.QueryRowContext(ctx, stmt, models.RoleModerator, models.RoleAdmin).Scan(
+		&s.Users, &s.ActiveUsers, &s.VerifiedUsers, &s.Moderators, &s.Admins,
+		&s.Snippets, &s.LiveSnippets, &s.Sessions)
+	if err != nil {
+		return nil, spanError(span, err)
+	}
+
+	return s, nil
+}
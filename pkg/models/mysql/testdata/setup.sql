@@ -12,13 +12,98 @@ CREATE TABLE users (
     name VARCHAR(255) NOT NULL,
     email VARCHAR(255) NOT NULL,
     hashed_password CHAR(60) NOT NULL,
-    created DATETIME NOT NULL
+    created DATETIME NOT NULL,
+    email_verified BOOLEAN NOT NULL DEFAULT FALSE,
+    failed_logins INTEGER NOT NULL DEFAULT 0,
+    locked_until DATETIME,
+    last_login DATETIME,
+    last_login_ip VARCHAR(45),
+    session_version INTEGER NOT NULL DEFAULT 0,
+    totp_secret VARCHAR(64),
+    totp_last_step BIGINT NOT NULL DEFAULT 0,
+    role VARCHAR(16) NOT NULL DEFAULT 'user',
+    active BOOLEAN NOT NULL DEFAULT TRUE
 );
 
 ALTER TABLE users ADD CONSTRAINT users_uc_email UNIQUE (email);
 
+CREATE TABLE password_resets (
+    token_hash CHAR(64) NOT NULL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    expires DATETIME NOT NULL
+);
+CREATE INDEX idx_password_resets_user_id ON password_resets(user_id);
+
+CREATE TABLE login_tokens (
+    token_hash CHAR(64) NOT NULL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    expires DATETIME NOT NULL
+);
+CREATE INDEX idx_login_tokens_user_id ON login_tokens(user_id);
+
+CREATE TABLE recovery_codes (
+    user_id INTEGER NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    PRIMARY KEY (user_id, code_hash)
+);
+
+CREATE TABLE webauthn_credentials (
+    id VARBINARY(255) NOT NULL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    public_key BLOB NOT NULL,
+    attestation_type VARCHAR(32) NOT NULL,
+    aaguid VARBINARY(16) NOT NULL,
+    transports VARCHAR(255) NOT NULL,
+    sign_count INTEGER UNSIGNED NOT NULL,
+    backup_eligible BOOLEAN NOT NULL,
+    backup_state BOOLEAN NOT NULL,
+    created DATETIME NOT NULL,
+    last_used DATETIME
+);
+CREATE INDEX idx_webauthn_credentials_user_id ON webauthn_credentials(user_id);
+
+CREATE TABLE user_identities (
+    issuer VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    user_id INTEGER NOT NULL,
+    created DATETIME NOT NULL,
+    PRIMARY KEY (issuer, subject)
+);
+CREATE INDEX idx_user_identities_user_id ON user_identities(user_id);
+
+CREATE TABLE sessions (
+    token_hash CHAR(64) NOT NULL PRIMARY KEY,
+    data BLOB NOT NULL,
+    expiry DATETIME(6) NOT NULL
+);
+CREATE INDEX idx_sessions_expiry ON sessions(expiry);
+
+CREATE TABLE user_sessions (
+    id CHAR(43) NOT NULL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    created DATETIME NOT NULL,
+    last_seen DATETIME NOT NULL,
+    expires DATETIME NOT NULL,
+    ip VARCHAR(45) NOT NULL,
+    user_agent VARCHAR(255) NOT NULL
+);
+CREATE INDEX idx_user_sessions_user_id ON user_sessions(user_id);
+
+CREATE TABLE remember_tokens (
+    selector CHAR(16) NOT NULL PRIMARY KEY,
+    validator_hash CHAR(64) NOT NULL,
+    previous_validator_hash CHAR(64),
+    rotated DATETIME,
+    user_id INTEGER NOT NULL,
+    session_id CHAR(43) NOT NULL,
+    created DATETIME NOT NULL,
+    expires DATETIME NOT NULL
+);
+CREATE INDEX idx_remember_tokens_user_id ON remember_tokens(user_id);
+
 INSERT INTO users (
-    name, email, hashed_password, created) 
+    name, email, hashed_password, created, email_verified) 
     VALUES ( 
-        'Alice Jones', 'alice@example.com', '$2a$12$NuTjWXm3KKntReFwyBVHyuf/to.HEwTy.eS206TNfkGfr6HzGJSWG', '2018-12-23 17:25:22'
+        'Alice Jones', 'alice@example.com', '$2a$12$NuTjWXm3KKntReFwyBVHyuf/to.HEwTy.eS206TNfkGfr6HzGJSWG', '2018-12-23 17:25:22', TRUE
 );
\ No newline at end of file
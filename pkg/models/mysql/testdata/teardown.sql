@@ -1,3 +1,19 @@
+DROP TABLE remember_tokens;
+
+DROP TABLE sessions;
+
+DROP TABLE user_sessions;
+
+DROP TABLE user_identities;
+
+DROP TABLE webauthn_credentials;
+
+DROP TABLE recovery_codes;
+
+DROP TABLE login_tokens;
+
+DROP TABLE password_resets;
+
 DROP TABLE users;
 
 DROP TABLE snippets;
\ No newline at end of file
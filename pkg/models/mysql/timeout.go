@@ -0,0 +1,21 @@
+package mysql
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultTimeout is the maximum time a query may take when a model's Timeout
+// field hasn't been set.
+const DefaultTimeout = 3 * time.Second
+
+// The withTimeout() helper returns a copy of the context with the query
+// deadline applied. The query is cancelled when either the deadline passes or
+// the parent context is cancelled (for example, because the client has gone
+// away), so a slow query can't tie up a connection indefinitely.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,24 @@
+package mysql
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// The newToken() function generates a random 256-bit token for emailed
+// links, encoded so that it can be used in a URL as it is.
+func newToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// The hashToken() function returns the hex-encoded SHA-256 hash of a token,
+// which is what we store in the database. The tokens are random and long, so
+// unlike passwords they don't need a slow hash.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,79 @@
+package mysql
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+// The TOTP settings. These are the defaults which every authenticator app
+// supports, and they must match the ones in the otpauth URI which the user
+// enrolled with.
+const (
+	totpPeriod = 30
+	totpDigits = otp.DigitsSix
+	totpSkew   = 1
+)
+
+// The number of recovery codes issued when two-factor authentication is
+// enabled.
+const recoveryCodeCount = 10
+
+// The totpStep() function returns the TOTP time step containing t.
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// The matchTOTP() function checks the code against the secret for the time
+// step containing now and the steps either side of it (to allow for clock
+// drift), and returns the step it matched. Steps up to and including
+// lastStep are skipped, so that a code can't be used twice.
+func matchTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	opts := totp.ValidateOpts{Period: totpPeriod, Digits: totpDigits, Algorithm: otp.AlgorithmSHA1}
+
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		want, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), opts)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// The newRecoveryCodes() function generates a set of random one-time
+// recovery codes, formatted like "abcde-fghij" so that they are easy to
+// write down.
+func newRecoveryCodes() []string {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		rand.Read(b)
+		s := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+	}
+	return codes
+}
+
+// The normalizeRecoveryCode() function puts a recovery code typed by the user
+// into the form it was issued in, before it is hashed.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Join(strings.Fields(code), ""))
+	code = strings.ReplaceAll(code, "-", "")
+	if len(code) != 10 {
+		return code
+	}
+	return code[:5] + "-" + code[5:]
+}
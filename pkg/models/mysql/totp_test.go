@@ -0,0 +1,91 @@
+package mysql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+func TestMatchTOTP(t *testing.T) {
+	const secret = "JBSWY3DPEHPK3PXP"
+	now := time.Date(2020, 1, 1, 12, 0, 10, 0, time.UTC)
+	step := totpStep(now)
+
+	code := func(step int64) string {
+		c, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		code     string
+		lastStep int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{"Current step", code(step), 0, step, true},
+		{"Surrounding spaces", " " + code(step) + " ", 0, step, true},
+		{"Previous step", code(step - 1), 0, step - 1, true},
+		{"Next step", code(step + 1), 0, step + 1, true},
+		{"Too old", code(step - 2), 0, 0, false},
+		{"Already used", code(step), step, 0, false},
+		{"Wrong code", "000000", 0, 0, false},
+		{"Empty code", "", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, ok := matchTOTP(secret, tt.code, now, tt.lastStep)
+			if ok != tt.wantOK || gotStep != tt.wantStep {
+				t.Errorf("want %d, %t; got %d, %t", tt.wantStep, tt.wantOK, gotStep, ok)
+			}
+		})
+	}
+}
+
+func TestNewRecoveryCodes(t *testing.T) {
+	codes := newRecoveryCodes()
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("want %d codes; got %d", recoveryCodeCount, len(codes))
+	}
+
+	seen := map[string]bool{}
+	for _, c := range codes {
+		if len(c) != 11 || c[5] != '-' || normalizeRecoveryCode(c) != c {
+			t.Errorf("want code like %q; got %q", "abcde-fghij", c)
+		}
+		if seen[c] {
+			t.Errorf("want unique codes; got %q twice", c)
+		}
+		seen[c] = true
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"abcde-fghij", "abcde-fghij"},
+		{" abcde-fghij\n", "abcde-fghij"},
+		{"ABCDE-FGHIJ", "abcde-fghij"},
+		{"abcdefghij", "abcde-fghij"},
+		{"abcde fghij", "abcde-fghij"},
+		{"abc", "abc"},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeRecoveryCode(tt.code); got != tt.want {
+			t.Errorf("%q: want %q; got %q", tt.code, tt.want, got)
+		}
+	}
+}
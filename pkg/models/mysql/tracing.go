@@ -0,0 +1,34 @@
+package mysql
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The tracer used for the database query spans. It comes from the global
+// tracer provider, which is configured in main().
+var tracer = otel.Tracer("chilliweb.com/snippetbox/pkg/models/mysql")
+
+// The startSpan() helper starts a new span for a database query, as a child
+// of any span in the context.
+func startSpan(ctx context.Context, name, stmt string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "mysql"),
+			attribute.String("db.statement", stmt),
+		),
+	)
+}
+
+// The spanError() helper records an error on the span and marks it as failed.
+// It returns the error so it can be used in a return statement.
+func spanError(span trace.Span, err error) error {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	return err
+}
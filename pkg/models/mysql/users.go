@@ -1,8 +1,10 @@
 package mysql
 
 import (
+	"context"
 	"database/sql"
 	"strings"
+	"time"
 
 	"chilliweb.com/snippetbox/pkg/models"
 
@@ -10,78 +12,962 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Define a UserModel type which wraps a sql.DB connection pool, the
+// maximum time each query may take (DefaultTimeout if zero) and the account
+// lockout policy.
 type UserModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Timeout time.Duration
+	Lockout Lockout
 }
 
-func (m *UserModel) Get(id int) (*models.User, error) {
+// The dummyHash is a bcrypt hash (with the same cost as our real ones) which
+// Authenticate() checks the password against when there's no account with
+// the given email. That way the response takes as long as it does for a real
+// account, so the timing doesn't reveal which email addresses are registered.
+var dummyHash = []byte("$2a$12$NuTjWXm3KKntReFwyBVHyuf/to.HEwTy.eS206TNfkGfr6HzGJSWG")
+
+func (m *UserModel) Get(ctx context.Context, id int) (*models.User, error) {
 	s := &models.User{}
 
-	stmt := `SELECT id, name, email, created FROM users WHERE id = ?`
-	err := m.DB.QueryRow(stmt, id).Scan(&s.ID, &s.Name, &s.Email, &s.Created)
+	stmt := `SELECT id, name, email, created, email_verified, last_login, last_login_ip, session_version,
+	totp_secret IS NOT NULL, role, active, locked_until FROM users WHERE id = ?`
+
+	ctx, span := startSpan(ctx, "UserModel.Get", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	// The last login columns are NULL until the user first logs in, and
+	// locked_until is NULL unless the account has been locked.
+	var lastLogin, lockedUntil sql.NullTime
+	var lastLoginIP sql.NullString
+	err := m.DB.QueryRowContext(ctx, stmt, id).Scan(&s.ID, &s.Name, &s.Email, &s.Created, &s.EmailVerified, &lastLogin, &lastLoginIP, &s.SessionVersion, &s.TOTPEnabled, &s.Role, &s.Active, &lockedUntil)
 	if err == sql.ErrNoRows {
 		return nil, models.ErrNoRecord
 	} else if err != nil {
-		return nil, err
+		return nil, spanError(span, err)
 	}
+	s.LastLogin = lastLogin.Time
+	s.LastLoginIP = lastLoginIP.String
+	s.LockedUntil = lockedUntil.Time
 
 	return s, nil
 }
 
-// We'll use the Insert method to add a new record to the users table
-func (m *UserModel) Insert(name, email, password string) error {
+// We'll use the Insert method to add a new record to the users table, and
+// return the new user's ID. New users start with an unverified email address.
+func (m *UserModel) Insert(ctx context.Context, name, email, password string) (int, error) {
 	// Create a bcrypt hash of the plain-text password.
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	stmt := `INSERT INTO users (name, email, hashed_password, created) 
 	VALUES(?, ?, ?, UTC_TIMESTAMP())`
 
+	ctx, span := startSpan(ctx, "UserModel.Insert", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
 	// Use the Exec() method to insert the user details and the hashed password
 	// into the users table. If this returns an error, we try to type assert
 	// it to a *mysql.MySQLError object so we can check if the error number is
 	// 1062 and, if it is, we also check whether or not the error relates to
 	// our users_uc_email key by checking the contents of the message string.
 	// If it does, we return a ErrDuplicateEmail error. Otherwise, we just
-	// return the original error (or nil if everything worked).
-	_, err = m.DB.Exec(stmt, name, email, string(hashedPassword))
+	// return the original error.
+	result, err := m.DB.ExecContext(ctx, stmt, name, email, string(hashedPassword))
 	if err != nil {
 		if mysqlErr, ok := err.(*mysql.MySQLError); ok {
 			if mysqlErr.Number == 1062 && strings.Contains(mysqlErr.Message, "users_uc_email") {
-				return models.ErrDuplicateEmail
+				return 0, models.ErrDuplicateEmail
 			}
 		}
+		return 0, spanError(span, err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, spanError(span, err)
 	}
-	return err
+	return int(id), nil
 }
 
 // We'll use the Authenticate method to verify whether a user exisits with
 // the provided email address and password.
 // This will return a user ID if they do.
-func (m *UserModel) Authenticate(email, password string) (int, error) {
+//
+// It also enforces the lockout policy: failed logins are counted, and once
+// there have been too many the account is locked and ErrAccountLocked is
+// returned (even for the right password) until the lock expires. A
+// successful login resets the count and records the time and the client's
+// IP address.
+func (m *UserModel) Authenticate(ctx context.Context, email, password, ip string) (int, error) {
+	stmt := "SELECT failed_logins, locked_until FROM users WHERE id = ? FOR UPDATE"
+
+	ctx, span := startSpan(ctx, "UserModel.Authenticate", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
 	// Retrieve the id and hashed password associated with teh given email.
-	// If no matching email exists, we return the ErrInvalidCredentials error
+	// If no matching email exists, we still check the password against the
+	// dummy hash before returning the ErrInvalidCredentials error.
 	var id int
 	var hashedPassword []byte
-	row := m.DB.QueryRow("SELECT id, hashed_password FROM users WHERE email = ?", email)
+	row := m.DB.QueryRowContext(ctx, "SELECT id, hashed_password FROM users WHERE email = ?", email)
 	err := row.Scan(&id, &hashedPassword)
 	if err == sql.ErrNoRows {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
 		return 0, models.ErrInvalidCredentials
 	} else if err != nil {
-		return 0, err
+		return 0, spanError(span, err)
 	}
 
-	// Check whether the hashed password and plain-text password provided match.
-	// If they don't we return the ErrInvalidCredentials error.
+	// Check whether the hashed password and plain-text password provided
+	// match. This is slow, so we do it before locking the user's row.
 	err = bcrypt.CompareHashAndPassword(hashedPassword, []byte(password))
-	if err == bcrypt.ErrMismatchedHashAndPassword {
+	if err != nil && err != bcrypt.ErrMismatchedHashAndPassword {
+		return 0, spanError(span, err)
+	}
+	mismatch := err == bcrypt.ErrMismatchedHashAndPassword
+
+	// Read the lockout state and update it in a transaction, with the user's
+	// row locked, so that concurrent failures are all counted and can't
+	// overwrite each other's locks.
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, spanError(span, err)
+	}
+	defer tx.Rollback()
+
+	var failedLogins int
+	var lockedUntil sql.NullTime
+	err = tx.QueryRowContext(ctx, stmt, id).Scan(&failedLogins, &lockedUntil)
+	if err == sql.ErrNoRows {
 		return 0, models.ErrInvalidCredentials
 	} else if err != nil {
+		return 0, spanError(span, err)
+	}
+
+	// If the account is locked we refuse the login whatever the password was.
+	// Attempts while it's locked don't count as failures, or an attacker
+	// could keep the account locked forever.
+	now := time.Now().UTC()
+	if lockedUntil.Valid && now.Before(lockedUntil.Time) {
+		return 0, models.ErrAccountLocked
+	}
+
+	// If the password is wrong, count the failure and lock the account if
+	// that takes it over the threshold. A failure below the threshold leaves
+	// locked_until as it is, so it never clears a lock.
+	if mismatch {
+		stmt := "UPDATE users SET failed_logins = failed_logins + 1 WHERE id = ?"
+		args := []interface{}{id}
+		if d := m.Lockout.duration(failedLogins + 1); d > 0 {
+			stmt = "UPDATE users SET failed_logins = failed_logins + 1, locked_until = ? WHERE id = ?"
+			args = []interface{}{now.Add(d), id}
+		}
+
+		if _, err := tx.ExecContext(ctx, stmt, args...); err != nil {
+			return 0, spanError(span, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, spanError(span, err)
+		}
+		return 0, models.ErrInvalidCredentials
+	}
+
+	// Otherwise, the password is correct. Reset the failure count, record the
+	// login and return the user ID.
+	stmt = `UPDATE users SET failed_logins = 0, locked_until = NULL,
+	last_login = UTC_TIMESTAMP(), last_login_ip = ? WHERE id = ?`
+	if _, err := tx.ExecContext(ctx, stmt, ip, id); err != nil {
+		return 0, spanError(span, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, spanError(span, err)
+	}
+
+	return id, nil
+}
+
+// The Unlock method unlocks the account with the given email address and
+// resets its failed login count, so the user can log in straight away.
+func (m *UserModel) Unlock(ctx context.Context, email string) error {
+	stmt := "UPDATE users SET failed_logins = 0, locked_until = NULL WHERE email = ?"
+
+	ctx, span := startSpan(ctx, "UserModel.Unlock", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	// MySQL reports zero rows affected if the account wasn't locked, so we
+	// check that the account exists first.
+	var id int
+	err := m.DB.QueryRowContext(ctx, "SELECT id FROM users WHERE email = ?", email).Scan(&id)
+	if err == sql.ErrNoRows {
+		return models.ErrNoRecord
+	} else if err != nil {
+		return spanError(span, err)
+	}
+
+	if _, err := m.DB.ExecContext(ctx, stmt, email); err != nil {
+		return spanError(span, err)
+	}
+	return nil
+}
+
+// The UnlockID method is the same as Unlock, but for the user with the given
+// ID. The admin area uses it.
+func (m *UserModel) UnlockID(ctx context.Context, id int) error {
+	stmt := "UPDATE users SET failed_logins = 0, locked_until = NULL WHERE id = ?"
+
+	ctx, span := startSpan(ctx, "UserModel.UnlockID", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var exists bool
+	err := m.DB.QueryRowContext(ctx, "SELECT EXISTS(SELECT true FROM users WHERE id = ?)", id).Scan(&exists)
+	if err != nil {
+		return spanError(span, err)
+	} else if !exists {
+		return models.ErrNoRecord
+	}
+
+	if _, err := m.DB.ExecContext(ctx, stmt, id); err != nil {
+		return spanError(span, err)
+	}
+	return nil
+}
+
+// The MakeAdmin method gives the user with the given email address the admin
+// role, so that the first admin can be set up from the command line.
+func (m *UserModel) MakeAdmin(ctx context.Context, email string) error {
+	stmt := "UPDATE users SET role = ? WHERE email = ?"
+
+	ctx, span := startSpan(ctx, "UserModel.MakeAdmin", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	// As with Unlock, MySQL reports zero rows affected if nothing changed,
+	// so we check that the account exists first.
+	var id int
+	err := m.DB.QueryRowContext(ctx, "SELECT id FROM users WHERE email = ?", email).Scan(&id)
+	if err == sql.ErrNoRows {
+		return models.ErrNoRecord
+	} else if err != nil {
+		return spanError(span, err)
+	}
+
+	if _, err := m.DB.ExecContext(ctx, stmt, models.RoleAdmin, email); err != nil {
+		return spanError(span, err)
+	}
+	return nil
+}
+
+// The CreatePasswordReset method creates a single-use password reset token
+// for the user with the given email address, valid for ttl. Only a SHA-256
+// hash of the token is stored, so the tokens can't be used by anyone who
+// gets hold of a copy of the database. The user's expired tokens are
+// deleted at the same time, so that the table doesn't grow forever. It
+// returns ErrNoRecord if there's no such user.
+func (m *UserModel) CreatePasswordReset(ctx context.Context, email string, ttl time.Duration) (string, error) {
+	stmt := `INSERT INTO password_resets (token_hash, user_id, expires)
+	SELECT ?, id, ? FROM users WHERE email = ?`
+
+	ctx, span := startSpan(ctx, "UserModel.CreatePasswordReset", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM password_resets
+	WHERE user_id = (SELECT id FROM users WHERE email = ?) AND expires <= UTC_TIMESTAMP()`, email)
+	if err != nil {
+		return "", spanError(span, err)
+	}
+
+	token := newToken()
+	expires := time.Now().UTC().Add(ttl)
+
+	result, err := m.DB.ExecContext(ctx, stmt, hashToken(token), expires, email)
+	if err != nil {
+		return "", spanError(span, err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return "", spanError(span, err)
+	}
+	if n == 0 {
+		return "", models.ErrNoRecord
+	}
+
+	return token, nil
+}
+
+// The ResetPassword method sets a new password for the user the token was
+// issued to, and returns their ID. The token and any other outstanding
+// reset and login link tokens for the user are deleted, the failed login
+// count is reset and the session version is incremented, which logs the
+// user out everywhere else. It returns ErrInvalidToken if the token doesn't exist or has expired.
+func (m *UserModel) ResetPassword(ctx context.Context, token, password string) (int, error) {
+	stmt := `SELECT user_id FROM password_resets
+	WHERE token_hash = ? AND expires > UTC_TIMESTAMP() FOR UPDATE`
+
+	ctx, span := startSpan(ctx, "UserModel.ResetPassword", stmt)
+	defer span.End()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
 		return 0, err
 	}
 
-	// Otherwise, the password id correct. Return the user ID.
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	// Use a transaction, with the token row locked, so that two requests
+	// with the same token can't both succeed.
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, spanError(span, err)
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRowContext(ctx, stmt, hashToken(token)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, models.ErrInvalidToken
+	} else if err != nil {
+		return 0, spanError(span, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET hashed_password = ?, failed_logins = 0,
+	locked_until = NULL, session_version = session_version + 1 WHERE id = ?`, string(hashedPassword), id)
+	if err != nil {
+		return 0, spanError(span, err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM password_resets WHERE user_id = ?", id)
+	if err != nil {
+		return 0, spanError(span, err)
+	}
+
+	// A login link sent before the reset could have been asked for by
+	// whoever the password is being reset to lock out, so those go too.
+	_, err = tx.ExecContext(ctx, "DELETE FROM login_tokens WHERE user_id = ?", id)
+	if err != nil {
+		return 0, spanError(span, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, spanError(span, err)
+	}
+
+	return id, nil
+}
+
+// CreateLoginToken creates a token for a login link for the user with the
+// given email address, valid for ttl, and returns it. The token itself is
+// only sent to the user; we store its hash. As with password resets, the
+// user's expired tokens are deleted at the same time. If there is no user
+// with the email address, it returns models.ErrNoRecord.
+func (m *UserModel) CreateLoginToken(ctx context.Context, email string, ttl time.Duration) (string, error) {
+	stmt := `INSERT INTO login_tokens (token_hash, user_id, expires)
+	SELECT ?, id, ? FROM users WHERE email = ?`
+
+	ctx, span := startSpan(ctx, "UserModel.CreateLoginToken", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM login_tokens
+	WHERE user_id = (SELECT id FROM users WHERE email = ?) AND expires <= UTC_TIMESTAMP()`, email)
+	if err != nil {
+		return "", spanError(span, err)
+	}
+
+	token := newToken()
+	expires := time.Now().UTC().Add(ttl)
+
+	result, err := m.DB.ExecContext(ctx, stmt, hashToken(token), expires, email)
+	if err != nil {
+		return "", spanError(span, err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return "", spanError(span, err)
+	}
+	if n == 0 {
+		return "", models.ErrNoRecord
+	}
+
+	return token, nil
+}
+
+// ConsumeLoginToken returns the ID of the user a login link token was
+// created for, and records the login. The user's login tokens can only be
+// used once: this one and any others they've been sent are deleted. If the
+// token doesn't exist or has expired it returns models.ErrInvalidToken.
+func (m *UserModel) ConsumeLoginToken(ctx context.Context, token string) (int, error) {
+	stmt := `SELECT user_id FROM login_tokens
+	WHERE token_hash = ? AND expires > UTC_TIMESTAMP() FOR UPDATE`
+
+	ctx, span := startSpan(ctx, "UserModel.ConsumeLoginToken", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	// Use a transaction, with the token row locked, so that two requests
+	// with the same token can't both succeed.
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, spanError(span, err)
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRowContext(ctx, stmt, hashToken(token)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, models.ErrInvalidToken
+	} else if err != nil {
+		return 0, spanError(span, err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM login_tokens WHERE user_id = ?", id)
+	if err != nil {
+		return 0, spanError(span, err)
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE users SET last_login = UTC_TIMESTAMP() WHERE id = ?", id)
+	if err != nil {
+		return 0, spanError(span, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, spanError(span, err)
+	}
+
+	return id, nil
+}
+
+// The VerifyEmail method marks the user's email address as verified. The
+// email address must still match the one the verification link was sent to;
+// if the user has changed it since, ErrNoRecord is returned.
+func (m *UserModel) VerifyEmail(ctx context.Context, id int, email string) error {
+	stmt := "UPDATE users SET email_verified = TRUE WHERE id = ? AND email = ?"
+
+	ctx, span := startSpan(ctx, "UserModel.VerifyEmail", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	// MySQL reports zero rows affected if the address was already verified,
+	// so we check that the user exists with that address first.
+	var exists bool
+	err := m.DB.QueryRowContext(ctx, "SELECT EXISTS(SELECT true FROM users WHERE id = ? AND email = ?)", id, email).Scan(&exists)
+	if err != nil {
+		return spanError(span, err)
+	}
+	if !exists {
+		return models.ErrNoRecord
+	}
+
+	if _, err := m.DB.ExecContext(ctx, stmt, id, email); err != nil {
+		return spanError(span, err)
+	}
+	return nil
+}
+
+// The UpdateName method changes the user's name.
+func (m *UserModel) UpdateName(ctx context.Context, id int, name string) error {
+	stmt := "UPDATE users SET name = ? WHERE id = ?"
+
+	ctx, span := startSpan(ctx, "UserModel.UpdateName", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	if _, err := m.DB.ExecContext(ctx, stmt, name, id); err != nil {
+		return spanError(span, err)
+	}
+	return nil
+}
+
+// The UpdateEmail method changes the user's email address, which then needs
+// to be verified again. Like ChangePassword, it checks the user's current
+// password first, so that someone who gets hold of a logged in session can't
+// take over the account by changing its email address and then resetting the
+// password. It returns ErrInvalidCredentials if the password is wrong, and
+// ErrDuplicateEmail if another user already has the address.
+func (m *UserModel) UpdateEmail(ctx context.Context, id int, password, email string) error {
+	stmt := "UPDATE users SET email = ?, email_verified = FALSE WHERE id = ?"
+
+	ctx, span := startSpan(ctx, "UserModel.UpdateEmail", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var hashedPassword []byte
+	err := m.DB.QueryRowContext(ctx, "SELECT hashed_password FROM users WHERE id = ?", id).Scan(&hashedPassword)
+	if err == sql.ErrNoRows {
+		return models.ErrNoRecord
+	} else if err != nil {
+		return spanError(span, err)
+	}
+
+	err = bcrypt.CompareHashAndPassword(hashedPassword, []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return models.ErrInvalidCredentials
+	} else if err != nil {
+		return spanError(span, err)
+	}
+
+	_, err = m.DB.ExecContext(ctx, stmt, email, id)
+	if err != nil {
+		if mysqlErr, ok := err.(*mysql.MySQLError); ok {
+			if mysqlErr.Number == 1062 && strings.Contains(mysqlErr.Message, "users_uc_email") {
+				return models.ErrDuplicateEmail
+			}
+		}
+		return spanError(span, err)
+	}
+	return nil
+}
+
+// The ChangePassword method sets a new password for the user, as long as
+// the current password is correct; otherwise it returns
+// ErrInvalidCredentials. Like ResetPassword, it increments the session
+// version, which logs the user out of their other sessions, and deletes any
+// outstanding login link tokens.
+func (m *UserModel) ChangePassword(ctx context.Context, id int, currentPassword, newPassword string) error {
+	stmt := "SELECT hashed_password FROM users WHERE id = ? FOR UPDATE"
+
+	ctx, span := startSpan(ctx, "UserModel.ChangePassword", stmt)
+	defer span.End()
+
+	newHash, err := bcrypt.GenerateFromPassword([]byte(newPassword), 12)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return spanError(span, err)
+	}
+	defer tx.Rollback()
+
+	var currentHash []byte
+	err = tx.QueryRowContext(ctx, stmt, id).Scan(&currentHash)
+	if err == sql.ErrNoRows {
+		return models.ErrNoRecord
+	} else if err != nil {
+		return spanError(span, err)
+	}
+
+	err = bcrypt.CompareHashAndPassword(currentHash, []byte(currentPassword))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return models.ErrInvalidCredentials
+	} else if err != nil {
+		return spanError(span, err)
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE users SET hashed_password = ?, session_version = session_version + 1 WHERE id = ?", string(newHash), id)
+	if err != nil {
+		return spanError(span, err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM login_tokens WHERE user_id = ?", id)
+	if err != nil {
+		return spanError(span, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return spanError(span, err)
+	}
+	return nil
+}
+
+// The EnableTOTP method turns on two-factor authentication for the user with
+// the given TOTP secret, once they have proved that their authenticator app
+// is set up by entering a code from it. It returns a new set of one-time
+// recovery codes, which are only stored hashed, or ErrInvalidCredentials if
+// the code is wrong.
+func (m *UserModel) EnableTOTP(ctx context.Context, id int, secret, code string) ([]string, error) {
+	stmt := "UPDATE users SET totp_secret = ?, totp_last_step = ? WHERE id = ?"
+
+	ctx, span := startSpan(ctx, "UserModel.EnableTOTP", stmt)
+	defer span.End()
+
+	step, ok := matchTOTP(secret, code, time.Now(), 0)
+	if !ok {
+		return nil, models.ErrInvalidCredentials
+	}
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, spanError(span, err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, stmt, secret, step, id)
+	if err != nil {
+		return nil, spanError(span, err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return nil, spanError(span, err)
+	}
+	if n == 0 {
+		return nil, models.ErrNoRecord
+	}
+
+	codes, err := replaceRecoveryCodes(ctx, tx, id)
+	if err != nil {
+		return nil, spanError(span, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, spanError(span, err)
+	}
+	return codes, nil
+}
+
+// The DisableTOTP method turns off two-factor authentication for the user
+// and deletes their recovery codes. Like UpdateEmail, it checks the user's
+// password first and returns ErrInvalidCredentials if it's wrong.
+func (m *UserModel) DisableTOTP(ctx context.Context, id int, password string) error {
+	stmt := "UPDATE users SET totp_secret = NULL, totp_last_step = 0 WHERE id = ?"
+
+	ctx, span := startSpan(ctx, "UserModel.DisableTOTP", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var hashedPassword []byte
+	err := m.DB.QueryRowContext(ctx, "SELECT hashed_password FROM users WHERE id = ?", id).Scan(&hashedPassword)
+	if err == sql.ErrNoRows {
+		return models.ErrNoRecord
+	} else if err != nil {
+		return spanError(span, err)
+	}
+
+	err = bcrypt.CompareHashAndPassword(hashedPassword, []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return models.ErrInvalidCredentials
+	} else if err != nil {
+		return spanError(span, err)
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return spanError(span, err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, stmt, id); err != nil {
+		return spanError(span, err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = ?", id); err != nil {
+		return spanError(span, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return spanError(span, err)
+	}
+	return nil
+}
+
+// The AuthenticateTOTP method is the second step of logging in for a user
+// with two-factor authentication turned on. It accepts either a code from
+// their authenticator app, which can't be used again, or one of their
+// recovery codes, which is then deleted. It returns ErrInvalidCredentials if
+// the code is wrong, or if the user doesn't have two-factor authentication
+// turned on.
+func (m *UserModel) AuthenticateTOTP(ctx context.Context, id int, code string) error {
+	stmt := "SELECT totp_secret, totp_last_step FROM users WHERE id = ? FOR UPDATE"
+
+	ctx, span := startSpan(ctx, "UserModel.AuthenticateTOTP", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	// Use a transaction, with the user's row locked, so that the same code
+	// can't be used by two requests at once.
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return spanError(span, err)
+	}
+	defer tx.Rollback()
+
+	var secret sql.NullString
+	var lastStep int64
+	err = tx.QueryRowContext(ctx, stmt, id).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return models.ErrNoRecord
+	} else if err != nil {
+		return spanError(span, err)
+	}
+	if !secret.Valid {
+		return models.ErrInvalidCredentials
+	}
+
+	if step, ok := matchTOTP(secret.String, code, time.Now(), lastStep); ok {
+		_, err := tx.ExecContext(ctx, "UPDATE users SET totp_last_step = ? WHERE id = ?", step, id)
+		if err != nil {
+			return spanError(span, err)
+		}
+	} else {
+		// It isn't a valid TOTP code, so try it as a recovery code.
+		result, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = ? AND code_hash = ?", id, hashToken(normalizeRecoveryCode(code)))
+		if err != nil {
+			return spanError(span, err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return spanError(span, err)
+		}
+		if n == 0 {
+			return models.ErrInvalidCredentials
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return spanError(span, err)
+	}
+	return nil
+}
+
+// The replaceRecoveryCodes() function deletes the user's recovery codes and
+// stores the hashes of a new set, which it returns.
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, id int) ([]string, error) {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = ?", id); err != nil {
+		return nil, err
+	}
+
+	codes := newRecoveryCodes()
+	for _, code := range codes {
+		_, err := tx.ExecContext(ctx, "INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", id, hashToken(code))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// AuthenticateIdentity returns the ID of the user who logs in with the given
+// identity from an OpenID Connect provider. The first time an identity is
+// seen it is linked to the user with the same email address, but only if the
+// provider says it has verified the address; otherwise anyone who could
+// create an account at the provider with someone else's address could take
+// over their account here. If there isn't a user with that address and
+// provision is true, a new one is created, again only if the address is
+// verified, so that nobody can take an address before its owner signs up;
+// otherwise it returns ErrUnverifiedEmail. Provisioned users get a random
+// password, so they can only log in through the provider until they reset
+// it.
+func (m *UserModel) AuthenticateIdentity(ctx context.Context, identity *models.Identity, provision bool) (int, error) {
+	stmt := "SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?"
+
+	ctx, span := startSpan(ctx, "UserModel.AuthenticateIdentity", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, spanError(span, err)
+	}
+	defer tx.Rollback()
+
+	// If the identity is already linked, that's who is logging in.
+	var id int
+	err = tx.QueryRowContext(ctx, stmt, identity.Issuer, identity.Subject).Scan(&id)
+	if err == nil {
+		stmt := "UPDATE users SET last_login = UTC_TIMESTAMP() WHERE id = ?"
+		if _, err := tx.ExecContext(ctx, stmt, id); err != nil {
+			return 0, spanError(span, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, spanError(span, err)
+		}
+		return id, nil
+	} else if err != sql.ErrNoRows {
+		return 0, spanError(span, err)
+	}
+
+	// Otherwise look for a user with the same email address, locking the row
+	// so that two logins at once can't both link it.
+	stmt = "SELECT id FROM users WHERE email = ? FOR UPDATE"
+	err = tx.QueryRowContext(ctx, stmt, identity.Email).Scan(&id)
+	switch {
+	case err == nil && !identity.EmailVerified:
+		return 0, models.ErrDuplicateEmail
+	case err == nil:
+		// The provider has verified the address, so we can mark it as
+		// verified here too.
+		stmt := "UPDATE users SET email_verified = TRUE, last_login = UTC_TIMESTAMP() WHERE id = ?"
+		if _, err := tx.ExecContext(ctx, stmt, id); err != nil {
+			return 0, spanError(span, err)
+		}
+	case err == sql.ErrNoRows && !provision:
+		return 0, models.ErrNoRecord
+	case err == sql.ErrNoRows && !identity.EmailVerified:
+		return 0, models.ErrUnverifiedEmail
+	case err == sql.ErrNoRows:
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newToken()), 12)
+		if err != nil {
+			return 0, spanError(span, err)
+		}
+
+		stmt := `INSERT INTO users (name, email, hashed_password, created, email_verified, last_login)
+		VALUES(?, ?, ?, UTC_TIMESTAMP(), TRUE, UTC_TIMESTAMP())`
+		result, err := tx.ExecContext(ctx, stmt, identity.Name, identity.Email, string(hashedPassword))
+		if err != nil {
+			if mysqlErr, ok := err.(*mysql.MySQLError); ok {
+				if mysqlErr.Number == 1062 && strings.Contains(mysqlErr.Message, "users_uc_email") {
+					return 0, models.ErrDuplicateEmail
+				}
+			}
+			return 0, spanError(span, err)
+		}
+		lastID, err := result.LastInsertId()
+		if err != nil {
+			return 0, spanError(span, err)
+		}
+		id = int(lastID)
+	default:
+		return 0, spanError(span, err)
+	}
+
+	stmt = "INSERT INTO user_identities (issuer, subject, user_id, created) VALUES(?, ?, ?, UTC_TIMESTAMP())"
+	if _, err := tx.ExecContext(ctx, stmt, identity.Issuer, identity.Subject, id); err != nil {
+		return 0, spanError(span, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, spanError(span, err)
+	}
 	return id, nil
 }
+
+// The Search method returns up to limit users whose name or email address
+// contains query, or the most recent users if query is empty, newest first.
+func (m *UserModel) Search(ctx context.Context, query string, limit int) ([]*models.User, error) {
+	stmt := `SELECT id, name, email, created, email_verified, last_login, last_login_ip, session_version,
+	totp_secret IS NOT NULL, role, active, locked_until FROM users
+	WHERE name LIKE ? OR email LIKE ? ORDER BY id DESC LIMIT ?`
+
+	ctx, span := startSpan(ctx, "UserModel.Search", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	pattern := containsPattern(query)
+	rows, err := m.DB.QueryContext(ctx, stmt, pattern, pattern, limit)
+	if err != nil {
+		return nil, spanError(span, err)
+	}
+	defer rows.Close()
+
+	users := []*models.User{}
+	for rows.Next() {
+		u := &models.User{}
+		var lastLogin, lockedUntil sql.NullTime
+		var lastLoginIP sql.NullString
+		err := rows.Scan(&u.ID, &u.Name, &u.Email, &u.Created, &u.EmailVerified, &lastLogin, &lastLoginIP, &u.SessionVersion, &u.TOTPEnabled, &u.Role, &u.Active, &lockedUntil)
+		if err != nil {
+			return nil, spanError(span, err)
+		}
+		u.LastLogin = lastLogin.Time
+		u.LastLoginIP = lastLoginIP.String
+		u.LockedUntil = lockedUntil.Time
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, spanError(span, err)
+	}
+
+	return users, nil
+}
+
+// The SetRole method changes the user's role. It returns ErrNoRecord if
+// there's no such user.
+func (m *UserModel) SetRole(ctx context.Context, id int, role string) error {
+	stmt := "UPDATE users SET role = ? WHERE id = ?"
+
+	ctx, span := startSpan(ctx, "UserModel.SetRole", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var exists bool
+	err := m.DB.QueryRowContext(ctx, "SELECT EXISTS(SELECT true FROM users WHERE id = ?)", id).Scan(&exists)
+	if err != nil {
+		return spanError(span, err)
+	} else if !exists {
+		return models.ErrNoRecord
+	}
+
+	if _, err := m.DB.ExecContext(ctx, stmt, role, id); err != nil {
+		return spanError(span, err)
+	}
+	return nil
+}
+
+// The SetActive method deactivates or reactivates the user's account.
+// Deactivating it also increments the user's session version, so that all of
+// their sessions are logged out. It returns ErrNoRecord if there's no such
+// user.
+func (m *UserModel) SetActive(ctx context.Context, id int, active bool) error {
+	stmt := `UPDATE users SET active = ?,
+	session_version = IF(?, session_version, session_version + 1) WHERE id = ?`
+
+	ctx, span := startSpan(ctx, "UserModel.SetActive", stmt)
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var exists bool
+	err := m.DB.QueryRowContext(ctx, "SELECT EXISTS(SELECT true FROM users WHERE id = ?)", id).Scan(&exists)
+	if err != nil {
+		return spanError(span, err)
+	} else if !exists {
+		return models.ErrNoRecord
+	}
+
+	if _, err := m.DB.ExecContext(ctx, stmt, active, active, id); err != nil {
+		return spanError(span, err)
+	}
+	return nil
+}
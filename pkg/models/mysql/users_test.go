@@ -1,11 +1,15 @@
 package mysql
 
 import (
+	"context"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
 	"chilliweb.com/snippetbox/pkg/models"
+
+	"github.com/pquerna/otp/totp"
 )
 
 func TestUserModelGet(t *testing.T) {
@@ -29,6 +33,10 @@ func TestUserModelGet(t *testing.T) {
 				Name:    "Alice Jones",
 				Email:   "alice@example.com",
 				Created: time.Date(2018, 12, 23, 17, 25, 22, 0, time.UTC),
+				// Alice's address is verified in the test data.
+				EmailVerified: true,
+				Role:          models.RoleUser,
+				Active:        true,
 			},
 			wantError: nil,
 		},
@@ -55,11 +63,11 @@ func TestUserModelGet(t *testing.T) {
 			defer teardown()
 
 			// Create a new instance of the UserModel.
-			m := UserModel{db}
+			m := UserModel{DB: db}
 
 			// Call the UserModel.Get() method and check that the return value
 			// and error match the expected values for the sub-test.
-			user, err := m.Get(tt.userID)
+			user, err := m.Get(context.Background(), tt.userID)
 
 			if err != tt.wantError {
 				t.Errorf("want %v; got %s", tt.wantError, err)
@@ -71,3 +79,485 @@ func TestUserModelGet(t *testing.T) {
 		})
 	}
 }
+
+func TestUserModelAuthenticate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("mysql: skipping integration test")
+	}
+
+	db, teardown := newTestDB(t)
+	defer teardown()
+
+	ctx := context.Background()
+	m := UserModel{DB: db, Lockout: Lockout{Threshold: 2, Duration: time.Hour, MaxDuration: time.Hour}}
+
+	_, err := m.Insert(ctx, "Bob", "bob@example.com", "validPa$$word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name      string
+		email     string
+		password  string
+		wantError error
+	}{
+		{"Unknown email", "nobody@example.com", "validPa$$word", models.ErrInvalidCredentials},
+		{"First failure", "bob@example.com", "wrong", models.ErrInvalidCredentials},
+		{"Second failure locks", "bob@example.com", "wrong", models.ErrInvalidCredentials},
+		{"Locked with right password", "bob@example.com", "validPa$$word", models.ErrAccountLocked},
+		{"Locked with wrong password", "bob@example.com", "wrong", models.ErrAccountLocked},
+		{"Still locked", "bob@example.com", "validPa$$word", models.ErrAccountLocked},
+	}
+
+	for _, tt := range steps {
+		_, err := m.Authenticate(ctx, tt.email, tt.password, "192.0.2.1")
+		if err != tt.wantError {
+			t.Errorf("%s: want %v; got %v", tt.name, tt.wantError, err)
+		}
+	}
+
+	locked, err := m.Search(ctx, "bob@example.com", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locked) != 1 || !locked[0].Locked() {
+		t.Fatal("want the account to show as locked")
+	}
+
+	if err := m.UnlockID(ctx, locked[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := m.Authenticate(ctx, "bob@example.com", "validPa$$word", "192.0.2.1")
+	if err != nil {
+		t.Fatalf("want login after unlock; got %v", err)
+	}
+
+	user, err := m.Get(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.LastLoginIP != "192.0.2.1" || user.LastLogin.IsZero() {
+		t.Errorf("want last login recorded; got %v from %q", user.LastLogin, user.LastLoginIP)
+	}
+
+	if err := m.Unlock(ctx, "nobody@example.com"); err != models.ErrNoRecord {
+		t.Errorf("want %v; got %v", models.ErrNoRecord, err)
+	}
+	if err := m.UnlockID(ctx, 99); err != models.ErrNoRecord {
+		t.Errorf("want %v; got %v", models.ErrNoRecord, err)
+	}
+}
+
+func TestUserModelAuthenticateConcurrent(t *testing.T) {
+	if testing.Short() {
+		t.Skip("mysql: skipping integration test")
+	}
+
+	db, teardown := newTestDB(t)
+	defer teardown()
+
+	ctx := context.Background()
+	m := UserModel{DB: db, Lockout: Lockout{Threshold: 3, Duration: time.Hour, MaxDuration: time.Hour}}
+
+	_, err := m.Insert(ctx, "Bob", "bob@example.com", "validPa$$word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail several logins at once. Every failure up to the threshold should
+	// be counted, the rest refused because of the lock, and the account
+	// should end up locked.
+	const attempts = 5
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.Authenticate(ctx, "bob@example.com", "wrong", "192.0.2.1")
+		}()
+	}
+	wg.Wait()
+
+	var failedLogins int
+	err = db.QueryRow("SELECT failed_logins FROM users WHERE email = ?", "bob@example.com").Scan(&failedLogins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failedLogins != 3 {
+		t.Errorf("want %d failed logins; got %d", 3, failedLogins)
+	}
+
+	_, err = m.Authenticate(ctx, "bob@example.com", "validPa$$word", "192.0.2.1")
+	if err != models.ErrAccountLocked {
+		t.Errorf("want %v; got %v", models.ErrAccountLocked, err)
+	}
+}
+
+func TestUserModelResetPassword(t *testing.T) {
+	if testing.Short() {
+		t.Skip("mysql: skipping integration test")
+	}
+
+	db, teardown := newTestDB(t)
+	defer teardown()
+
+	ctx := context.Background()
+	m := UserModel{DB: db}
+
+	if _, err := m.CreatePasswordReset(ctx, "nobody@example.com", time.Hour); err != models.ErrNoRecord {
+		t.Errorf("want %v; got %v", models.ErrNoRecord, err)
+	}
+
+	expired, err := m.CreatePasswordReset(ctx, "alice@example.com", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ResetPassword(ctx, expired, "newPa$$word1"); err != models.ErrInvalidToken {
+		t.Errorf("expired token: want %v; got %v", models.ErrInvalidToken, err)
+	}
+
+	token, err := m.CreatePasswordReset(ctx, "alice@example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A login link sent before the reset stops working after it.
+	loginToken, err := m.CreateLoginToken(ctx, "alice@example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Creating a token deletes the user's expired ones.
+	var stale int
+	err = db.QueryRow("SELECT COUNT(*) FROM password_resets WHERE expires <= UTC_TIMESTAMP()").Scan(&stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale != 0 {
+		t.Errorf("want %d expired tokens; got %d", 0, stale)
+	}
+
+	id, err := m.ResetPassword(ctx, token, "newPa$$word1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The token can only be used once.
+	if _, err := m.ResetPassword(ctx, token, "newPa$$word2"); err != models.ErrInvalidToken {
+		t.Errorf("reused token: want %v; got %v", models.ErrInvalidToken, err)
+	}
+
+	if _, err := m.Authenticate(ctx, "alice@example.com", "newPa$$word1", "192.0.2.1"); err != nil {
+		t.Errorf("want login with new password; got %v", err)
+	}
+
+	if _, err := m.ConsumeLoginToken(ctx, loginToken); err != models.ErrInvalidToken {
+		t.Errorf("login token after reset: want %v; got %v", models.ErrInvalidToken, err)
+	}
+
+	user, err := m.Get(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.SessionVersion != 1 {
+		t.Errorf("want session version 1; got %d", user.SessionVersion)
+	}
+}
+
+func TestUserModelChangePassword(t *testing.T) {
+	if testing.Short() {
+		t.Skip("mysql: skipping integration test")
+	}
+
+	db, teardown := newTestDB(t)
+	defer teardown()
+
+	ctx := context.Background()
+	m := UserModel{DB: db}
+
+	id, err := m.Insert(ctx, "Bob", "bob@example.com", "validPa$$word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loginToken, err := m.CreateLoginToken(ctx, "bob@example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.ChangePassword(ctx, id, "wrong", "newPa$$word1"); err != models.ErrInvalidCredentials {
+		t.Errorf("wrong password: want %v; got %v", models.ErrInvalidCredentials, err)
+	}
+
+	if err := m.ChangePassword(ctx, id, "validPa$$word", "newPa$$word1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.ConsumeLoginToken(ctx, loginToken); err != models.ErrInvalidToken {
+		t.Errorf("login token after change: want %v; got %v", models.ErrInvalidToken, err)
+	}
+}
+
+func TestUserModelLoginToken(t *testing.T) {
+	if testing.Short() {
+		t.Skip("mysql: skipping integration test")
+	}
+
+	db, teardown := newTestDB(t)
+	defer teardown()
+
+	ctx := context.Background()
+	m := UserModel{DB: db}
+
+	if _, err := m.CreateLoginToken(ctx, "nobody@example.com", time.Hour); err != models.ErrNoRecord {
+		t.Errorf("want %v; got %v", models.ErrNoRecord, err)
+	}
+
+	expired, err := m.CreateLoginToken(ctx, "alice@example.com", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ConsumeLoginToken(ctx, expired); err != models.ErrInvalidToken {
+		t.Errorf("expired token: want %v; got %v", models.ErrInvalidToken, err)
+	}
+
+	first, err := m.CreateLoginToken(ctx, "alice@example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Creating a token deletes the user's expired ones.
+	var stale int
+	err = db.QueryRow("SELECT COUNT(*) FROM login_tokens WHERE expires <= UTC_TIMESTAMP()").Scan(&stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale != 0 {
+		t.Errorf("want %d expired tokens; got %d", 0, stale)
+	}
+	second, err := m.CreateLoginToken(ctx, "alice@example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := m.ConsumeLoginToken(ctx, second)
+	if err != nil || id != 1 {
+		t.Fatalf("want 1, nil; got %d, %v", id, err)
+	}
+
+	// Neither the used token nor the other one sent before it work again.
+	for _, token := range []string{second, first} {
+		if _, err := m.ConsumeLoginToken(ctx, token); err != models.ErrInvalidToken {
+			t.Errorf("reused token: want %v; got %v", models.ErrInvalidToken, err)
+		}
+	}
+}
+
+func TestUserModelTOTP(t *testing.T) {
+	if testing.Short() {
+		t.Skip("mysql: skipping integration test")
+	}
+
+	db, teardown := newTestDB(t)
+	defer teardown()
+
+	ctx := context.Background()
+	m := UserModel{DB: db}
+
+	id, err := m.Insert(ctx, "Bob", "bob@example.com", "validPa$$word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const secret = "JBSWY3DPEHPK3PXP"
+	code := func() string {
+		c, err := totp.GenerateCode(secret, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	if err := m.AuthenticateTOTP(ctx, id, code()); err != models.ErrInvalidCredentials {
+		t.Errorf("not enabled: want %v; got %v", models.ErrInvalidCredentials, err)
+	}
+
+	if _, err := m.EnableTOTP(ctx, id, secret, "000000"); err != models.ErrInvalidCredentials {
+		t.Errorf("wrong code: want %v; got %v", models.ErrInvalidCredentials, err)
+	}
+
+	codes, err := m.EnableTOTP(ctx, id, secret, code())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := m.Get(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.TOTPEnabled {
+		t.Error("want TOTP enabled")
+	}
+
+	// The code used to enable TOTP can't be used again to log in.
+	if err := m.AuthenticateTOTP(ctx, id, code()); err != models.ErrInvalidCredentials {
+		t.Errorf("reused code: want %v; got %v", models.ErrInvalidCredentials, err)
+	}
+
+	// Each recovery code works once.
+	if err := m.AuthenticateTOTP(ctx, id, codes[0]); err != nil {
+		t.Errorf("recovery code: want nil; got %v", err)
+	}
+	if err := m.AuthenticateTOTP(ctx, id, codes[0]); err != models.ErrInvalidCredentials {
+		t.Errorf("reused recovery code: want %v; got %v", models.ErrInvalidCredentials, err)
+	}
+
+	if err := m.DisableTOTP(ctx, id, "wrongPa$$word"); err != models.ErrInvalidCredentials {
+		t.Errorf("wrong password: want %v; got %v", models.ErrInvalidCredentials, err)
+	}
+	if err := m.DisableTOTP(ctx, id, "validPa$$word"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AuthenticateTOTP(ctx, id, codes[1]); err != models.ErrInvalidCredentials {
+		t.Errorf("disabled: want %v; got %v", models.ErrInvalidCredentials, err)
+	}
+}
+
+func TestUserModelAuthenticateIdentity(t *testing.T) {
+	if testing.Short() {
+		t.Skip("mysql: skipping integration test")
+	}
+
+	db, teardown := newTestDB(t)
+	defer teardown()
+
+	ctx := context.Background()
+	m := UserModel{DB: db}
+
+	const issuer = "https://idp.example.com"
+
+	// An unverified address doesn't link to the existing user.
+	_, err := m.AuthenticateIdentity(ctx, &models.Identity{Issuer: issuer, Subject: "a1", Email: "alice@example.com"}, true)
+	if err != models.ErrDuplicateEmail {
+		t.Errorf("unverified email: want %v; got %v", models.ErrDuplicateEmail, err)
+	}
+
+	// A verified one does, and after that the subject alone is enough.
+	id, err := m.AuthenticateIdentity(ctx, &models.Identity{Issuer: issuer, Subject: "a1", Email: "alice@example.com", EmailVerified: true}, false)
+	if err != nil || id != 1 {
+		t.Errorf("link: want 1, nil; got %d, %v", id, err)
+	}
+	id, err = m.AuthenticateIdentity(ctx, &models.Identity{Issuer: issuer, Subject: "a1", Email: "changed@example.com"}, false)
+	if err != nil || id != 1 {
+		t.Errorf("linked: want 1, nil; got %d, %v", id, err)
+	}
+
+	// Unknown users are only created when provisioning is turned on, and
+	// the provider has verified their address.
+	bob := &models.Identity{Issuer: issuer, Subject: "b2", Email: "bob@example.com", EmailVerified: true, Name: "Bob"}
+	if _, err := m.AuthenticateIdentity(ctx, bob, false); err != models.ErrNoRecord {
+		t.Errorf("no provisioning: want %v; got %v", models.ErrNoRecord, err)
+	}
+	unverified := &models.Identity{Issuer: issuer, Subject: "b2", Email: "bob@example.com", Name: "Bob"}
+	if _, err := m.AuthenticateIdentity(ctx, unverified, true); err != models.ErrUnverifiedEmail {
+		t.Errorf("unverified provisioning: want %v; got %v", models.ErrUnverifiedEmail, err)
+	}
+	id, err = m.AuthenticateIdentity(ctx, bob, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := m.Get(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "Bob" || user.Email != "bob@example.com" || !user.EmailVerified {
+		t.Errorf("want provisioned user Bob; got %+v", user)
+	}
+
+	again, err := m.AuthenticateIdentity(ctx, bob, true)
+	if err != nil || again != id {
+		t.Errorf("provisioned: want %d, nil; got %d, %v", id, again, err)
+	}
+}
+
+func TestUserModelAdmin(t *testing.T) {
+	if testing.Short() {
+		t.Skip("mysql: skipping integration test")
+	}
+
+	db, teardown := newTestDB(t)
+	defer teardown()
+
+	ctx := context.Background()
+	m := UserModel{DB: db}
+
+	if _, err := m.Insert(ctx, "Bob Smith", "bob@example.com", "validPa$$word"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"bob@example.com", "alice@example.com"}},
+		{"alice", []string{"alice@example.com"}},
+		{"Smith", []string{"bob@example.com"}},
+		{"%", nil},
+	} {
+		users, err := m.Search(ctx, tt.query, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, u := range users {
+			got = append(got, u.Email)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("search %q: want %v; got %v", tt.query, tt.want, got)
+		}
+	}
+
+	if err := m.MakeAdmin(ctx, "nobody@example.com"); err != models.ErrNoRecord {
+		t.Errorf("unknown email: want %v; got %v", models.ErrNoRecord, err)
+	}
+	if err := m.MakeAdmin(ctx, "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetRole(ctx, 99, models.RoleModerator); err != models.ErrNoRecord {
+		t.Errorf("unknown user: want %v; got %v", models.ErrNoRecord, err)
+	}
+	if err := m.SetRole(ctx, 2, models.RoleModerator); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deactivating a user logs out their sessions, and they can't log in
+	// until they are reactivated.
+	if err := m.SetActive(ctx, 2, false); err != nil {
+		t.Fatal(err)
+	}
+	user, err := m.Get(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != models.RoleModerator || user.Active || user.SessionVersion != 1 {
+		t.Errorf("want a deactivated moderator with session version 1; got %q, %v, %d", user.Role, user.Active, user.SessionVersion)
+	}
+	if err := m.SetActive(ctx, 2, true); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := m.Get(ctx, 2); !user.Active || user.SessionVersion != 1 {
+		t.Errorf("want an active user with session version 1; got %v, %d", user.Active, user.SessionVersion)
+	}
+
+	stats, err := (&StatsModel{DB: db}).Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &models.Stats{Users: 2, ActiveUsers: 2, VerifiedUsers: 1, Moderators: 1, Admins: 1}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("want %+v; got %+v", want, stats)
+	}
+}
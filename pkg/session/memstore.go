@@ -0,0 +1,74 @@
+package session
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store which keeps sessions in memory. They are lost when
+// the application restarts and aren't shared between instances, so it's
+// only suitable for development, tests and single-instance deployments.
+type MemoryStore struct {
+	mu       sync.Mutex
+	sessions map[string]memoryRecord
+}
+
+type memoryRecord struct {
+	data   []byte
+	expiry time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: map[string]memoryRecord{}}
+}
+
+func (s *MemoryStore) Find(ctx context.Context, token string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.sessions[token]
+	if !ok || !time.Now().Before(rec.expiry) {
+		return nil, false, nil
+	}
+	return rec.data, true, nil
+}
+
+func (s *MemoryStore) Commit(ctx context.Context, token string, data []byte, expiry time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[token] = memoryRecord{data: data, expiry: expiry}
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, token)
+	return nil
+}
+
+func (s *MemoryStore) DeleteExpired(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for token, rec := range s.sessions {
+		if !now.Before(rec.expiry) {
+			delete(s.sessions, token)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of sessions in the store, including expired ones
+// which haven't been deleted yet.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.sessions)
+}
@@ -0,0 +1,397 @@
+// Package session provides server-side sessions. The session data is kept in
+// a Store, and the browser's cookie only holds a random token which
+// identifies it, so the data isn't limited to what fits in a cookie and a
+// session can be ended for good by deleting it from the store.
+package session
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Store is implemented by anything which can keep session data. Tokens are
+// only ever created by the Manager; a store may hash them before keeping
+// them. Find must not return sessions which have expired, and DeleteExpired
+// is called periodically to throw them away.
+type Store interface {
+	Find(ctx context.Context, token string) (data []byte, found bool, err error)
+	Commit(ctx context.Context, token string, data []byte, expiry time.Time) error
+	Delete(ctx context.Context, token string) error
+	DeleteExpired(ctx context.Context) error
+}
+
+// ErrNoSession is the panic raised when the session is used in a handler
+// which hasn't been wrapped with the Enable middleware.
+var ErrNoSession = errors.New("session: no session in request context (is the Enable middleware missing?)")
+
+type contextKey string
+
+var contextKeyData = contextKey("data")
+
+// Manager loads and saves sessions from its Store. Use the Enable middleware
+// to wrap the handlers which use sessions.
+type Manager struct {
+	Store Store
+
+	// Lifetime is how long a session lasts from when it's created or its
+	// token is renewed. It isn't extended by using the session.
+	Lifetime time.Duration
+
+	// The session cookie's name and attributes.
+	Cookie struct {
+		Name     string
+		Path     string
+		Secure   bool
+		SameSite http.SameSite
+	}
+
+	// ErrorFunc is called to send the response if the session can't be
+	// loaded or saved. By default the error is logged and a plain 500
+	// Internal Server Error response is sent.
+	ErrorFunc func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// New returns a Manager which keeps its sessions in store, with a lifetime
+// of 24 hours and a cookie named "session".
+func New(store Store) *Manager {
+	m := &Manager{
+		Store:     store,
+		Lifetime:  24 * time.Hour,
+		ErrorFunc: defaultErrorFunc,
+	}
+	m.Cookie.Name = "session"
+	m.Cookie.Path = "/"
+	m.Cookie.SameSite = http.SameSiteLaxMode
+	return m
+}
+
+func defaultErrorFunc(w http.ResponseWriter, r *http.Request, err error) {
+	log.Output(2, err.Error())
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+// The status of a session's data since it was loaded.
+type status int
+
+const (
+	unmodified status = iota
+	modified
+	destroyed
+)
+
+// The data type holds a session while a request is being handled. The
+// token is empty for a new session which hasn't been saved yet, and
+// oldToken is the token it was loaded with if that has been renewed, so
+// that it can be deleted when the session is saved.
+type data struct {
+	mu       sync.Mutex
+	token    string
+	oldToken string
+	deadline time.Time
+	values   map[string]interface{}
+	status   status
+}
+
+// The record type is what is encoded and kept in the store.
+type record struct {
+	Deadline time.Time
+	Values   map[string]interface{}
+}
+
+func (m *Manager) newData() *data {
+	return &data{
+		deadline: time.Now().Add(m.Lifetime).UTC(),
+		values:   map[string]interface{}{},
+	}
+}
+
+// The newToken() function generates a random 256-bit session token.
+func newToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Enable is middleware which loads the session for the request's cookie,
+// or starts a new one, and saves it after the handler has run if it has
+// been changed. The response is buffered until then, so that the cookie can
+// still be set and errors saving the session can still be reported.
+func (m *Manager) Enable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The session may already have been loaded by an outer handler.
+		if _, ok := r.Context().Value(contextKeyData).(*data); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		d, err := m.load(r)
+		if err != nil {
+			m.ErrorFunc(w, r, err)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), contextKeyData, d))
+
+		bw := &bufferedResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(bw, r)
+
+		if err := m.save(w, r, d); err != nil {
+			m.ErrorFunc(w, r, err)
+			return
+		}
+
+		if bw.code != 0 {
+			w.WriteHeader(bw.code)
+		}
+		w.Write(bw.buf.Bytes())
+	})
+}
+
+// The load() method returns the session for the request's cookie. A missing,
+// unknown or expired token gets a new, empty session.
+func (m *Manager) load(r *http.Request) (*data, error) {
+	cookie, err := r.Cookie(m.Cookie.Name)
+	if err == http.ErrNoCookie {
+		return m.newData(), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	b, found, err := m.Store.Find(r.Context(), cookie.Value)
+	if err != nil {
+		return nil, err
+	} else if !found {
+		return m.newData(), nil
+	}
+
+	var rec record
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&rec); err != nil {
+		return nil, err
+	}
+	if time.Now().After(rec.Deadline) {
+		return m.newData(), nil
+	}
+	if rec.Values == nil {
+		rec.Values = map[string]interface{}{}
+	}
+
+	return &data{token: cookie.Value, deadline: rec.Deadline, values: rec.Values}, nil
+}
+
+// The save() method writes a modified session to the store and sets the
+// cookie, or deletes a destroyed session and expires the cookie.
+func (m *Manager) save(w http.ResponseWriter, r *http.Request, d *data) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.status == unmodified {
+		return nil
+	}
+
+	cookie := &http.Cookie{
+		Name:     m.Cookie.Name,
+		Path:     m.Cookie.Path,
+		Secure:   m.Cookie.Secure,
+		HttpOnly: true,
+		SameSite: m.Cookie.SameSite,
+	}
+
+	if d.status == destroyed {
+		for _, token := range []string{d.oldToken, d.token} {
+			if token == "" {
+				continue
+			}
+			if err := m.Store.Delete(r.Context(), token); err != nil {
+				return err
+			}
+		}
+		cookie.Expires = time.Unix(1, 0)
+		cookie.MaxAge = -1
+		http.SetCookie(w, cookie)
+		return nil
+	}
+
+	if d.token == "" {
+		d.token = newToken()
+	}
+
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(record{Deadline: d.deadline, Values: d.values}); err != nil {
+		return err
+	}
+	if err := m.Store.Commit(r.Context(), d.token, b.Bytes(), d.deadline); err != nil {
+		return err
+	}
+
+	// A renewed token replaces the old one, which must stop working.
+	if d.oldToken != "" {
+		if err := m.Store.Delete(r.Context(), d.oldToken); err != nil {
+			return err
+		}
+		d.oldToken = ""
+	}
+
+	cookie.Value = d.token
+	cookie.Expires = time.Unix(d.deadline.Unix()+1, 0)
+	cookie.MaxAge = int(time.Until(d.deadline).Seconds() + 1)
+	w.Header().Add("Vary", "Cookie")
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+func dataFromContext(r *http.Request) *data {
+	d, ok := r.Context().Value(contextKeyData).(*data)
+	if !ok {
+		panic(ErrNoSession)
+	}
+	return d
+}
+
+// Put adds a value to the session, replacing any existing value for the key.
+// Only basic types (strings, numbers and so on) can be stored.
+func (m *Manager) Put(r *http.Request, key string, val interface{}) {
+	d := dataFromContext(r)
+
+	d.mu.Lock()
+	d.values[key] = val
+	if d.status == unmodified {
+		d.status = modified
+	}
+	d.mu.Unlock()
+}
+
+// Get returns the value for the key, or nil if there isn't one.
+func (m *Manager) Get(r *http.Request, key string) interface{} {
+	d := dataFromContext(r)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.values[key]
+}
+
+// GetString returns the string value for the key, or the empty string if
+// there isn't one or it isn't a string.
+func (m *Manager) GetString(r *http.Request, key string) string {
+	s, _ := m.Get(r, key).(string)
+	return s
+}
+
+// GetInt returns the int value for the key, or zero if there isn't one or it
+// isn't an int.
+func (m *Manager) GetInt(r *http.Request, key string) int {
+	i, _ := m.Get(r, key).(int)
+	return i
+}
+
+// GetBool returns the bool value for the key, or false if there isn't one
+// or it isn't a bool.
+func (m *Manager) GetBool(r *http.Request, key string) bool {
+	b, _ := m.Get(r, key).(bool)
+	return b
+}
+
+// PopString returns the string value for the key and removes it from the
+// session, like GetString followed by Remove.
+func (m *Manager) PopString(r *http.Request, key string) string {
+	d := dataFromContext(r)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	val, ok := d.values[key]
+	if !ok {
+		return ""
+	}
+	delete(d.values, key)
+	if d.status == unmodified {
+		d.status = modified
+	}
+
+	s, _ := val.(string)
+	return s
+}
+
+// Exists reports whether the session has a value for the key.
+func (m *Manager) Exists(r *http.Request, key string) bool {
+	d := dataFromContext(r)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, ok := d.values[key]
+	return ok
+}
+
+// Remove deletes the value for the key from the session, if there is one.
+func (m *Manager) Remove(r *http.Request, key string) {
+	d := dataFromContext(r)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.values[key]; !ok {
+		return
+	}
+	delete(d.values, key)
+	if d.status == unmodified {
+		d.status = modified
+	}
+}
+
+// RenewToken gives the session a new token, keeping its data, and restarts
+// its lifetime. The old token stops working when the session is saved. Call
+// it whenever the user's privileges change, like when they log in or out,
+// so that an attacker who has planted a token in the user's browser
+// (session fixation) doesn't share the logged in session.
+func (m *Manager) RenewToken(r *http.Request) {
+	d := dataFromContext(r)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// If the token has already been renewed during this request, the new
+	// one was never saved, so the one to delete is still the original.
+	if d.oldToken == "" {
+		d.oldToken = d.token
+	}
+	d.token = newToken()
+	d.deadline = time.Now().Add(m.Lifetime).UTC()
+	d.status = modified
+}
+
+// Destroy deletes the session from the store and expires the cookie. Any
+// later changes to the session during the request are discarded.
+func (m *Manager) Destroy(r *http.Request) {
+	d := dataFromContext(r)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.values = map[string]interface{}{}
+	d.status = destroyed
+}
+
+// The bufferedResponseWriter type holds on to the response while the
+// handler runs, so that the session can be saved first.
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	buf  bytes.Buffer
+	code int
+}
+
+func (bw *bufferedResponseWriter) Write(b []byte) (int, error) {
+	return bw.buf.Write(b)
+}
+
+func (bw *bufferedResponseWriter) WriteHeader(code int) {
+	if bw.code == 0 {
+		bw.code = code
+	}
+}
@@ -0,0 +1,142 @@
+package session
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// The newTestManager() helper returns a Manager with a MemoryStore, and a
+// handler using it which runs the handler function for the request path.
+func newTestManager(handlers map[string]func(m *Manager, r *http.Request) string) (*Manager, *MemoryStore, http.Handler) {
+	store := NewMemoryStore()
+	m := New(store)
+
+	h := m.Enable(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(handlers[r.URL.Path](m, r)))
+	}))
+	return m, store, h
+}
+
+// The do() helper sends a request to h with the given session cookie (if
+// it isn't empty) and returns the body and the session cookie in the
+// response, or nil if it didn't set one.
+func do(t *testing.T, h http.Handler, path, token string) (string, *http.Cookie) {
+	r := httptest.NewRequest("GET", path, nil)
+	if token != "" {
+		r.AddCookie(&http.Cookie{Name: "session", Value: token})
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == "session" {
+			return rr.Body.String(), c
+		}
+	}
+	return rr.Body.String(), nil
+}
+
+var testHandlers = map[string]func(m *Manager, r *http.Request) string{
+	"/put": func(m *Manager, r *http.Request) string {
+		m.Put(r, "name", "alice")
+		m.Put(r, "id", 1)
+		return ""
+	},
+	"/get": func(m *Manager, r *http.Request) string {
+		if m.GetInt(r, "id") != 1 {
+			return ""
+		}
+		return m.GetString(r, "name")
+	},
+	"/pop": func(m *Manager, r *http.Request) string {
+		return m.PopString(r, "name")
+	},
+	"/renew": func(m *Manager, r *http.Request) string {
+		m.RenewToken(r)
+		return ""
+	},
+	"/destroy": func(m *Manager, r *http.Request) string {
+		m.Destroy(r)
+		return ""
+	},
+}
+
+func TestManager(t *testing.T) {
+	_, store, h := newTestManager(testHandlers)
+
+	// Reading a new session doesn't save it.
+	if _, cookie := do(t, h, "/get", ""); cookie != nil {
+		t.Errorf("want no cookie; got %q", cookie.Value)
+	}
+
+	_, cookie := do(t, h, "/put", "")
+	if cookie == nil {
+		t.Fatal("want a session cookie; got none")
+	}
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("want an HttpOnly, SameSite=Lax cookie; got %v", cookie)
+	}
+	token := cookie.Value
+
+	if body, _ := do(t, h, "/get", token); body != "alice" {
+		t.Errorf("want %q; got %q", "alice", body)
+	}
+
+	// An unknown token gets an empty session.
+	if body, _ := do(t, h, "/get", "unknown"); body != "" {
+		t.Errorf("unknown token: want %q; got %q", "", body)
+	}
+
+	// Renewing the token keeps the data, but the old token stops working.
+	_, cookie = do(t, h, "/renew", token)
+	if cookie == nil || cookie.Value == token {
+		t.Fatal("want a new session token")
+	}
+	renewed := cookie.Value
+	if body, _ := do(t, h, "/get", token); body != "" {
+		t.Errorf("old token: want %q; got %q", "", body)
+	}
+	if body, _ := do(t, h, "/get", renewed); body != "alice" {
+		t.Errorf("new token: want %q; got %q", "alice", body)
+	}
+
+	if body, _ := do(t, h, "/pop", renewed); body != "alice" {
+		t.Errorf("pop: want %q; got %q", "alice", body)
+	}
+	if body, _ := do(t, h, "/pop", renewed); body != "" {
+		t.Errorf("second pop: want %q; got %q", "", body)
+	}
+
+	_, cookie = do(t, h, "/destroy", renewed)
+	if cookie == nil || cookie.MaxAge >= 0 {
+		t.Errorf("want the cookie to be expired; got %v", cookie)
+	}
+	if n := store.Len(); n != 0 {
+		t.Errorf("want 0 sessions in the store; got %d", n)
+	}
+}
+
+func TestManagerExpiry(t *testing.T) {
+	m, store, h := newTestManager(testHandlers)
+	m.Lifetime = -time.Minute
+
+	_, cookie := do(t, h, "/put", "")
+	if cookie == nil {
+		t.Fatal("want a session cookie; got none")
+	}
+
+	if body, _ := do(t, h, "/get", cookie.Value); body != "" {
+		t.Errorf("expired session: want %q; got %q", "", body)
+	}
+
+	if err := store.DeleteExpired(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := store.Len(); n != 0 {
+		t.Errorf("want 0 sessions in the store; got %d", n)
+	}
+}
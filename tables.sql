@@ -18,11 +18,143 @@ CREATE TABLE users (
     id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT, name VARCHAR(255) NOT NULL,
     email VARCHAR(255) NOT NULL,
     hashed_password CHAR(60) NOT NULL,
-    created DATETIME NOT NULL
+    created DATETIME NOT NULL,
+    email_verified BOOLEAN NOT NULL DEFAULT FALSE,
+    failed_logins INTEGER NOT NULL DEFAULT 0,
+    locked_until DATETIME,
+    last_login DATETIME,
+    last_login_ip VARCHAR(45),
+    session_version INTEGER NOT NULL DEFAULT 0,
+    totp_secret VARCHAR(64),
+    totp_last_step BIGINT NOT NULL DEFAULT 0,
+    role VARCHAR(16) NOT NULL DEFAULT 'user',
+    active BOOLEAN NOT NULL DEFAULT TRUE
 );
 
 ALTER TABLE users ADD CONSTRAINT users_uc_email UNIQUE (email);
 
+-- Create a `password_resets` table, holding the hashes of the tokens in
+-- password reset links.
+CREATE TABLE password_resets (
+    token_hash CHAR(64) NOT NULL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    expires DATETIME NOT NULL
+);
+CREATE INDEX idx_password_resets_user_id ON password_resets(user_id);
+
+-- Create a `login_tokens` table, holding the hashes of the tokens in
+-- emailed login links.
+CREATE TABLE login_tokens (
+    token_hash CHAR(64) NOT NULL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    expires DATETIME NOT NULL
+);
+CREATE INDEX idx_login_tokens_user_id ON login_tokens(user_id);
+
+-- Create a `recovery_codes` table, holding the hashes of the one-time codes
+-- which users with two-factor authentication can log in with if they lose
+-- their authenticator app.
+CREATE TABLE recovery_codes (
+    user_id INTEGER NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    PRIMARY KEY (user_id, code_hash)
+);
+
+-- Create a `webauthn_credentials` table, holding the public keys of the
+-- passkeys which users have registered to log in with.
+CREATE TABLE webauthn_credentials (
+    id VARBINARY(255) NOT NULL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    public_key BLOB NOT NULL,
+    attestation_type VARCHAR(32) NOT NULL,
+    aaguid VARBINARY(16) NOT NULL,
+    transports VARCHAR(255) NOT NULL,
+    sign_count INTEGER UNSIGNED NOT NULL,
+    backup_eligible BOOLEAN NOT NULL,
+    backup_state BOOLEAN NOT NULL,
+    created DATETIME NOT NULL,
+    last_used DATETIME
+);
+CREATE INDEX idx_webauthn_credentials_user_id ON webauthn_credentials(user_id);
+
+-- Create a `user_identities` table, linking users to their accounts at an
+-- OpenID Connect provider for single sign-on.
+CREATE TABLE user_identities (
+    issuer VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    user_id INTEGER NOT NULL,
+    created DATETIME NOT NULL,
+    PRIMARY KEY (issuer, subject)
+);
+CREATE INDEX idx_user_identities_user_id ON user_identities(user_id);
+
+-- Create a `sessions` table, holding the session data for the session
+-- manager, keyed by the hash of the token in the session cookie.
+CREATE TABLE sessions (
+    token_hash CHAR(64) NOT NULL PRIMARY KEY,
+    data BLOB NOT NULL,
+    expiry DATETIME(6) NOT NULL
+);
+CREATE INDEX idx_sessions_expiry ON sessions(expiry);
+
+-- Create a `user_sessions` table, the registry of logged in sessions. The
+-- ID is stored in the session data, and the session is only authenticated
+-- while its row exists.
+CREATE TABLE user_sessions (
+    id CHAR(43) NOT NULL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    created DATETIME NOT NULL,
+    last_seen DATETIME NOT NULL,
+    expires DATETIME NOT NULL,
+    ip VARCHAR(45) NOT NULL,
+    user_agent VARCHAR(255) NOT NULL
+);
+CREATE INDEX idx_user_sessions_user_id ON user_sessions(user_id);
+
+-- Create a `remember_tokens` table, holding the "remember me" token
+-- families which log users back in when their session expires. Only the
+-- hashes of the validators are stored.
+CREATE TABLE remember_tokens (
+    selector CHAR(16) NOT NULL PRIMARY KEY,
+    validator_hash CHAR(64) NOT NULL,
+    previous_validator_hash CHAR(64),
+    rotated DATETIME,
+    user_id INTEGER NOT NULL,
+    session_id CHAR(43) NOT NULL,
+    created DATETIME NOT NULL,
+    expires DATETIME NOT NULL
+);
+CREATE INDEX idx_remember_tokens_user_id ON remember_tokens(user_id);
+
+-- To upgrade an existing database, add the email verification, account
+-- lockout, last login and session version columns to the `users` table (the
+-- existing users' addresses are treated as verified)
+-- ALTER TABLE users
+--     ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE,
+--     ADD COLUMN failed_logins INTEGER NOT NULL DEFAULT 0,
+--     ADD COLUMN locked_until DATETIME,
+--     ADD COLUMN last_login DATETIME,
+--     ADD COLUMN last_login_ip VARCHAR(45),
+--     ADD COLUMN session_version INTEGER NOT NULL DEFAULT 0;
+-- UPDATE users SET email_verified = TRUE;
+-- and create the `password_resets` table above. For two-factor
+-- authentication, add the TOTP columns
+-- ALTER TABLE users
+--     ADD COLUMN totp_secret VARCHAR(64),
+--     ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;
+-- and create the `recovery_codes` table above. For passkeys, create the
+-- `webauthn_credentials` table above, and for single sign-on the
+-- `user_identities` table. For login links, create the `login_tokens`
+-- table, and for the session registry the `user_sessions` table (everyone
+-- will need to log in again). For server-side sessions, create the
+-- `sessions` table, and for "remember me" the `remember_tokens` table. For
+-- roles and the admin area, add the role and active columns
+-- ALTER TABLE users
+--     ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'user',
+--     ADD COLUMN active BOOLEAN NOT NULL DEFAULT TRUE;
+-- and make yourself an admin with the -make-admin flag.
+
 -- Create a test database
 CREATE DATABASE test_snippetbox CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
 
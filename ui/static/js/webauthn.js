@@ -0,0 +1,116 @@
+// Registering and logging in with passkeys. The WebAuthn options from the
+// server and the credentials we send back contain binary values, which are
+// base64url encoded in the JSON.
+function base64urlToBuffer(s) {
+	var b64 = s.replace(/-/g, "+").replace(/_/g, "/");
+	var bin = atob(b64);
+	var buf = new Uint8Array(bin.length);
+	for (var i = 0; i < bin.length; i++) {
+		buf[i] = bin.charCodeAt(i);
+	}
+	return buf.buffer;
+}
+
+function bufferToBase64url(buf) {
+	var bytes = new Uint8Array(buf);
+	var bin = "";
+	for (var i = 0; i < bytes.length; i++) {
+		bin += String.fromCharCode(bytes[i]);
+	}
+	return btoa(bin).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
+
+// Send the CSRF token from the form in a header, because the body is JSON.
+function postJSON(url, form, body) {
+	return fetch(url, {
+		method: "POST",
+		credentials: "same-origin",
+		headers: {
+			"Content-Type": "application/json",
+			"X-CSRF-Token": form.elements["csrf_token"].value
+		},
+		body: body ? JSON.stringify(body) : null
+	}).then(function(resp) {
+		if (!resp.ok) {
+			throw new Error(resp.statusText);
+		}
+		return resp.json();
+	});
+}
+
+function showError(form, message) {
+	var error = form.querySelector(".error");
+	if (!error) {
+		error = document.createElement("div");
+		error.className = "error";
+		form.insertBefore(error, form.firstChild);
+	}
+	error.textContent = message;
+}
+
+var loginForm = document.getElementById("passkey-login");
+if (loginForm && window.PublicKeyCredential) {
+	loginForm.addEventListener("submit", function(e) {
+		e.preventDefault();
+		postJSON("/user/passkey/login/begin", loginForm).then(function(options) {
+			var pk = options.publicKey;
+			pk.challenge = base64urlToBuffer(pk.challenge);
+			(pk.allowCredentials || []).forEach(function(c) {
+				c.id = base64urlToBuffer(c.id);
+			});
+			return navigator.credentials.get({publicKey: pk});
+		}).then(function(cred) {
+			return postJSON("/user/passkey/login/finish", loginForm, {
+				id: cred.id,
+				rawId: bufferToBase64url(cred.rawId),
+				type: cred.type,
+				response: {
+					authenticatorData: bufferToBase64url(cred.response.authenticatorData),
+					clientDataJSON: bufferToBase64url(cred.response.clientDataJSON),
+					signature: bufferToBase64url(cred.response.signature),
+					userHandle: bufferToBase64url(cred.response.userHandle)
+				}
+			});
+		}).then(function(result) {
+			window.location = result.redirect;
+		}).catch(function() {
+			showError(loginForm, "Logging in with a passkey didn't work. Please try again, or log in with your password.");
+		});
+	});
+}
+
+var registerForm = document.getElementById("passkey-register");
+if (registerForm && window.PublicKeyCredential) {
+	registerForm.addEventListener("submit", function(e) {
+		e.preventDefault();
+		var name = registerForm.elements["name"].value.trim();
+		if (!name) {
+			showError(registerForm, "Please give the passkey a name.");
+			return;
+		}
+		postJSON("/account/passkeys/register/begin", registerForm).then(function(options) {
+			var pk = options.publicKey;
+			pk.challenge = base64urlToBuffer(pk.challenge);
+			pk.user.id = base64urlToBuffer(pk.user.id);
+			(pk.excludeCredentials || []).forEach(function(c) {
+				c.id = base64urlToBuffer(c.id);
+			});
+			return navigator.credentials.create({publicKey: pk});
+		}).then(function(cred) {
+			return postJSON("/account/passkeys/register/finish?name=" + encodeURIComponent(name), registerForm, {
+				id: cred.id,
+				rawId: bufferToBase64url(cred.rawId),
+				type: cred.type,
+				response: {
+					attestationObject: bufferToBase64url(cred.response.attestationObject),
+					clientDataJSON: bufferToBase64url(cred.response.clientDataJSON),
+					transports: cred.response.getTransports ? cred.response.getTransports() : []
+				}
+			});
+		}).then(function(result) {
+			window.location = result.redirect;
+		}).catch(function() {
+			showError(registerForm, "The passkey couldn't be added. Please try again.");
+		});
+	});
+}